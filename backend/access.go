@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// accessMutationAttempts bounds how often a read-modify-write is restarted
+// after a concurrent edit is detected.
+const accessMutationAttempts = 5
+
+// errConcurrentModification is returned when the policy or group kept
+// changing under us for every attempt.
+var errConcurrentModification = errors.New("access resource was modified concurrently")
+
+// Structs for Cloudflare API
+type CFAccessPolicyResponse struct {
+	Success bool             `json:"success"`
+	Errors  []CFError        `json:"errors"`
+	Result  CFAccessResource `json:"result"`
+}
+
+// CFAccessResource is a reusable Access policy or an Access Group.
+type CFAccessResource struct {
+	Name      string       `json:"name"`
+	Decision  string       `json:"decision,omitempty"`
+	Include   []AccessRule `json:"include"`
+	Exclude   []AccessRule `json:"exclude"`
+	Require   []AccessRule `json:"require"`
+	UpdatedAt string       `json:"updated_at,omitempty"`
+}
+
+// version identifies a revision of the resource. Cloudflare bumps
+// updated_at on every write; the rule fingerprint covers writes that land
+// within the timestamp's resolution.
+func (r CFAccessResource) version() string {
+	var rules []string
+	for _, set := range [][]AccessRule{r.Include, r.Exclude, r.Require} {
+		for _, rule := range set {
+			rules = append(rules, canonicalRuleJSON(rule))
+		}
+		rules = append(rules, "|")
+	}
+	b, _ := json.Marshal(rules)
+	sum := sha256.Sum256(b)
+	return r.UpdatedAt + "/" + hex.EncodeToString(sum[:8])
+}
+
+// CFAccessPolicyUpdate is the PUT body for a policy or an Access Group.
+// Groups have no decision, so it is omitted when empty.
+type CFAccessPolicyUpdate struct {
+	Name     string       `json:"name"`
+	Decision string       `json:"decision,omitempty"`
+	Include  []AccessRule `json:"include"`
+	Exclude  []AccessRule `json:"exclude"`
+	Require  []AccessRule `json:"require"`
+}
+
+// accessProvider whitelists IPs as ip include rules on an account-level
+// Cloudflare Zero Trust Access resource: a reusable policy or an Access Group.
+// Both expose the same include/exclude/require rule sets.
+type accessProvider struct {
+	name     string
+	kind     string  // "policy" or "group", used in logs and errors
+	resource string  // API collection, e.g. "access/policies"
+	id       *string // resource ID, read at call time so tests can swap it
+	idEnv    string
+}
+
+// accessMutationQueues serializes read-modify-writes per Access resource,
+// shared by every provider instance that points at the same resource.
+var (
+	accessMutationQueuesMu sync.Mutex
+	accessMutationQueues   = map[string]chan struct{}{}
+)
+
+// acquire waits for this process's turn to mutate the resource. Waiters are
+// released in arrival order; the wait is abandoned if ctx is done.
+func (p *accessProvider) acquire(ctx context.Context) (release func(), err error) {
+	accessMutationQueuesMu.Lock()
+	queue, ok := accessMutationQueues[p.path()]
+	if !ok {
+		queue = make(chan struct{}, 1)
+		accessMutationQueues[p.path()] = queue
+	}
+	accessMutationQueuesMu.Unlock()
+
+	select {
+	case queue <- struct{}{}:
+		return func() { <-queue }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// newAccessPolicyProvider manages a reusable Access policy (CLOUDFLARE_POLICY_ID).
+func newAccessPolicyProvider() *accessProvider {
+	return &accessProvider{
+		name:     "access_policy",
+		kind:     "policy",
+		resource: "access/policies",
+		id:       &policyID,
+		idEnv:    "CLOUDFLARE_POLICY_ID",
+	}
+}
+
+// newAccessGroupProvider manages an Access Group (CLOUDFLARE_GROUP_ID), so a
+// whitelisted IP unlocks every application whose policies reference the group.
+func newAccessGroupProvider() *accessProvider {
+	return &accessProvider{
+		name:     "access_group",
+		kind:     "group",
+		resource: "access/groups",
+		id:       &groupID,
+		idEnv:    "CLOUDFLARE_GROUP_ID",
+	}
+}
+
+func (p *accessProvider) Name() string { return p.name }
+
+func (p *accessProvider) MissingConfig() []string {
+	var missing []string
+	if apiToken == "" {
+		missing = append(missing, "CLOUDFLARE_API_TOKEN")
+	}
+	if accountID == "" {
+		missing = append(missing, "CLOUDFLARE_ACCOUNT_ID")
+	}
+	if *p.id == "" {
+		missing = append(missing, p.idEnv)
+	}
+	return missing
+}
+
+func (p *accessProvider) path() string {
+	return fmt.Sprintf("%s/%s", p.resource, *p.id)
+}
+
+// Contains checks if an IP is allowed by an ip include rule. A bare address
+// matches any rule whose network contains it; a CIDR must match exactly.
+func (p *accessProvider) Contains(ctx context.Context, ip string) (bool, error) {
+	if !providerConfigured(p) {
+		return false, fmt.Errorf("cloudflare credentials not configured")
+	}
+
+	prefix, err := parseIPOrPrefix(ip)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := cfRequest(ctx, "GET", p.path(), nil)
+	if err != nil {
+		return false, err
+	}
+
+	if prefix.IsSingleIP() {
+		return coversAddr(res.Result.Include, prefix.Addr()), nil
+	}
+	return findIPRule(res.Result.Include, prefix) >= 0, nil
+}
+
+// List returns the IPs and networks of all ip include rules
+func (p *accessProvider) List(ctx context.Context) ([]string, error) {
+	if !providerConfigured(p) {
+		return nil, fmt.Errorf("cloudflare credentials not configured")
+	}
+
+	res, err := cfRequest(ctx, "GET", p.path(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []string
+	for _, rule := range res.Result.Include {
+		if prefix, ok := rule.Prefix(); ok {
+			ips = append(ips, prefixString(prefix))
+		}
+	}
+
+	return ips, nil
+}
+
+func (p *accessProvider) FindRule(ctx context.Context, ip string) (string, bool, error) {
+	if !providerConfigured(p) {
+		return "", false, fmt.Errorf("cloudflare credentials not configured")
+	}
+
+	prefix, err := parseIPOrPrefix(ip)
+	if err != nil {
+		return "", false, err
+	}
+
+	res, err := cfRequest(ctx, "GET", p.path(), nil)
+	if err != nil {
+		return "", false, err
+	}
+	return "", findIPRule(res.Result.Include, prefix) >= 0, nil
+}
+
+// cfRequest calls an account-level Access endpoint.
+func cfRequest(ctx context.Context, method, path string, body interface{}) (*CFAccessPolicyResponse, error) {
+	var res CFAccessPolicyResponse
+	env, err := cfCall(ctx, method, fmt.Sprintf("accounts/%s/%s", accountID, path), body, &res.Result)
+	if err != nil {
+		return nil, err
+	}
+	res.Success = env.Success
+	res.Errors = env.Errors
+	return &res, nil
+}
+
+// mutateInclude performs a read-modify-write of the include rules.
+//
+// Mutations from this process are serialized through acquire. Cloudflare
+// offers no conditional PUT, so edits made elsewhere (the dashboard, another
+// replica) are detected twice. Right before the PUT the resource is read
+// again and its version (updated_at and a hash of the rules) compared with
+// the first read, so an edit made since is not overwritten. After the PUT
+// it is read back: the exclude and require rules and every include rule
+// that isn't a target must be exactly what was written, and verify must
+// accept the include rules, which catches an edit racing the PUT itself.
+// Either way the whole cycle restarts from a fresh read.
+//
+// apply returns the new include rules and whether anything changed;
+// isTarget reports whether a rule is one apply may have added or removed.
+// The result reports whether this call made a PUT, including one that a
+// retry then found already in place.
+func (p *accessProvider) mutateInclude(ctx context.Context, apply func([]AccessRule) ([]AccessRule, bool), isTarget func(AccessRule) bool, verify func([]AccessRule) bool) (bool, error) {
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return false, fmt.Errorf("waiting to update %s: %w", p.kind, err)
+	}
+	defer release()
+
+	put := false
+	for attempt := 1; attempt <= accessMutationAttempts; attempt++ {
+		// 1. Get Policy
+		res, err := cfRequest(ctx, "GET", p.path(), nil)
+		if err != nil {
+			return put, fmt.Errorf("failed to get %s: %w", p.kind, err)
+		}
+		policy := res.Result
+
+		// 2. Apply the change
+		include, changed := apply(policy.Include)
+		if !changed {
+			return put, nil
+		}
+
+		// 3. Make sure nobody changed it since we read it
+		current, err := cfRequest(ctx, "GET", p.path(), nil)
+		if err != nil {
+			return put, fmt.Errorf("failed to get %s: %w", p.kind, err)
+		}
+		if current.Result.version() != policy.version() {
+			log.Printf("[Cloudflare] %s %s changed since it was read (attempt %d), retrying", p.kind, *p.id, attempt)
+			continue
+		}
+
+		// 4. Update
+		updatePayload := CFAccessPolicyUpdate{
+			Name:     policy.Name,
+			Decision: policy.Decision,
+			Include:  include,
+			Exclude:  policy.Exclude,
+			Require:  policy.Require,
+		}
+
+		log.Printf("[Cloudflare] Sending PUT request to update %s", p.kind)
+		if _, err := cfRequest(ctx, "PUT", p.path(), updatePayload); err != nil {
+			return put, fmt.Errorf("failed to update %s: %w", p.kind, err)
+		}
+		put = true
+
+		// 5. Verify
+		verifyRes, err := cfRequest(ctx, "GET", p.path(), nil)
+		if err != nil {
+			return put, fmt.Errorf("failed to verify %s update: %w", p.kind, err)
+		}
+		written := verifyRes.Result
+		if sameRules(written.Exclude, policy.Exclude) && sameRules(written.Require, policy.Require) &&
+			sameRules(withoutTargets(written.Include, isTarget), withoutTargets(include, isTarget)) &&
+			verify(written.Include) {
+			return put, nil
+		}
+		log.Printf("[Cloudflare] %s %s was changed concurrently with our update (attempt %d), retrying", p.kind, *p.id, attempt)
+	}
+
+	return put, fmt.Errorf("%w: gave up after %d attempts", errConcurrentModification, accessMutationAttempts)
+}
+
+// withoutTargets returns the rules for which isTarget is false.
+func withoutTargets(rules []AccessRule, isTarget func(AccessRule) bool) []AccessRule {
+	var kept []AccessRule
+	for _, rule := range rules {
+		if !isTarget(rule) {
+			kept = append(kept, rule)
+		}
+	}
+	return kept
+}
+
+// sameRules reports whether a and b hold the same rules in the same order,
+// ignoring how Cloudflare formats their JSON.
+func sameRules(a, b []AccessRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if canonicalRuleJSON(a[i]) != canonicalRuleJSON(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalRuleJSON re-encodes a rule with sorted keys and no whitespace.
+func canonicalRuleJSON(rule AccessRule) string {
+	raw, err := json.Marshal(rule)
+	if err != nil {
+		return ""
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return string(raw)
+	}
+	canonical, _ := json.Marshal(v)
+	return string(canonical)
+}
+
+// Add adds the IP to the Access policy or group. Concurrent calls are
+// coalesced into a single update (see accessBatcher).
+func (p *accessProvider) Add(ctx context.Context, req RuleRequest) (string, error) {
+	ip := req.IP
+	if !providerConfigured(p) {
+		log.Println("Skipping Cloudflare update: API credentials not configured")
+		return "", nil
+	}
+
+	prefix, err := parseIPOrPrefix(ip)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("[Cloudflare] Attempting to add IP %s to %s %s", ip, p.kind, *p.id)
+	return "", p.submit(ctx, ip, prefix, true)
+}
+
+// Remove removes the IP from the Access policy or group. Concurrent calls
+// are coalesced into a single update (see accessBatcher).
+func (p *accessProvider) Remove(ctx context.Context, ip, _ string) error {
+	if !providerConfigured(p) {
+		log.Println("Skipping Cloudflare removal: API credentials not configured")
+		return nil
+	}
+
+	prefix, err := parseIPOrPrefix(ip)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[Cloudflare] Attempting to remove IP %s from %s %s", ip, p.kind, *p.id)
+	return p.submit(ctx, ip, prefix, false)
+}
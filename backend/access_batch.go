@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// accessBatchTimeout bounds how long applying one coalesced batch may take.
+// It is independent of the waiting requests, which may give up earlier.
+const accessBatchTimeout = 2 * time.Minute
+
+// accessChange is an add or remove waiting to be applied to an Access
+// resource.
+type accessChange struct {
+	ip     string
+	prefix netip.Prefix
+	add    bool
+	trace  *cfTrace   // of the submitter; gets the Ray IDs of the batch
+	result chan error // buffered; receives exactly one value
+}
+
+// accessBatcher coalesces the changes submitted to one Access resource
+// within writeCoalesceWindow into a single read-modify-write, so a burst of
+// requests (or a sweep of the expiry daemon) costs one GET/PUT/verify cycle
+// instead of one per IP.
+type accessBatcher struct {
+	p       *accessProvider
+	mu      sync.Mutex
+	pending []*accessChange
+}
+
+var (
+	accessBatchersMu sync.Mutex
+	accessBatchers   = map[string]*accessBatcher{}
+)
+
+// batcher returns the batcher for p's resource, shared by every provider
+// instance that points at it.
+func (p *accessProvider) batcher() *accessBatcher {
+	accessBatchersMu.Lock()
+	defer accessBatchersMu.Unlock()
+
+	b, ok := accessBatchers[p.path()]
+	if !ok {
+		b = &accessBatcher{p: p}
+		accessBatchers[p.path()] = b
+	}
+	return b
+}
+
+// submit queues a change and waits for the result of the batch it lands in.
+// The wait outlives ctx: the batch applies the change regardless, and the
+// caller has to learn the outcome to keep the store in step with it.
+// accessBatchTimeout bounds it instead.
+func (p *accessProvider) submit(ctx context.Context, ip string, prefix netip.Prefix, add bool) error {
+	c := &accessChange{ip: ip, prefix: prefix, add: add, trace: cfTraceOf(ctx), result: make(chan error, 1)}
+
+	b := p.batcher()
+	b.mu.Lock()
+	b.pending = append(b.pending, c)
+	if len(b.pending) == 1 {
+		time.AfterFunc(writeCoalesceWindow, b.flush)
+	}
+	b.mu.Unlock()
+
+	return <-c.result
+}
+
+// flush applies everything pending and reports the outcome to each waiter.
+func (b *accessBatcher) flush() {
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), accessBatchTimeout)
+	defer cancel()
+	ctx, trace := withCFTrace(ctx)
+
+	if len(batch) > 1 {
+		log.Printf("[Cloudflare] Coalescing %d changes into one %s update", len(batch), b.p.kind)
+	}
+	b.apply(ctx, batch)
+	// Every change in the batch was made by the same calls
+	rays := trace.Rays()
+	for _, c := range batch {
+		c.trace.add(rays...)
+	}
+}
+
+// apply applies batch and reports each change's own outcome. When
+// Cloudflare rejects the update, the batch is split in halves that are
+// applied separately, so an invalid change only fails its own request.
+// Other failures, like an outage, are the same for every change and fail
+// the whole batch at once.
+func (b *accessBatcher) apply(ctx context.Context, batch []*accessChange) {
+	err := b.p.applyBatch(ctx, batch)
+	if err != nil && len(batch) > 1 && rejectedUpdate(err) {
+		log.Printf("[Cloudflare] %s rejected %d changes, applying them in halves: %v", b.p.kind, len(batch), err)
+		half := len(batch) / 2
+		b.apply(ctx, batch[:half])
+		b.apply(ctx, batch[half:])
+		return
+	}
+	for _, c := range batch {
+		c.result <- err
+	}
+}
+
+// rejectedUpdate reports whether Cloudflare refused an update for its
+// content, rather than failing it for reasons unrelated to the rules in it.
+func rejectedUpdate(err error) bool {
+	var apiErr *CFAPIError
+	return errors.As(err, &apiErr) &&
+		(apiErr.StatusCode == http.StatusBadRequest || apiErr.StatusCode == http.StatusUnprocessableEntity)
+}
+
+// applyBatch applies the changes in submission order with a single
+// mutateInclude. When the same network is both added and removed in one
+// batch, the last change wins and is what gets verified.
+func (p *accessProvider) applyBatch(ctx context.Context, batch []*accessChange) error {
+	want := make(map[netip.Prefix]bool, len(batch))
+	for _, c := range batch {
+		want[c.prefix] = c.add
+	}
+
+	changed, err := p.mutateInclude(ctx,
+		func(include []AccessRule) ([]AccessRule, bool) {
+			include = append([]AccessRule(nil), include...)
+			changed := false
+			for _, c := range batch {
+				exists := findIPRule(include, c.prefix) >= 0
+				switch {
+				case c.add && exists:
+					log.Printf("[Cloudflare] IP %s already exists in %s, skipping add", c.ip, p.kind)
+				case c.add:
+					include = append(include, NewAccessIPRule(c.prefix))
+					changed = true
+				case exists:
+					// Only the exact network; broader rules are left alone
+					include = removeIPRule(include, c.prefix)
+					changed = true
+				default:
+					log.Printf("[Cloudflare] IP %s not found in %s, nothing to remove", c.ip, p.kind)
+				}
+			}
+			return include, changed
+		},
+		func(rule AccessRule) bool {
+			prefix, ok := rule.Prefix()
+			_, target := want[prefix]
+			return ok && target
+		},
+		func(include []AccessRule) bool {
+			for prefix, present := range want {
+				if (findIPRule(include, prefix) >= 0) != present {
+					return false
+				}
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		for _, c := range batch {
+			if c.add {
+				log.Printf("[Cloudflare] Successfully added and verified IP %s in %s", c.ip, p.kind)
+			} else {
+				log.Printf("[Cloudflare] Successfully removed and verified IP %s from %s", c.ip, p.kind)
+			}
+		}
+	}
+	return nil
+}
+
+// removeIPRule returns rules without the ip rules for exactly prefix.
+func removeIPRule(rules []AccessRule, prefix netip.Prefix) []AccessRule {
+	kept := rules[:0]
+	for _, rule := range rules {
+		if rulePrefix, ok := rule.Prefix(); ok && rulePrefix == prefix {
+			continue
+		}
+		kept = append(kept, rule)
+	}
+	return kept
+}
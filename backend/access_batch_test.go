@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func withCoalesceWindow(t *testing.T, d time.Duration) {
+	t.Helper()
+	orig := writeCoalesceWindow
+	writeCoalesceWindow = d
+	t.Cleanup(func() { writeCoalesceWindow = orig })
+}
+
+func TestAccessProviderCoalescesBurst(t *testing.T) {
+	fake := newFakePolicy()
+	withFakeCloudflare(t, fake)
+	withCoalesceWindow(t, 50*time.Millisecond)
+	p := newAccessPolicyProvider()
+
+	ips := []string{"198.51.100.1", "198.51.100.2", "not-an-ip", "198.51.100.3"}
+	errs := make([]error, len(ips))
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		wg.Add(1)
+		go func(i int, ip string) {
+			defer wg.Done()
+			_, errs[i] = p.Add(context.Background(), RuleRequest{IP: ip})
+		}(i, ip)
+	}
+	wg.Wait()
+
+	for i, ip := range ips {
+		if ip == "not-an-ip" {
+			if errs[i] == nil {
+				t.Error("Add(not-an-ip) expected an error")
+			}
+		} else if errs[i] != nil {
+			t.Errorf("Add(%s) error: %v", ip, errs[i])
+		}
+	}
+	if len(fake.puts) != 1 {
+		t.Errorf("PUT count = %d, want 1 for the whole burst", len(fake.puts))
+	}
+	if got, _ := p.List(context.Background()); len(got) != 3 {
+		t.Errorf("List() = %v, want 3 IPs", got)
+	}
+}
+
+func TestAccessProviderAddOutlivesCallerContext(t *testing.T) {
+	fake := newFakePolicy()
+	withFakeCloudflare(t, fake)
+	withCoalesceWindow(t, 50*time.Millisecond)
+	p := newAccessPolicyProvider()
+
+	// The client went away while the change was waiting for its batch
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := p.Add(ctx, RuleRequest{IP: "198.51.100.1"}); err != nil {
+		t.Fatalf("Add() error = %v, want the outcome of the applied batch", err)
+	}
+	if got, _ := p.List(context.Background()); len(got) != 1 {
+		t.Errorf("List() = %v, want the added IP", got)
+	}
+}
+
+func TestAccessProviderBatchTracesRayIDs(t *testing.T) {
+	fake := newFakePolicy()
+	withFakeCloudflare(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cf-Ray", r.Method+"-AMS")
+		fake.ServeHTTP(w, r)
+	}))
+	withCoalesceWindow(t, 50*time.Millisecond)
+	p := newAccessPolicyProvider()
+
+	traces := make([]*cfTrace, 2)
+	var wg sync.WaitGroup
+	for i := range traces {
+		ctx, trace := withCFTrace(context.Background())
+		traces[i] = trace
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p.Add(ctx, RuleRequest{IP: fmt.Sprintf("198.51.100.%d", i+1)})
+		}(i)
+	}
+	wg.Wait()
+
+	// Both changes were made by the one read/re-read/PUT/verify cycle
+	want := []string{"GET-AMS", "GET-AMS", "PUT-AMS", "GET-AMS"}
+	for i, trace := range traces {
+		if rays := trace.Rays(); !reflect.DeepEqual(rays, want) {
+			t.Errorf("Rays() of change %d = %v, want %v", i, rays, want)
+		}
+	}
+}
+
+func TestAccessProviderBatchReportsErrorsPerIP(t *testing.T) {
+	fake := newFakePolicy()
+	fake.rejectPut = func(body map[string]interface{}) bool {
+		include, _ := json.Marshal(body["include"])
+		return strings.Contains(string(include), "198.51.100.66")
+	}
+	withFakeCloudflare(t, fake)
+	withCoalesceWindow(t, 50*time.Millisecond)
+	p := newAccessPolicyProvider()
+
+	ips := []string{"198.51.100.1", "198.51.100.66", "198.51.100.2", "198.51.100.3"}
+	errs := make([]error, len(ips))
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		wg.Add(1)
+		go func(i int, ip string) {
+			defer wg.Done()
+			_, errs[i] = p.Add(context.Background(), RuleRequest{IP: ip})
+		}(i, ip)
+	}
+	wg.Wait()
+
+	for i, ip := range ips {
+		if rejected := ip == "198.51.100.66"; (errs[i] != nil) != rejected {
+			t.Errorf("Add(%s) error = %v, want one only for the rejected IP", ip, errs[i])
+		}
+	}
+	got, _ := p.List(context.Background())
+	sort.Strings(got)
+	if want := []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+}
+
+func TestAccessProviderBatchLastChangeWins(t *testing.T) {
+	fake := newFakePolicy()
+	fake.appendInclude(map[string]interface{}{"ip": map[string]interface{}{"ip": "198.51.100.9/32"}})
+	withFakeCloudflare(t, fake)
+	withCoalesceWindow(t, 50*time.Millisecond)
+	p := newAccessPolicyProvider()
+
+	var wg sync.WaitGroup
+	var addErr, removeErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, addErr = p.Add(context.Background(), RuleRequest{IP: "198.51.100.1"})
+	}()
+	go func() {
+		defer wg.Done()
+		removeErr = p.Remove(context.Background(), "198.51.100.9", "")
+	}()
+	wg.Wait()
+
+	if addErr != nil || removeErr != nil {
+		t.Fatalf("Add/Remove errors: %v, %v", addErr, removeErr)
+	}
+	got, _ := p.List(context.Background())
+	if len(got) != 1 || got[0] != "198.51.100.1" {
+		t.Errorf("List() = %v, want [198.51.100.1]", got)
+	}
+	if len(fake.puts) != 1 {
+		t.Errorf("PUT count = %d, want 1", len(fake.puts))
+	}
+}
+
+func TestRemoveExpiredCoalesces(t *testing.T) {
+	fake := newFakePolicy()
+	withFakeCloudflare(t, fake)
+	withCoalesceWindow(t, 50*time.Millisecond)
+
+	tmpfile, err := os.CreateTemp("", "whitelist_store_expiry.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	origStore, origStoreFile, origProvider := store, storeFile, provider
+	defer func() { store, storeFile, provider = origStore, origStoreFile, origProvider }()
+	storeFile = tmpfile.Name()
+	store = &WhitelistStore{Entries: make(map[string]time.Time)}
+	provider = newAccessPolicyProvider()
+
+	past := time.Now().Add(-time.Minute)
+	for i := 1; i <= 3; i++ {
+		ip := fmt.Sprintf("198.51.100.%d", i)
+		fake.appendInclude(map[string]interface{}{"ip": map[string]interface{}{"ip": ip + "/32"}})
+		store.Add(ip, past, EntryMeta{})
+	}
+	store.Add("198.51.100.4", time.Now().Add(time.Hour), EntryMeta{})
+
+	removeExpired(time.Now())
+
+	if len(fake.puts) != 1 {
+		t.Errorf("PUT count = %d, want 1 for the whole sweep", len(fake.puts))
+	}
+	if len(expiriesOf(t, store)) != 1 {
+		t.Errorf("store has %d entries, want only the unexpired one", len(expiriesOf(t, store)))
+	}
+}
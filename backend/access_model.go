@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+)
+
+// AccessRule is one entry of an Access include, exclude or require list.
+//
+// Cloudflare encodes each rule as an object with a single key naming its
+// kind, e.g. {"ip":{"ip":"203.0.113.7/32"}} or {"email":{"email":"a@b.c"}}.
+// The common kinds are decoded into typed fields; the original JSON is kept
+// and written back verbatim, so kinds this service does not know about (and
+// fields it does not model) survive a read-modify-write unchanged.
+type AccessRule struct {
+	IP          *AccessIPRule          `json:"ip,omitempty"`
+	Email       *AccessEmailRule       `json:"email,omitempty"`
+	EmailDomain *AccessEmailDomainRule `json:"email_domain,omitempty"`
+	Group       *AccessGroupRule       `json:"group,omitempty"`
+	Geo         *AccessGeoRule         `json:"geo,omitempty"`
+
+	raw json.RawMessage
+}
+
+type AccessIPRule struct {
+	IP string `json:"ip"`
+}
+
+type AccessEmailRule struct {
+	Email string `json:"email"`
+}
+
+type AccessEmailDomainRule struct {
+	Domain string `json:"domain"`
+}
+
+type AccessGroupRule struct {
+	ID string `json:"id"`
+}
+
+type AccessGeoRule struct {
+	CountryCode string `json:"country_code"`
+}
+
+// accessRuleJSON has AccessRule's fields but not its methods, so it gets
+// the default JSON encoding.
+type accessRuleJSON AccessRule
+
+// NewAccessIPRule returns an ip rule for prefix.
+func NewAccessIPRule(prefix netip.Prefix) AccessRule {
+	return AccessRule{IP: &AccessIPRule{IP: prefix.String()}}
+}
+
+func (r *AccessRule) UnmarshalJSON(b []byte) error {
+	var decoded accessRuleJSON
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return err
+	}
+	*r = AccessRule(decoded)
+	r.raw = append(json.RawMessage(nil), bytes.TrimSpace(b)...)
+	return nil
+}
+
+func (r AccessRule) MarshalJSON() ([]byte, error) {
+	if r.raw != nil {
+		return r.raw, nil
+	}
+	return json.Marshal(accessRuleJSON(r))
+}
+
+// Prefix returns the network of an ip rule. ok is false for other rule
+// kinds and for ip rules Cloudflare would not accept.
+func (r AccessRule) Prefix() (prefix netip.Prefix, ok bool) {
+	if r.IP == nil {
+		return netip.Prefix{}, false
+	}
+	prefix, err := parseIPOrPrefix(r.IP.IP)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return prefix, true
+}
+
+// parseIPOrPrefix parses "203.0.113.7", "203.0.113.0/24" or any IPv6 form
+// into a canonical prefix: masked, with IPv4-mapped IPv6 unmapped and a bare
+// address becoming a single-address (/32 or /128) prefix.
+func parseIPOrPrefix(s string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		addr := prefix.Addr()
+		bits := prefix.Bits()
+		if addr.Is4In6() {
+			if bits < 96 {
+				return netip.Prefix{}, fmt.Errorf("invalid IPv4-mapped prefix %q", s)
+			}
+			addr, bits = addr.Unmap(), bits-96
+		}
+		return netip.PrefixFrom(addr.WithZone(""), bits).Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address or prefix %q", s)
+	}
+	addr = addr.Unmap().WithZone("")
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// prefixString formats prefix the way List reports it: a bare address for
+// single-address prefixes, CIDR notation otherwise.
+func prefixString(prefix netip.Prefix) string {
+	if prefix.IsSingleIP() {
+		return prefix.Addr().String()
+	}
+	return prefix.String()
+}
+
+// findIPRule returns the index of the ip rule for exactly prefix, or -1.
+func findIPRule(rules []AccessRule, prefix netip.Prefix) int {
+	for i, rule := range rules {
+		if p, ok := rule.Prefix(); ok && p == prefix {
+			return i
+		}
+	}
+	return -1
+}
+
+// coversAddr reports whether any ip rule's network contains addr.
+func coversAddr(rules []AccessRule, addr netip.Addr) bool {
+	for _, rule := range rules {
+		if p, ok := rule.Prefix(); ok && p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+)
+
+func TestAccessRuleRoundTrip(t *testing.T) {
+	in := `[{"ip":{"ip":"203.0.113.7/32"}},{"email":{"email":"a@example.com"}},{"service_token":{"token_id":"abc"}},{"geo":{"country_code":"NL","extra":true}}]`
+
+	var rules []AccessRule
+	if err := json.Unmarshal([]byte(in), &rules); err != nil {
+		t.Fatalf("Unmarshal error: %v", err)
+	}
+	if rules[0].IP == nil || rules[1].Email == nil || rules[3].Geo == nil {
+		t.Fatalf("typed fields not decoded: %+v", rules)
+	}
+	if rules[2].IP != nil || rules[2].Email != nil {
+		t.Errorf("unknown rule kind decoded as a known one: %+v", rules[2])
+	}
+
+	out, err := json.Marshal(rules)
+	if err != nil {
+		t.Fatalf("Marshal error: %v", err)
+	}
+	if string(out) != in {
+		t.Errorf("round trip changed rules:\n got %s\nwant %s", out, in)
+	}
+
+	out, _ = json.Marshal(NewAccessIPRule(netip.MustParsePrefix("2001:db8::1/128")))
+	if want := `{"ip":{"ip":"2001:db8::1/128"}}`; string(out) != want {
+		t.Errorf("NewAccessIPRule = %s, want %s", out, want)
+	}
+}
+
+func TestParseIPOrPrefix(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"203.0.113.7", "203.0.113.7/32"},
+		{"203.0.113.7/32", "203.0.113.7/32"},
+		{"203.0.113.7/24", "203.0.113.0/24"},
+		{"::ffff:203.0.113.7", "203.0.113.7/32"},
+		{"2001:0db8:0000:0000:0000:0000:0000:0001", "2001:db8::1/128"},
+		{"2001:DB8::1/128", "2001:db8::1/128"},
+		{"2001:db8::1/64", "2001:db8::/64"},
+	}
+	for _, tt := range tests {
+		got, err := parseIPOrPrefix(tt.in)
+		if err != nil {
+			t.Errorf("parseIPOrPrefix(%q) error: %v", tt.in, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("parseIPOrPrefix(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "not-an-ip", "999.1.1.1", "1.2.3.4/33"} {
+		if _, err := parseIPOrPrefix(bad); err == nil {
+			t.Errorf("parseIPOrPrefix(%q) expected error", bad)
+		}
+	}
+}
+
+func TestFindIPRule(t *testing.T) {
+	var rules []AccessRule
+	json.Unmarshal([]byte(`[{"ip":{"ip":"10.0.0.0/8"}},{"ip":{"ip":"2001:0db8::0001/128"}},{"email":{"email":"ip@example.com"}}]`), &rules)
+
+	if i := findIPRule(rules, netip.MustParsePrefix("2001:db8::1/128")); i != 1 {
+		t.Errorf("findIPRule(IPv6) = %d, want 1", i)
+	}
+	if i := findIPRule(rules, netip.MustParsePrefix("10.1.2.3/32")); i != -1 {
+		t.Errorf("findIPRule(10.1.2.3/32) = %d, want -1 (only covered, not equal)", i)
+	}
+	if !coversAddr(rules, netip.MustParseAddr("10.1.2.3")) {
+		t.Error("coversAddr(10.1.2.3) = false, want true")
+	}
+	if coversAddr(rules, netip.MustParseAddr("192.0.2.1")) {
+		t.Error("coversAddr(192.0.2.1) = true, want false")
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+)
+
+// accessRuleNote is written to the notes field of every IP Access Rule this
+// service creates, so managed rules can be told apart from manual ones.
+const accessRuleNote = "Managed by cloudflare-whitelist-ip-service"
+
+// CFAccessRule is a firewall IP Access Rule.
+type CFAccessRule struct {
+	ID            string                `json:"id,omitempty"`
+	Mode          string                `json:"mode"`
+	Notes         string                `json:"notes"`
+	Configuration CFAccessRuleTarget    `json:"configuration"`
+	Scope         *CFAccessRuleScopeRef `json:"scope,omitempty"`
+}
+
+type CFAccessRuleTarget struct {
+	Target string `json:"target"`
+	Value  string `json:"value"`
+}
+
+type CFAccessRuleScopeRef struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// accessRulesProvider whitelists IPs with firewall IP Access Rules in
+// "whitelist" mode, at zone or account scope (CLOUDFLARE_ACCESS_RULE_SCOPE).
+type accessRulesProvider struct{}
+
+func (p *accessRulesProvider) Name() string { return "access_rules" }
+
+func (p *accessRulesProvider) MissingConfig() []string {
+	var missing []string
+	if apiToken == "" {
+		missing = append(missing, "CLOUDFLARE_API_TOKEN")
+	}
+	if accessRuleScope == "account" {
+		if accountID == "" {
+			missing = append(missing, "CLOUDFLARE_ACCOUNT_ID")
+		}
+	} else if zoneID == "" {
+		missing = append(missing, "CLOUDFLARE_ZONE_ID")
+	}
+	return missing
+}
+
+// rulesPath returns the access rules collection for the configured scope.
+func (p *accessRulesProvider) rulesPath() string {
+	if accessRuleScope == "account" {
+		return fmt.Sprintf("accounts/%s/firewall/access_rules/rules", accountID)
+	}
+	return fmt.Sprintf("zones/%s/firewall/access_rules/rules", zoneID)
+}
+
+// accessRuleTarget returns the configuration target Cloudflare expects for
+// ip: "ip_range" for a range (Cloudflare takes IPv4 /16 and /24 and IPv6
+// /32, /48 and /64), otherwise "ip" or "ip6".
+func accessRuleTarget(ip string) string {
+	prefix, err := parseIPOrPrefix(ip)
+	switch {
+	case err != nil:
+		return "ip"
+	case !prefix.IsSingleIP():
+		return "ip_range"
+	case prefix.Addr().Is6():
+		return "ip6"
+	}
+	return "ip"
+}
+
+// find returns the whitelist rules whose value is ip.
+func (p *accessRulesProvider) find(ctx context.Context, ip string) ([]CFAccessRule, error) {
+	q := url.Values{}
+	q.Set("mode", "whitelist")
+	q.Set("configuration.target", accessRuleTarget(ip))
+	q.Set("configuration.value", ip)
+
+	var rules []CFAccessRule
+	if _, err := cfCall(ctx, "GET", p.rulesPath()+"?"+q.Encode(), nil, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (p *accessRulesProvider) Add(ctx context.Context, req RuleRequest) (string, error) {
+	ip := req.IP
+	if !providerConfigured(p) {
+		log.Println("Skipping Cloudflare update: API credentials not configured")
+		return "", nil
+	}
+
+	log.Printf("[Cloudflare] Attempting to add IP Access Rule for %s", ip)
+
+	// Cloudflare rejects duplicate rules, so reuse an existing one, but
+	// only if it is ours: a manual rule would be deleted on expiry
+	existing, err := p.find(ctx, ip)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up access rules: %w", err)
+	}
+	for _, rule := range existing {
+		if !strings.HasPrefix(rule.Notes, accessRuleNote) {
+			log.Printf("[Cloudflare] IP %s already has access rule %s not managed by this service", ip, rule.ID)
+			return "", errForeignRule
+		}
+	}
+	if len(existing) > 0 {
+		log.Printf("[Cloudflare] IP %s already has access rule %s, skipping add", ip, existing[0].ID)
+		return existing[0].ID, nil
+	}
+
+	rule := CFAccessRule{
+		Mode:  "whitelist",
+		Notes: accessRuleNote + ": " + req.Comment(),
+		Configuration: CFAccessRuleTarget{
+			Target: accessRuleTarget(ip),
+			Value:  ip,
+		},
+	}
+	var created CFAccessRule
+	if _, err := cfCall(ctx, "POST", p.rulesPath(), rule, &created); err != nil {
+		return "", fmt.Errorf("failed to create access rule: %w", err)
+	}
+	if created.ID == "" {
+		return "", fmt.Errorf("access rule for IP %s created without an ID", ip)
+	}
+
+	log.Printf("[Cloudflare] Created access rule %s for IP %s", created.ID, ip)
+	return created.ID, nil
+}
+
+func (p *accessRulesProvider) Remove(ctx context.Context, ip, ruleID string) error {
+	if !providerConfigured(p) {
+		log.Println("Skipping Cloudflare removal: API credentials not configured")
+		return nil
+	}
+
+	// Fast path: delete the rule we created directly
+	if ruleID != "" {
+		_, err := cfCall(ctx, "DELETE", p.rulesPath()+"/"+ruleID, nil, nil)
+		if err == nil {
+			log.Printf("[Cloudflare] Deleted access rule %s for IP %s", ruleID, ip)
+			return nil
+		}
+		log.Printf("[Cloudflare] Deleting access rule %s failed (%v), looking up rules for IP %s", ruleID, err, ip)
+	}
+
+	rules, err := p.find(ctx, ip)
+	if err != nil {
+		return fmt.Errorf("failed to look up access rules: %w", err)
+	}
+	// Rules added by hand for the same IP are not ours to delete
+	managed := rules[:0]
+	for _, rule := range rules {
+		if strings.HasPrefix(rule.Notes, accessRuleNote) {
+			managed = append(managed, rule)
+		}
+	}
+	if len(managed) == 0 {
+		log.Printf("[Cloudflare] No managed access rule found for IP %s, nothing to remove", ip)
+		return nil
+	}
+
+	for _, rule := range managed {
+		if _, err := cfCall(ctx, "DELETE", p.rulesPath()+"/"+rule.ID, nil, nil); err != nil {
+			return fmt.Errorf("failed to delete access rule %s: %w", rule.ID, err)
+		}
+		log.Printf("[Cloudflare] Deleted access rule %s for IP %s", rule.ID, ip)
+	}
+	return nil
+}
+
+func (p *accessRulesProvider) Contains(ctx context.Context, ip string) (bool, error) {
+	if !providerConfigured(p) {
+		return false, fmt.Errorf("cloudflare credentials not configured")
+	}
+
+	rules, err := p.find(ctx, ip)
+	if err != nil {
+		return false, err
+	}
+	return len(rules) > 0, nil
+}
+
+// FindRule looks at every whitelist rule for ip, including manual ones.
+func (p *accessRulesProvider) FindRule(ctx context.Context, ip string) (string, bool, error) {
+	if !providerConfigured(p) {
+		return "", false, fmt.Errorf("cloudflare credentials not configured")
+	}
+
+	rules, err := p.find(ctx, ip)
+	if err != nil || len(rules) == 0 {
+		return "", false, err
+	}
+	return rules[0].ID, true, nil
+}
+
+// List returns the IPs of every whitelist rule, manual and adopted ones
+// included, just like Contains finds them.
+func (p *accessRulesProvider) List(ctx context.Context) ([]string, error) {
+	rules, err := p.listRules(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		ips = append(ips, rule.Configuration.Value)
+	}
+	return ips, nil
+}
+
+// ListManaged returns the rules created by this service with the expiry
+// and owner from their notes. A rule without them has a zero ExpiresAt.
+func (p *accessRulesProvider) ListManaged(ctx context.Context) ([]ManagedRule, error) {
+	rules, err := p.listRules(ctx, accessRuleNote)
+	if err != nil {
+		return nil, err
+	}
+	managed := make([]ManagedRule, 0, len(rules))
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule.Notes, accessRuleNote) {
+			continue
+		}
+		m := ManagedRule{IP: rule.Configuration.Value, RuleID: rule.ID}
+		comment := strings.TrimPrefix(strings.TrimPrefix(rule.Notes, accessRuleNote), ": ")
+		if expiresAt, by, ok := parseRuleComment(comment); ok {
+			m.ExpiresAt, m.By = expiresAt, by
+		}
+		managed = append(managed, m)
+	}
+	return managed, nil
+}
+
+// listRules returns every whitelist rule, only those whose notes contain
+// notes if it is set.
+func (p *accessRulesProvider) listRules(ctx context.Context, notes string) ([]CFAccessRule, error) {
+	if !providerConfigured(p) {
+		return nil, fmt.Errorf("cloudflare credentials not configured")
+	}
+
+	var all []CFAccessRule
+	for page := 1; ; page++ {
+		q := url.Values{}
+		q.Set("mode", "whitelist")
+		if notes != "" {
+			q.Set("notes", notes)
+		}
+		q.Set("per_page", "100")
+		q.Set("page", fmt.Sprint(page))
+
+		var rules []CFAccessRule
+		env, err := cfCall(ctx, "GET", p.rulesPath()+"?"+q.Encode(), nil, &rules)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, rules...)
+		if env.ResultInfo == nil || page >= env.ResultInfo.TotalPages {
+			break
+		}
+	}
+	return all, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAccessRules is an in-memory stand-in for the zone access rules API.
+type fakeAccessRules struct {
+	mu      sync.Mutex
+	rules   map[string]CFAccessRule
+	nextID  int
+	deletes []string
+}
+
+func (f *fakeAccessRules) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	const base = "/zones/zone/firewall/access_rules/rules"
+	switch {
+	case r.Method == "GET" && r.URL.Path == base:
+		value := r.URL.Query().Get("configuration.value")
+		notes := r.URL.Query().Get("notes")
+		result := []CFAccessRule{}
+		for _, rule := range f.rules {
+			if value != "" && rule.Configuration.Value != value {
+				continue
+			}
+			if notes != "" && !strings.Contains(rule.Notes, notes) {
+				continue
+			}
+			result = append(result, rule)
+		}
+		writeCFResult(w, result)
+	case r.Method == "POST" && r.URL.Path == base:
+		var rule CFAccessRule
+		json.NewDecoder(r.Body).Decode(&rule)
+		f.nextID++
+		rule.ID = fmt.Sprintf("rule%d", f.nextID)
+		f.rules[rule.ID] = rule
+		writeCFResult(w, rule)
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, base+"/"):
+		id := strings.TrimPrefix(r.URL.Path, base+"/")
+		if _, ok := f.rules[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "errors": []string{"not found"}})
+			return
+		}
+		delete(f.rules, id)
+		f.deletes = append(f.deletes, id)
+		writeCFResult(w, map[string]string{"id": id})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestAccessRulesProvider(t *testing.T) {
+	fake := &fakeAccessRules{rules: map[string]CFAccessRule{
+		"manual": {ID: "manual", Mode: "whitelist", Notes: "office", Configuration: CFAccessRuleTarget{Target: "ip", Value: "9.9.9.9"}},
+	}}
+	withFakeCloudflare(t, fake)
+	ctx := context.Background()
+	p := &accessRulesProvider{}
+
+	ruleID, err := p.Add(ctx, RuleRequest{IP: "1.2.3.4"})
+	if err != nil {
+		t.Fatalf("Add() error: %v", err)
+	}
+	if ruleID == "" {
+		t.Fatal("Add() returned empty rule ID")
+	}
+	if got := fake.rules[ruleID]; !strings.HasPrefix(got.Notes, accessRuleNote) || got.Configuration.Target != "ip" {
+		t.Errorf("created rule = %+v, want managed ip rule", got)
+	}
+
+	// Adding again reuses the existing rule
+	again, err := p.Add(ctx, RuleRequest{IP: "1.2.3.4"})
+	if err != nil || again != ruleID {
+		t.Errorf("second Add() = %q, %v; want %q, nil", again, err, ruleID)
+	}
+
+	found, err := p.Contains(ctx, "1.2.3.4")
+	if err != nil || !found {
+		t.Errorf("Contains() = %v, %v; want true, nil", found, err)
+	}
+
+	ips, err := p.List(ctx)
+	if err != nil {
+		t.Fatalf("List() error: %v", err)
+	}
+	// Manual rules count, as they do for Contains
+	sort.Strings(ips)
+	if strings.Join(ips, " ") != "1.2.3.4 9.9.9.9" {
+		t.Errorf("List() = %v, want [1.2.3.4 9.9.9.9]", ips)
+	}
+	managed, err := p.ListManaged(ctx)
+	if err != nil || len(managed) != 1 || managed[0].IP != "1.2.3.4" || managed[0].RuleID != ruleID {
+		t.Errorf("ListManaged() = %+v, %v; want only the managed rule", managed, err)
+	}
+
+	if err := p.Remove(ctx, "1.2.3.4", ruleID); err != nil {
+		t.Fatalf("Remove() error: %v", err)
+	}
+	if len(fake.deletes) != 1 || fake.deletes[0] != ruleID {
+		t.Errorf("deletes = %v, want [%s]", fake.deletes, ruleID)
+	}
+
+	// A stale rule ID falls back to looking the rule up by value
+	ruleID, _ = p.Add(ctx, RuleRequest{IP: "2001:db8::1"})
+	if got := fake.rules[ruleID].Configuration.Target; got != "ip6" {
+		t.Errorf("IPv6 target = %q, want ip6", got)
+	}
+	if err := p.Remove(ctx, "2001:db8::1", "stale"); err != nil {
+		t.Fatalf("Remove() with stale ID error: %v", err)
+	}
+	if _, ok := fake.rules[ruleID]; ok {
+		t.Error("rule still present after Remove with stale ID")
+	}
+
+	// The fallback never deletes a rule added by hand
+	if err := p.Remove(ctx, "9.9.9.9", "stale"); err != nil {
+		t.Fatalf("Remove() of manual rule error: %v", err)
+	}
+	if _, ok := fake.rules["manual"]; !ok {
+		t.Error("manual rule deleted by Remove fallback")
+	}
+}
+
+func TestAccessRuleTarget(t *testing.T) {
+	tests := []struct {
+		ip, want string
+	}{
+		{"1.2.3.4", "ip"},
+		{"::ffff:1.2.3.4", "ip"},
+		{"2001:db8::1", "ip6"},
+		{"198.51.100.0/24", "ip_range"},
+		{"2001:db8::/48", "ip_range"},
+		{"1.2.3.4/32", "ip"},
+	}
+	for _, tt := range tests {
+		if got := accessRuleTarget(tt.ip); got != tt.want {
+			t.Errorf("accessRuleTarget(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+
+	fake := &fakeAccessRules{rules: map[string]CFAccessRule{}}
+	withFakeCloudflare(t, fake)
+	ruleID, err := (&accessRulesProvider{}).Add(context.Background(), RuleRequest{IP: "198.51.100.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.rules[ruleID].Configuration; got.Target != "ip_range" || got.Value != "198.51.100.0/24" {
+		t.Errorf("range rule configuration = %+v", got)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAccessResource is an in-memory Access policy or group served at path.
+// Every PUT bumps updated_at. onGet, if set, runs before each GET is served
+// and can simulate edits made outside the service.
+type fakeAccessResource struct {
+	mu       sync.Mutex
+	path     string
+	resource map[string]interface{}
+	puts     []map[string]interface{}
+	gets     int
+	onGet    func(f *fakeAccessResource)
+	// rejectPut makes Cloudflare refuse a PUT of body with a 400
+	rejectPut func(body map[string]interface{}) bool
+}
+
+func (f *fakeAccessResource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path != f.path {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		f.gets++
+		if f.onGet != nil {
+			f.onGet(f)
+		}
+		writeCFResult(w, f.resource)
+	case "PUT":
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if f.rejectPut != nil && f.rejectPut(body) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"errors":  []CFError{{Code: 12130, Message: "access.api.error.invalid_request"}},
+			})
+			return
+		}
+		f.puts = append(f.puts, body)
+		f.resource = body
+		f.touch()
+		writeCFResult(w, body)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// touch bumps updated_at like Cloudflare does on every write.
+func (f *fakeAccessResource) touch() {
+	f.resource["updated_at"] = fmt.Sprintf("2030-01-01T00:00:%02dZ", len(f.puts)+f.gets)
+}
+
+// appendInclude adds an include rule, as an edit in the dashboard would.
+func (f *fakeAccessResource) appendInclude(rule map[string]interface{}) {
+	include, _ := f.resource["include"].([]interface{})
+	f.resource["include"] = append(include, rule)
+	f.touch()
+}
+
+func newFakePolicy() *fakeAccessResource {
+	return &fakeAccessResource{
+		path: "/accounts/account/access/policies/policy",
+		resource: map[string]interface{}{
+			"name":     "Whitelist",
+			"decision": "allow",
+			"include":  []interface{}{},
+			"exclude":  []interface{}{},
+			"require":  []interface{}{},
+		},
+	}
+}
+
+func TestAccessGroupProvider(t *testing.T) {
+	fake := &fakeAccessResource{
+		path: "/accounts/account/access/groups/group",
+		resource: map[string]interface{}{
+			"name":    "Whitelisted IPs",
+			"include": []interface{}{map[string]interface{}{"email": map[string]interface{}{"email": "admin@example.com"}}},
+			"exclude": []interface{}{},
+			"require": []interface{}{},
+		},
+	}
+	withFakeCloudflare(t, fake)
+
+	origGroupID := groupID
+	groupID = "group"
+	defer func() { groupID = origGroupID }()
+
+	ctx := context.Background()
+	p := newAccessGroupProvider()
+
+	if _, err := p.Add(ctx, RuleRequest{IP: "1.2.3.4"}); err != nil {
+		t.Fatalf("Add() error: %v", err)
+	}
+	if len(fake.puts) != 1 || fake.gets != 3 {
+		t.Fatalf("PUT count = %d, GET count = %d; want 1 PUT between a read, a re-read and a verify", len(fake.puts), fake.gets)
+	}
+	if _, ok := fake.puts[0]["decision"]; ok {
+		t.Error("group update must not send a decision")
+	}
+	if got := len(fake.puts[0]["include"].([]interface{})); got != 2 {
+		t.Errorf("include rules after Add = %d, want 2", got)
+	}
+
+	found, err := p.Contains(ctx, "1.2.3.4")
+	if err != nil || !found {
+		t.Errorf("Contains() = %v, %v; want true, nil", found, err)
+	}
+
+	if err := p.Remove(ctx, "1.2.3.4", ""); err != nil {
+		t.Fatalf("Remove() error: %v", err)
+	}
+	ips, err := p.List(ctx)
+	if err != nil || len(ips) != 0 {
+		t.Errorf("List() after Remove = %v, %v; want empty", ips, err)
+	}
+	if got := len(fake.resource["include"].([]interface{})); got != 1 {
+		t.Errorf("include rules after Remove = %d, want the email rule only", got)
+	}
+}
+
+func TestAccessPolicyProviderKeepsCIDRRules(t *testing.T) {
+	fake := &fakeAccessResource{
+		path: "/accounts/account/access/policies/policy",
+		resource: map[string]interface{}{
+			"name":     "Whitelist",
+			"decision": "allow",
+			"include": []interface{}{
+				map[string]interface{}{"ip": map[string]interface{}{"ip": "203.0.113.0/24"}},
+				map[string]interface{}{"ip": map[string]interface{}{"ip": "2001:0db8::0007/128"}},
+			},
+			"exclude": []interface{}{},
+			"require": []interface{}{},
+		},
+	}
+	withFakeCloudflare(t, fake)
+	ctx := context.Background()
+	p := newAccessPolicyProvider()
+
+	// Covered by the /24, but not an exact rule of its own
+	found, err := p.Contains(ctx, "203.0.113.7")
+	if err != nil || !found {
+		t.Errorf("Contains(203.0.113.7) = %v, %v; want true, nil", found, err)
+	}
+	if err := p.Remove(ctx, "203.0.113.7", ""); err != nil {
+		t.Fatalf("Remove() error: %v", err)
+	}
+	if len(fake.puts) != 0 {
+		t.Error("Remove of a single IP must not touch the covering /24 rule")
+	}
+
+	// Differently formatted IPv6 is the same rule
+	if _, err := p.Add(ctx, RuleRequest{IP: "2001:db8::7"}); err != nil {
+		t.Fatalf("Add() error: %v", err)
+	}
+	if len(fake.puts) != 0 {
+		t.Error("Add of an existing IPv6 rule in another notation must not update the policy")
+	}
+	if err := p.Remove(ctx, "2001:db8::7", ""); err != nil {
+		t.Fatalf("Remove() error: %v", err)
+	}
+	ips, _ := p.List(ctx)
+	if len(ips) != 1 || ips[0] != "203.0.113.0/24" {
+		t.Errorf("List() = %v, want [203.0.113.0/24]", ips)
+	}
+}
+
+func TestAccessProviderSerializesConcurrentAdds(t *testing.T) {
+	fake := newFakePolicy()
+	withFakeCloudflare(t, fake)
+	p := newAccessPolicyProvider()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := p.Add(context.Background(), RuleRequest{IP: fmt.Sprintf("198.51.100.%d", i)})
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Add() error: %v", err)
+		}
+	}
+
+	ips, err := p.List(context.Background())
+	if err != nil || len(ips) != 10 {
+		t.Errorf("List() = %v, %v; want all 10 IPs", ips, err)
+	}
+}
+
+func TestAccessProviderRetriesOnExternalEdit(t *testing.T) {
+	office := map[string]interface{}{"ip": map[string]interface{}{"ip": "192.0.2.1/32"}}
+	tests := []struct {
+		name string
+		// editAt is the GET before which the dashboard edit lands
+		editAt   int
+		wantPuts int
+	}{
+		// Between our read and our PUT: caught by the re-read, so our
+		// PUT never overwrites it
+		{"before the PUT", 2, 1},
+		// Racing our PUT: caught by the read-back, and the retry finds
+		// our rule in place
+		{"after the PUT", 3, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakePolicy()
+			fake.onGet = func(f *fakeAccessResource) {
+				if f.gets == tt.editAt {
+					f.appendInclude(office)
+				}
+			}
+			withFakeCloudflare(t, fake)
+			p := newAccessPolicyProvider()
+
+			if _, err := p.Add(context.Background(), RuleRequest{IP: "198.51.100.1"}); err != nil {
+				t.Fatalf("Add() error: %v", err)
+			}
+			if len(fake.puts) != tt.wantPuts {
+				t.Errorf("PUT count = %d, want %d", len(fake.puts), tt.wantPuts)
+			}
+			if include, _ := fake.puts[0]["include"].([]interface{}); tt.editAt == 2 && len(include) != 2 {
+				t.Errorf("PUT include = %v, want the external rule kept", include)
+			}
+			ips, _ := p.List(context.Background())
+			if len(ips) != 2 {
+				t.Errorf("List() = %v, want both the external and our rule", ips)
+			}
+		})
+	}
+}
+
+func TestMutateIncludeReportsChangeFoundOnRetry(t *testing.T) {
+	fake := newFakePolicy()
+	// An edit racing our PUT makes the read-back fail; the retry then
+	// finds our rule already in place
+	fake.onGet = func(f *fakeAccessResource) {
+		if f.gets == 3 {
+			f.appendInclude(map[string]interface{}{"ip": map[string]interface{}{"ip": "192.0.2.1/32"}})
+		}
+	}
+	withFakeCloudflare(t, fake)
+	p := newAccessPolicyProvider()
+	prefix := netip.MustParsePrefix("198.51.100.1/32")
+
+	changed, err := p.mutateInclude(context.Background(),
+		func(include []AccessRule) ([]AccessRule, bool) {
+			if findIPRule(include, prefix) >= 0 {
+				return include, false
+			}
+			return append(append([]AccessRule(nil), include...), NewAccessIPRule(prefix)), true
+		},
+		func(rule AccessRule) bool { rp, ok := rule.Prefix(); return ok && rp == prefix },
+		func(include []AccessRule) bool { return findIPRule(include, prefix) >= 0 },
+	)
+	if !changed || err != nil {
+		t.Errorf("mutateInclude() = %v, %v; want true, since this call made the change", changed, err)
+	}
+}
+
+func TestAccessProviderGivesUpOnConstantEdits(t *testing.T) {
+	fake := newFakePolicy()
+	// Another writer keeps replacing the include rules right after each
+	// of our PUTs
+	fake.onGet = func(f *fakeAccessResource) {
+		if f.gets%2 == 0 {
+			f.resource["include"] = []interface{}{}
+			f.appendInclude(map[string]interface{}{"email": map[string]interface{}{"email": fmt.Sprintf("u%d@example.com", f.gets)}})
+		}
+	}
+	withFakeCloudflare(t, fake)
+	p := newAccessPolicyProvider()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := p.Add(ctx, RuleRequest{IP: "198.51.100.1"})
+	if !errors.Is(err, errConcurrentModification) {
+		t.Errorf("Add() error = %v, want errConcurrentModification", err)
+	}
+	// Every attempt saw the edit when re-reading, so nothing was overwritten
+	if len(fake.puts) != 0 {
+		t.Errorf("PUT count = %d, want 0", len(fake.puts))
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// API keys let scripts and CI jobs use the service without a browser. An
+// admin creates one with POST /admin/api-keys and gets the key back once;
+// the store only keeps its SHA-256. Callers send it as
+// "Authorization: Bearer wlk_<id>_<secret>". The ID in the key locates the
+// stored hash, and the 256-bit secret makes a slow hash unnecessary.
+
+const apiKeyPrefix = "wlk_"
+
+// APIKey is a stored API key. Its scopes are permissions (rbac.go).
+type APIKey struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Hash is the hex SHA-256 of the whole key; never sent to clients
+	Hash   string   `json:"hash,omitempty"`
+	Scopes []string `json:"scopes"`
+	// MaxDuration caps how long the key may whitelist an IP for, as a Go
+	// duration; empty means no cap
+	MaxDuration string `json:"maxDuration,omitempty"`
+	// ExpiresAt is when the key stops working; nil means never
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	CreatedBy string     `json:"createdBy,omitempty"`
+}
+
+// maxDuration returns the key's cap on whitelist durations, 0 for none.
+func (k APIKey) maxDuration() time.Duration {
+	d, _ := time.ParseDuration(k.MaxDuration)
+	return d
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+var (
+	errUnknownAPIKey = errors.New("unknown API key")
+	errAPIKeyExpired = errors.New("API key expired")
+)
+
+// lookupAPIKey returns the stored key matching the presented key.
+func lookupAPIKey(key string) (APIKey, error) {
+	id, _, ok := strings.Cut(strings.TrimPrefix(key, apiKeyPrefix), "_")
+	if !ok {
+		return APIKey{}, errUnknownAPIKey
+	}
+	stored, ok, err := store.APIKey(id)
+	if err != nil {
+		return APIKey{}, storeUnavailable(err)
+	}
+	if !ok || subtle.ConstantTimeCompare([]byte(hashAPIKey(key)), []byte(stored.Hash)) != 1 {
+		return APIKey{}, errUnknownAPIKey
+	}
+	if stored.ExpiresAt != nil && time.Now().After(*stored.ExpiresAt) {
+		return APIKey{}, errAPIKeyExpired
+	}
+	return stored, nil
+}
+
+// apiKeyIdentity returns the identity of a valid API key.
+func apiKeyIdentity(token string) (Identity, error) {
+	key, err := lookupAPIKey(token)
+	var oe *opError
+	if errors.As(err, &oe) {
+		return Identity{}, err
+	}
+	if err != nil {
+		return Identity{}, &opError{http.StatusUnauthorized, "Unauthorized: " + err.Error()}
+	}
+	return Identity{Subject: key.ID, Method: "api_key", Scopes: key.Scopes, key: &key}, nil
+}
+
+// CreateAPIKeyRequest is the body of POST /admin/api-keys.
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// MaxDuration uses the syntax of WhitelistRequest.Duration
+	MaxDuration string     `json:"maxDuration,omitempty"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+}
+
+// CreateAPIKeyResponse returns the new key, the only time it is shown.
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// handleCreateAPIKey creates an API key.
+func handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "scopes is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !knownPermission(scope) {
+			http.Error(w, fmt.Sprintf("Unknown scope %q (available: %s)", scope, strings.Join(permissions, ", ")), http.StatusBadRequest)
+			return
+		}
+		// Nobody hands out more than they hold
+		if !caller(r).can(scope) {
+			writeOpError(w, permissionError(r, scope))
+			return
+		}
+	}
+	key := APIKey{
+		ID:        newID(),
+		Name:      req.Name,
+		Scopes:    req.Scopes,
+		ExpiresAt: req.ExpiresAt,
+		CreatedAt: time.Now(),
+		CreatedBy: requestOwner(r, "admin"),
+	}
+	if req.MaxDuration != "" {
+		d, err := parseDuration(req.MaxDuration)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid maxDuration", http.StatusBadRequest)
+			return
+		}
+		key.MaxDuration = d.String()
+	}
+	if key.ExpiresAt != nil && !key.ExpiresAt.After(time.Now()) {
+		http.Error(w, "expiresAt is in the past", http.StatusBadRequest)
+		return
+	}
+
+	secret := apiKeyPrefix + key.ID + "_" + randomToken()
+	key.Hash = hashAPIKey(secret)
+	err := store.SaveAPIKey(key)
+	recordAPIKeyAudit(newAuditSource(r, requestOwner(r, "admin")), "api-key.create", key.ID, err)
+	if err != nil {
+		log.Printf("Error saving API key %s: %v", key.ID, err)
+		http.Error(w, "Failed to save the API key", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Admin: created API key %s (%s) with scopes %s", key.ID, key.Name, strings.Join(key.Scopes, " "))
+
+	key.Hash = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateAPIKeyResponse{APIKey: key, Key: secret})
+}
+
+// handleAPIKeys lists the API keys, without their hashes.
+func handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := store.ListAPIKeys()
+	if err != nil {
+		writeOpError(w, storeUnavailable(err))
+		return
+	}
+	for i := range keys {
+		keys[i].Hash = ""
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]APIKey{"keys": keys})
+}
+
+// handleRevokeAPIKey deletes an API key; it stops working at once.
+func handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	found, err := store.RevokeAPIKey(id)
+	if found || err != nil {
+		recordAPIKeyAudit(newAuditSource(r, requestOwner(r, "admin")), "api-key.revoke", id, err)
+	}
+	if err != nil {
+		log.Printf("Error revoking API key %s: %v", id, err)
+		http.Error(w, "Failed to revoke the API key", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "No such API key", http.StatusNotFound)
+		return
+	}
+	log.Printf("Admin: revoked API key %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// recordAPIKeyAudit appends the creation or revocation of API key id to
+// the audit log.
+func recordAPIKeyAudit(src auditSource, action, id string, err error) {
+	rec := newAuditRecord(src, action, "", nil, err)
+	rec.APIKey = id
+	appendAudit(rec)
+}
+
+func (s *WhitelistStore) SaveAPIKey(key APIKey) error {
+	s.Lock()
+	if s.APIKeys == nil {
+		s.APIKeys = make(map[string]*APIKey)
+	}
+	s.APIKeys[key.ID] = &key
+	s.Unlock()
+	return s.Save()
+}
+
+func (s *WhitelistStore) APIKey(id string) (APIKey, bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+	key, ok := s.APIKeys[id]
+	if !ok {
+		return APIKey{}, false, nil
+	}
+	return *key, true, nil
+}
+
+func (s *WhitelistStore) ListAPIKeys() ([]APIKey, error) {
+	s.RLock()
+	keys := make([]APIKey, 0, len(s.APIKeys))
+	for _, key := range s.APIKeys {
+		keys = append(keys, *key)
+	}
+	s.RUnlock()
+	sortAPIKeys(keys)
+	return keys, nil
+}
+
+func (s *WhitelistStore) RevokeAPIKey(id string) (bool, error) {
+	s.Lock()
+	_, found := s.APIKeys[id]
+	delete(s.APIKeys, id)
+	s.Unlock()
+	if !found {
+		return false, nil
+	}
+	return true, s.Save()
+}
+
+// sortAPIKeys orders keys oldest first.
+func sortAPIKeys(keys []APIKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+}
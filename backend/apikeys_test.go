@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withTestAdminToken(t *testing.T) {
+	t.Helper()
+	orig := adminToken
+	adminToken = "secret"
+	t.Cleanup(func() { adminToken = orig })
+}
+
+// callAPI sends a request from 203.0.113.50 with the bearer token.
+func callAPI(r http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("CF-Connecting-IP", "203.0.113.50")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	return rr
+}
+
+// createTestAPIKey stores key and returns the key to send for it.
+func createTestAPIKey(t *testing.T, key APIKey) string {
+	t.Helper()
+	key.ID = newID()
+	secret := apiKeyPrefix + key.ID + "_" + randomToken()
+	key.Hash = hashAPIKey(secret)
+	key.CreatedAt = time.Now()
+	if err := store.SaveAPIKey(key); err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	withTestStore(t, newFakeProvider())
+	withTestAdminToken(t)
+	path := withTestAuditLog(t)
+	r := newRouter()
+
+	rr := callAPI(r, "POST", "/admin/api-keys", "secret", `{"name":"ci","scopes":["whitelist:self"],"maxDuration":"60"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d: %s", rr.Code, rr.Body)
+	}
+	var created CreateAPIKeyResponse
+	json.NewDecoder(rr.Body).Decode(&created)
+	if !strings.HasPrefix(created.Key, apiKeyPrefix+created.ID+"_") || created.Hash != "" || created.MaxDuration != "1h0m0s" {
+		t.Fatalf("created key = %+v", created)
+	}
+	if stored, _, _ := store.APIKey(created.ID); stored.Hash != hashAPIKey(created.Key) {
+		t.Errorf("stored hash = %q, want the SHA-256 of the key", stored.Hash)
+	}
+	rr = callAPI(r, "GET", "/admin/api-keys", "secret", "")
+	if strings.Contains(rr.Body.String(), "hash") || !strings.Contains(rr.Body.String(), created.ID) {
+		t.Errorf("list = %s", rr.Body)
+	}
+
+	if rr := callAPI(r, "POST", "/whitelist", created.Key, `{"duration":"30"}`); rr.Code != http.StatusOK {
+		t.Fatalf("whitelist: status = %d: %s", rr.Code, rr.Body)
+	}
+	if entry, _, _ := store.Entry("203.0.113.50"); entry.CreatedBy != "api-key:"+created.ID {
+		t.Errorf("CreatedBy = %q", entry.CreatedBy)
+	}
+	if rr := callAPI(r, "POST", "/whitelist", created.Key, `{"duration":"120"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("duration over the key's maximum: status = %d", rr.Code)
+	}
+
+	if rr := callAPI(r, "DELETE", "/admin/api-keys/"+created.ID, "secret", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("revoke: status = %d", rr.Code)
+	}
+	if rr := callAPI(r, "DELETE", "/admin/api-keys/"+created.ID, "secret", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("revoke again: status = %d", rr.Code)
+	}
+	if rr := callAPI(r, "POST", "/whitelist", created.Key, `{"duration":"30"}`); rr.Code != http.StatusUnauthorized {
+		t.Errorf("revoked key: status = %d", rr.Code)
+	}
+
+	var actions []string
+	for _, rec := range readAuditLog(t, path) {
+		actions = append(actions, rec.Actor+" "+rec.Action+" "+rec.APIKey)
+	}
+	want := []string{
+		"admin api-key.create " + created.ID,
+		"api-key:" + created.ID + " whitelist ",
+		"admin api-key.revoke " + created.ID,
+	}
+	if strings.Join(actions, "\n") != strings.Join(want, "\n") {
+		t.Errorf("audit records = %q, want %q", actions, want)
+	}
+}
+
+func TestCreateAPIKeyValidation(t *testing.T) {
+	withTestStore(t, newFakeProvider())
+	withTestAdminToken(t)
+	r := newRouter()
+
+	for _, body := range []string{
+		`{"scopes":["whitelist:self"]}`,
+		`{"name":"ci"}`,
+		`{"name":"ci","scopes":["admin:everything"]}`,
+		`{"name":"ci","scopes":["whitelist:self"],"maxDuration":"forever"}`,
+		`{"name":"ci","scopes":["whitelist:self"],"expiresAt":"2020-01-01T00:00:00Z"}`,
+	} {
+		if rr := callAPI(r, "POST", "/admin/api-keys", "secret", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, rr.Code)
+		}
+	}
+	if rr := callAPI(r, "POST", "/admin/api-keys", "", `{"name":"ci","scopes":["whitelist:self"]}`); rr.Code != http.StatusUnauthorized {
+		t.Errorf("without ADMIN_TOKEN: status = %d", rr.Code)
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	withTestStore(t, newFakeProvider())
+	withTestAdminToken(t)
+	r := newRouter()
+
+	expired := time.Now().Add(-time.Minute)
+	self := createTestAPIKey(t, APIKey{Name: "self", Scopes: []string{permWhitelistSelf}})
+	anyIP := createTestAPIKey(t, APIKey{Name: "any", Scopes: []string{permWhitelistAny}})
+	reader := createTestAPIKey(t, APIKey{Name: "reader", Scopes: []string{permAdminRead}})
+	old := createTestAPIKey(t, APIKey{Name: "old", Scopes: []string{permWhitelistSelf}, ExpiresAt: &expired})
+
+	tests := []struct {
+		name         string
+		method, path string
+		token        string
+		body         string
+		want         int
+	}{
+		{"own IP", "POST", "/whitelist", self, `{}`, http.StatusOK},
+		{"other IP without whitelist:any", "POST", "/whitelist", self, `{"ip":"198.51.100.7"}`, http.StatusForbidden},
+		{"range", "POST", "/whitelist", anyIP, `{"ip":"198.51.100.7/24"}`, http.StatusOK},
+		{"invalid IP", "POST", "/whitelist", anyIP, `{"ip":"nope"}`, http.StatusBadRequest},
+		{"no whitelist scope", "POST", "/whitelist", reader, `{}`, http.StatusForbidden},
+		{"expired key", "POST", "/whitelist", old, `{}`, http.StatusUnauthorized},
+		{"unknown key", "POST", "/whitelist", apiKeyPrefix + "0000000000000000_nope", `{}`, http.StatusUnauthorized},
+		{"remove other IP without whitelist:any", "DELETE", "/whitelist?ip=198.51.100.0/24", self, "", http.StatusForbidden},
+		{"remove range", "DELETE", "/whitelist?ip=198.51.100.0/24", anyIP, "", http.StatusOK},
+		{"admin read", "GET", "/admin/entries", reader, "", http.StatusOK},
+		{"admin read without admin:read", "GET", "/admin/entries", anyIP, "", http.StatusForbidden},
+		{"admin write", "POST", "/admin/adopt", reader, `{"ip":"198.51.100.9"}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rr := callAPI(r, tt.method, tt.path, tt.token, tt.body); rr.Code != tt.want {
+				t.Errorf("status = %d, want %d (%s)", rr.Code, tt.want, strings.TrimSpace(rr.Body.String()))
+			}
+		})
+	}
+	if ownsIP(t, store, "198.51.100.0/24") {
+		t.Error("removed range still in store")
+	}
+}
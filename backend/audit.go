@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every whitelist mutation is appended to an audit log (AUDIT_LOG), one
+// JSON record per line. Each record carries the hash of the previous one
+// and its own hash over both, so editing or deleting a record breaks the
+// chain. With AUDIT_HMAC_KEY the hashes are HMACs, which cannot be
+// recomputed for an edited log without the key. The sequence number and
+// hash of the last record are also written to AUDIT_LOG.head, so cutting
+// records off the end is detected too. "verify-audit" checks both.
+//
+// A chain has a single writer: replicas each keep their own log, named
+// after REPLICA_ID.
+
+// AuditRecord is one line of the audit log.
+type AuditRecord struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	// Actor is who made the change: the user (their email, or their IP
+	// without authentication), an API key ("api-key:<id>"), "admin" for
+	// ADMIN_TOKEN or a background job such as "expiry-daemon"
+	Actor  string `json:"actor"`
+	Action string `json:"action"`
+	IP     string `json:"ip"`
+	// SourceIP and IPHeaders are where the request came from and the
+	// headers the client IP was taken from
+	SourceIP  string            `json:"sourceIp,omitempty"`
+	IPHeaders map[string]string `json:"ipHeaders,omitempty"`
+	// CFRayIDs identify the Cloudflare API calls made for the change
+	CFRayIDs []string `json:"cfRayIds,omitempty"`
+	// APIKey is the ID of the API key created or revoked
+	APIKey string `json:"apiKey,omitempty"`
+	// User is the user whose TOTP enrollment changed
+	User     string `json:"user,omitempty"`
+	Outcome  string `json:"outcome"` // "success" or "failure"
+	Error    string `json:"error,omitempty"`
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash"`
+}
+
+// auditHead is the content of AUDIT_LOG.head.
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+	// MAC seals Seq and Hash with AUDIT_HMAC_KEY, so a truncated log
+	// cannot be hidden by rewriting the head; empty without a key
+	MAC string `json:"mac,omitempty"`
+}
+
+// mac returns the HMAC-SHA256 of the head keyed with AUDIT_HMAC_KEY, or ""
+// without a key.
+func (h auditHead) mac() string {
+	if auditHMACKey == "" {
+		return ""
+	}
+	m := hmac.New(sha256.New, []byte(auditHMACKey))
+	fmt.Fprintf(m, "audit-head\n%d\n%s", h.Seq, h.Hash)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// hash returns the hash of the record chained to its PrevHash, ignoring
+// the Hash field itself: an HMAC-SHA256 keyed with AUDIT_HMAC_KEY, or a
+// plain SHA-256 without one.
+func (rec AuditRecord) hash() string {
+	rec.Hash = ""
+	data, _ := json.Marshal(rec)
+	h := sha256.New()
+	if auditHMACKey != "" {
+		h = hmac.New(sha256.New, []byte(auditHMACKey))
+	}
+	h.Write([]byte(rec.PrevHash))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// replicaAuditLogPath returns AUDIT_LOG for this replica.
+func replicaAuditLogPath() string {
+	return strings.ReplaceAll(auditLogPath, "{replica}", replicaID)
+}
+
+// auditLog appends records to the audit log file.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	head auditHead
+}
+
+// auditor is the audit log of this process; nil when AUDIT_LOG is unset.
+var auditor *auditLog
+
+// openAuditLog opens path for appending, continuing the chain from its
+// last record. A file whose last line is incomplete is refused: run
+// verify-audit and repair it by hand.
+func openAuditLog(path string) (*auditLog, error) {
+	l := &auditLog{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if data[len(data)-1] != '\n' {
+			return nil, fmt.Errorf("%s ends with an incomplete record", path)
+		}
+		lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+		var last AuditRecord
+		if err := json.Unmarshal(lines[len(lines)-1], &last); err != nil {
+			return nil, fmt.Errorf("%s: last record: %w", path, err)
+		}
+		l.head = auditHead{Seq: last.Seq, Hash: last.Hash}
+	}
+
+	l.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) Close() error {
+	return l.f.Close()
+}
+
+// Append chains rec to the log and writes it durably.
+func (l *auditLog) Append(rec AuditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec.Seq = l.head.Seq + 1
+	rec.PrevHash = l.head.Hash
+	rec.Hash = rec.hash()
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.head = auditHead{Seq: rec.Seq, Hash: rec.Hash}
+	l.head.MAC = l.head.mac()
+
+	head, _ := json.Marshal(l.head)
+	return writeFileAtomic(l.path+".head", head, 0600)
+}
+
+// verifyAuditLog checks the hash chain of the log at path and that it
+// ends where its head file says. With AUDIT_HMAC_KEY set the head must
+// carry a valid MAC, and a missing head or an empty log fails too, since
+// deleting both would otherwise pass. It returns the number of records.
+func verifyAuditLog(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var prev AuditRecord
+	n := 0
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			break
+		}
+		if line[len(line)-1] != '\n' {
+			return n, fmt.Errorf("record %d is incomplete", n+1)
+		}
+
+		var rec AuditRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return n, fmt.Errorf("record %d is not valid JSON: %w", n+1, err)
+		}
+		switch {
+		case rec.Seq != prev.Seq+1:
+			return n, fmt.Errorf("record %d has sequence number %d, want %d: records were removed or reordered", n+1, rec.Seq, prev.Seq+1)
+		case rec.PrevHash != prev.Hash:
+			return n, fmt.Errorf("record %d does not chain to record %d", rec.Seq, prev.Seq)
+		case rec.Hash != rec.hash():
+			return n, fmt.Errorf("record %d was modified: hash mismatch", rec.Seq)
+		}
+		prev = rec
+		n++
+	}
+
+	if n == 0 && auditHMACKey != "" {
+		return 0, errors.New("the log is empty: it was truncated or replaced")
+	}
+	data, err := os.ReadFile(path + ".head")
+	if os.IsNotExist(err) && n == 0 {
+		return 0, nil
+	}
+	if err != nil {
+		return n, fmt.Errorf("reading head: %w", err)
+	}
+	var head auditHead
+	if err := json.Unmarshal(data, &head); err != nil {
+		return n, fmt.Errorf("reading head: %w", err)
+	}
+	if auditHMACKey != "" && !hmac.Equal([]byte(head.MAC), []byte(head.mac())) {
+		return n, errors.New("the head's MAC does not match: the head was altered or written with another key")
+	}
+	if head.Seq != prev.Seq || head.Hash != prev.Hash {
+		return n, fmt.Errorf("log ends at record %d but its head is record %d: the log was truncated or the head altered", prev.Seq, head.Seq)
+	}
+	return n, nil
+}
+
+// runVerifyAudit implements the verify-audit command.
+func runVerifyAudit(args []string) int {
+	path := replicaAuditLogPath()
+	if len(args) > 0 {
+		path = args[0]
+	}
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "usage: verify-audit [path] (or set AUDIT_LOG and REPLICA_ID)")
+		return 2
+	}
+	n, err := verifyAuditLog(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: TAMPERED after %d valid records: %v\n", path, n, err)
+		return 1
+	}
+	fmt.Printf("%s: OK, %d records\n", path, n)
+	return 0
+}
+
+// cfTrace collects the Ray IDs of the Cloudflare calls made under a context.
+type cfTrace struct {
+	mu   sync.Mutex
+	rays []string
+}
+
+type cfTraceKey struct{}
+
+func withCFTrace(ctx context.Context) (context.Context, *cfTrace) {
+	t := &cfTrace{}
+	return context.WithValue(ctx, cfTraceKey{}, t), t
+}
+
+// cfTraceOf returns the trace of ctx, or nil.
+func cfTraceOf(ctx context.Context) *cfTrace {
+	t, _ := ctx.Value(cfTraceKey{}).(*cfTrace)
+	return t
+}
+
+// traceCFRay records a Cloudflare Ray ID on the trace of ctx, if any.
+func traceCFRay(ctx context.Context, ray string) {
+	if ray != "" {
+		cfTraceOf(ctx).add(ray)
+	}
+}
+
+// add records rays on t; a nil trace ignores them.
+func (t *cfTrace) add(rays ...string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.rays = append(t.rays, rays...)
+	t.mu.Unlock()
+}
+
+func (t *cfTrace) Rays() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.rays...)
+}
+
+// auditSource is who made a change and from where.
+type auditSource struct {
+	Actor     string
+	SourceIP  string
+	IPHeaders map[string]string
+}
+
+// ipDetectionHeaders are the request headers getClientIP looks at.
+var ipDetectionHeaders = []string{"CF-Connecting-IP", "X-Forwarded-For"}
+
+func newAuditSource(r *http.Request, actor string) auditSource {
+	src := auditSource{Actor: actor, SourceIP: r.RemoteAddr}
+	for _, h := range ipDetectionHeaders {
+		if v := r.Header.Get(h); v != "" {
+			if src.IPHeaders == nil {
+				src.IPHeaders = map[string]string{}
+			}
+			src.IPHeaders[h] = v
+		}
+	}
+	return src
+}
+
+// recordAudit appends the outcome of a mutation to the audit log.
+func recordAudit(src auditSource, action, ip string, trace *cfTrace, err error) {
+	appendAudit(newAuditRecord(src, action, ip, trace, err))
+}
+
+func newAuditRecord(src auditSource, action, ip string, trace *cfTrace, err error) AuditRecord {
+	rec := AuditRecord{
+		Time:      time.Now().UTC(),
+		Actor:     src.Actor,
+		Action:    action,
+		IP:        ip,
+		SourceIP:  src.SourceIP,
+		IPHeaders: src.IPHeaders,
+		Outcome:   "success",
+	}
+	if trace != nil {
+		rec.CFRayIDs = trace.Rays()
+	}
+	if err != nil {
+		rec.Outcome = "failure"
+		rec.Error = err.Error()
+	}
+	return rec
+}
+
+// appendAudit appends rec to the audit log, if there is one.
+func appendAudit(rec AuditRecord) {
+	if auditor == nil {
+		return
+	}
+	if err := auditor.Append(rec); err != nil {
+		log.Printf("Audit: Error appending %s of IP %s: %v", rec.Action, rec.IP, err)
+	}
+}
+
+// audited wraps apply so that its outcome is audited, including the Ray
+// IDs of the Cloudflare calls it made.
+func audited(src auditSource, action, ip string, apply func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		ctx, trace := withCFTrace(ctx)
+		err := apply(ctx)
+		recordAudit(src, action, ip, trace, err)
+		return err
+	}
+}
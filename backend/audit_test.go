@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// withTestAuditLog installs an audit log in a temp dir for the test.
+func withTestAuditLog(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := auditor
+	auditor = l
+	t.Cleanup(func() { auditor = orig; l.Close() })
+	return path
+}
+
+func readAuditLog(t *testing.T, path string) []AuditRecord {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recs []AuditRecord
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var rec AuditRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestAuditLogVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(lines []string) []string
+		wantErr string
+	}{
+		{"intact", func(l []string) []string { return l }, ""},
+		{"modified", func(l []string) []string {
+			l[1] = strings.Replace(l[1], `"outcome":"success"`, `"outcome":"failure"`, 1)
+			return l
+		}, "modified"},
+		{"deleted", func(l []string) []string { return append(l[:1], l[2:]...) }, "removed"},
+		{"truncated", func(l []string) []string { return l[:2] }, "truncated"},
+		{"rehashed", func(l []string) []string {
+			// Recomputing the hash of an edited record breaks the next link
+			var rec AuditRecord
+			json.Unmarshal([]byte(l[0]), &rec)
+			rec.IP = "6.6.6.6"
+			rec.Hash = rec.hash()
+			b, _ := json.Marshal(rec)
+			l[0] = string(b)
+			return l
+		}, "does not chain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := withTestAuditLog(t)
+			for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+				recordAudit(auditSource{Actor: "test"}, "whitelist", ip, nil, nil)
+			}
+
+			data, _ := os.ReadFile(path)
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			os.WriteFile(path, []byte(strings.Join(tt.tamper(lines), "\n")+"\n"), 0600)
+
+			n, err := verifyAuditLog(path)
+			if tt.wantErr == "" {
+				if err != nil || n != 3 {
+					t.Errorf("verifyAuditLog() = %d, %v; want 3 records", n, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verifyAuditLog() error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuditLogContinuesChainAfterRestart(t *testing.T) {
+	path := withTestAuditLog(t)
+	recordAudit(auditSource{Actor: "test"}, "whitelist", "1.1.1.1", nil, nil)
+	auditor.Close()
+
+	l, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditor = l
+	recordAudit(auditSource{Actor: "test"}, "remove", "1.1.1.1", nil, nil)
+
+	if n, err := verifyAuditLog(path); err != nil || n != 2 {
+		t.Errorf("verifyAuditLog() = %d, %v; want 2 records", n, err)
+	}
+}
+
+func TestAuditLogKeyedChain(t *testing.T) {
+	origKey := auditHMACKey
+	auditHMACKey = "s3cret"
+	defer func() { auditHMACKey = origKey }()
+
+	path := withTestAuditLog(t)
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+		recordAudit(auditSource{Actor: "test"}, "whitelist", ip, nil, nil)
+	}
+	if n, err := verifyAuditLog(path); err != nil || n != 2 {
+		t.Fatalf("verifyAuditLog() = %d, %v; want 2 records", n, err)
+	}
+
+	// Rewriting the whole chain and its head needs the key
+	data, _ := os.ReadFile(path)
+	var out []string
+	var prev AuditRecord
+	auditHMACKey = ""
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var rec AuditRecord
+		json.Unmarshal([]byte(line), &rec)
+		rec.IP = "6.6.6.6"
+		rec.PrevHash = prev.Hash
+		rec.Hash = rec.hash()
+		b, _ := json.Marshal(rec)
+		out = append(out, string(b))
+		prev = rec
+	}
+	os.WriteFile(path, []byte(strings.Join(out, "\n")+"\n"), 0600)
+	head, _ := json.Marshal(auditHead{Seq: prev.Seq, Hash: prev.Hash})
+	os.WriteFile(path+".head", head, 0600)
+
+	auditHMACKey = "s3cret"
+	if _, err := verifyAuditLog(path); err == nil || !strings.Contains(err.Error(), "modified") {
+		t.Errorf("verifyAuditLog() of a chain rewritten without the key = %v", err)
+	}
+}
+
+func TestAuditLogKeyedHead(t *testing.T) {
+	origKey := auditHMACKey
+	auditHMACKey = "s3cret"
+	defer func() { auditHMACKey = origKey }()
+
+	tests := []struct {
+		name    string
+		tamper  func(path string, lines []string)
+		wantErr string
+	}{
+		{"truncated with the head rewritten", func(path string, lines []string) {
+			os.WriteFile(path, []byte(strings.Join(lines[:2], "\n")+"\n"), 0600)
+			var last AuditRecord
+			json.Unmarshal([]byte(lines[1]), &last)
+			head, _ := json.Marshal(auditHead{Seq: last.Seq, Hash: last.Hash})
+			os.WriteFile(path+".head", head, 0600)
+		}, "MAC"},
+		{"log and head deleted", func(path string, lines []string) {
+			os.Remove(path)
+			os.Remove(path + ".head")
+			os.WriteFile(path, nil, 0600)
+		}, "empty"},
+		{"head deleted", func(path string, lines []string) {
+			os.Remove(path + ".head")
+		}, "head"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := withTestAuditLog(t)
+			for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+				recordAudit(auditSource{Actor: "test"}, "whitelist", ip, nil, nil)
+			}
+			if _, err := verifyAuditLog(path); err != nil {
+				t.Fatalf("verifyAuditLog() of the intact log = %v", err)
+			}
+			data, _ := os.ReadFile(path)
+			tt.tamper(path, strings.Split(strings.TrimSpace(string(data)), "\n"))
+			if _, err := verifyAuditLog(path); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verifyAuditLog() error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReplicaAuditLogPath(t *testing.T) {
+	origPath, origReplica := auditLogPath, replicaID
+	defer func() { auditLogPath, replicaID = origPath, origReplica }()
+
+	replicaID = "replica-1"
+	auditLogPath = "/data/audit-{replica}.log"
+	if got := replicaAuditLogPath(); got != "/data/audit-replica-1.log" {
+		t.Errorf("replicaAuditLogPath() = %q", got)
+	}
+}
+
+func TestWhitelistIsAudited(t *testing.T) {
+	withTestStore(t, newFakeProvider())
+	path := withTestAuditLog(t)
+
+	req := httptest.NewRequest("POST", "/whitelist", strings.NewReader(`{"duration":"60"}`))
+	req.Header.Set("CF-Connecting-IP", "203.0.113.40")
+	rr := httptest.NewRecorder()
+	handleWhitelist(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d", rr.Code)
+	}
+
+	recs := readAuditLog(t, path)
+	if len(recs) != 1 {
+		t.Fatalf("audit log has %d records, want 1", len(recs))
+	}
+	rec := recs[0]
+	if rec.Action != "whitelist" || rec.IP != "203.0.113.40" || rec.Actor != "203.0.113.40" || rec.Outcome != "success" {
+		t.Errorf("record = %+v", rec)
+	}
+	if rec.IPHeaders["CF-Connecting-IP"] != "203.0.113.40" || rec.SourceIP == "" {
+		t.Errorf("record source = %q, headers %v", rec.SourceIP, rec.IPHeaders)
+	}
+}
+
+func TestCFTraceCollectsRayIDs(t *testing.T) {
+	withFakeCloudflare(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cf-Ray", "8f1e2d3c4b5a6978-AMS")
+		writeCFResult(w, map[string]string{"id": "ok"})
+	}))
+	withTestCFClient(t, 0)
+
+	ctx, trace := withCFTrace(context.Background())
+	if _, err := cfCall(ctx, "GET", "thing", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rays := trace.Rays(); len(rays) != 1 || rays[0] != "8f1e2d3c4b5a6978-AMS" {
+		t.Errorf("Rays() = %v", rays)
+	}
+}
+
+func TestStoreOnlyChangesAreAudited(t *testing.T) {
+	fake := newFakeProvider()
+	withTestStore(t, fake)
+	path := withTestAuditLog(t)
+
+	failed := errors.New("cloudflare is down")
+	store.Add("198.51.100.1", time.Now().Add(time.Hour), EntryMeta{}) // missing in provider
+	store.EnqueueRemoval("198.51.100.2", failed)                      // already gone
+	if _, err := reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	store.EnqueueRemoval("198.51.100.3", failed)
+	pending, _, _ := store.QueuedOps()
+	for _, op := range pending {
+		if op.IP == "198.51.100.3" {
+			for i := 0; i < outboxMaxAttempts; i++ {
+				store.FailOp(op.ID, failed, time.Now())
+			}
+		}
+	}
+	_, dead, _ := store.QueuedOps()
+	if len(dead) != 1 {
+		t.Fatalf("dead letters = %v", dead)
+	}
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", dead[0].ID)
+	req := httptest.NewRequest("POST", "/admin/outbox/"+dead[0].ID+"/retry", nil)
+	rr := httptest.NewRecorder()
+	handleRetryDeadLetter(rr, req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx)))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("retry status = %d", rr.Code)
+	}
+
+	var got []string
+	for _, rec := range readAuditLog(t, path) {
+		got = append(got, rec.Actor+" "+rec.Action+" "+rec.IP)
+	}
+	want := []string{
+		"reconciler reconcile.queue-add 198.51.100.1",
+		"reconciler reconcile.complete-remove 198.51.100.2",
+		"admin outbox.requeue 198.51.100.3",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("audit log = %v, want %v", got, want)
+	}
+}
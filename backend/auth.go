@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Behind Cloudflare Access every request carries a signed assertion of
+// who the user is, in the Cf-Access-Jwt-Assertion header. With
+// CF_ACCESS_TEAM_DOMAIN and CF_ACCESS_AUD set, the whitelisting endpoints
+// accept requests whose assertion verifies against the team's keys. With
+// OIDC_ISSUER set they accept a session from signing in there (oidc.go).
+// Once either is configured, anonymous requests are rejected, and entries
+// are owned by the user's email instead of their IP. API keys
+// (apikeys.go) and ADMIN_TOKEN are accepted either way. What each caller
+// may do is up to rbac.go.
+
+// Identity is the authenticated user behind a request.
+type Identity struct {
+	Email   string `json:"email"`
+	Subject string `json:"sub,omitempty"`
+	// Groups are the user's groups at the identity provider, if known
+	Groups []string `json:"groups,omitempty"`
+	// Method is how the user authenticated: "cloudflare_access", "oidc",
+	// "api_key" or "admin_token"
+	Method string `json:"method"`
+	// Role is the user's role; API keys have Scopes instead
+	Role   string   `json:"role,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+
+	key *APIKey
+}
+
+type identityKey struct{}
+
+func withIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// identityFrom returns the identity authenticate established for ctx.
+func identityFrom(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// accessVerifier checks Cloudflare Access assertions for one application.
+type accessVerifier struct {
+	issuer   string
+	audience string
+	keys     *jwks
+}
+
+// cfAccess verifies Access assertions; nil when Access is not configured.
+var cfAccess *accessVerifier
+
+// newAccessVerifier returns the verifier for the Access application with
+// audience tag aud of the team at teamDomain ("<team>.cloudflareaccess.com").
+func newAccessVerifier(teamDomain, aud string) *accessVerifier {
+	issuer := strings.TrimSuffix(teamDomain, "/")
+	if !strings.Contains(issuer, "://") {
+		issuer = "https://" + issuer
+	}
+	return &accessVerifier{
+		issuer:   issuer,
+		audience: aud,
+		keys:     newJWKS(issuer + "/cdn-cgi/access/certs"),
+	}
+}
+
+func (v *accessVerifier) verify(ctx context.Context, token string) (Identity, error) {
+	claims, err := verifyJWT(ctx, token, v.keys, v.issuer, v.audience)
+	if err != nil {
+		return Identity{}, err
+	}
+	groups := accessGroups(claims)
+	return Identity{Email: claims.Email, Subject: claims.Subject, Groups: groups, Method: "cloudflare_access", Role: roleForGroups(groups)}, nil
+}
+
+// accessGroups returns the CF_ACCESS_GROUPS_CLAIM claim of an Access
+// assertion. Access passes the IdP's claims through when they are added
+// as OIDC claims to the identity provider, under "custom"; without them
+// the user has no groups and is a plain user.
+func accessGroups(claims *jwtClaims) []string {
+	if groups := claims.strings(accessGroupsClaim); len(groups) > 0 {
+		return groups
+	}
+	var custom map[string]json.RawMessage
+	if err := json.Unmarshal(claims.raw["custom"], &custom); err != nil {
+		return nil
+	}
+	return (&jwtClaims{raw: custom}).strings(accessGroupsClaim)
+}
+
+// authRequired reports whether requests must be authenticated.
+func authRequired() bool {
+	return cfAccess != nil || oidc != nil
+}
+
+// authenticate rejects requests that do not carry a valid bearer token,
+// Cloudflare Access assertion or session cookie and attaches the identity
+// to the others. Without authentication configured every request without
+// a bearer token passes anonymously.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			id, err := bearerIdentity(token)
+			if err != nil {
+				log.Printf("Rejecting bearer token from %s: %v", r.RemoteAddr, err)
+				writeOpError(w, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), id)))
+			return
+		}
+		if !authRequired() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if token := r.Header.Get("Cf-Access-Jwt-Assertion"); token != "" && cfAccess != nil {
+			id, err := cfAccess.verify(r.Context(), token)
+			if err == nil && id.Email == "" {
+				// Service tokens have no email and cannot own entries
+				err = errInvalidToken
+			}
+			if err != nil {
+				log.Printf("Rejecting Cloudflare Access token from %s: %v", r.RemoteAddr, err)
+				http.Error(w, "Unauthorized: invalid Cloudflare Access token", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), id)))
+			return
+		}
+		if oidc != nil {
+			if id, ok := sessionIdentity(r); ok {
+				next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), id)))
+				return
+			}
+			http.Error(w, "Unauthorized: sign in at /auth/login", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "Unauthorized: missing Cloudflare Access token", http.StatusUnauthorized)
+	})
+}
+
+// bearerIdentity authenticates a bearer token: an API key, or ADMIN_TOKEN
+// for the admin role.
+func bearerIdentity(token string) (Identity, error) {
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		return apiKeyIdentity(token)
+	}
+	if adminToken == "" {
+		return Identity{}, &opError{http.StatusForbidden, "Admin API disabled: ADMIN_TOKEN not set"}
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		return Identity{}, &opError{http.StatusUnauthorized, "Unauthorized"}
+	}
+	return Identity{Method: "admin_token", Role: roleAdmin}, nil
+}
+
+// requestOwner returns who a request acts for: the authenticated user's
+// email, "api-key:<id>" for an API key, "admin" for ADMIN_TOKEN, or
+// anonymous (the client IP, for the whitelisting endpoints) when nobody is
+// authenticated.
+func requestOwner(r *http.Request, anonymous string) string {
+	id, ok := identityFrom(r.Context())
+	switch {
+	case !ok:
+		return anonymous
+	case id.key != nil:
+		return "api-key:" + id.key.ID
+	case id.Method == "admin_token":
+		return "admin"
+	}
+	return id.Email
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIssuer is a local identity provider: it serves a JSON Web Key Set
+// and signs tokens with the keys in it.
+type testIssuer struct {
+	*httptest.Server
+	mux     *http.ServeMux
+	fetches int32 // key set downloads
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PrivateKey
+	kid  string // key new tokens are signed with
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	i := &testIssuer{mux: http.NewServeMux(), keys: map[string]*rsa.PrivateKey{}}
+	serveKeys := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&i.fetches, 1)
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		var set []map[string]string
+		for kid, key := range i.keys {
+			set = append(set, map[string]string{
+				"kty": "RSA", "kid": kid, "use": "sig", "alg": "RS256",
+				"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": set})
+	}
+	i.mux.HandleFunc("/cdn-cgi/access/certs", serveKeys)
+	i.mux.HandleFunc("/jwks", serveKeys)
+	i.Server = httptest.NewServer(i.mux)
+	t.Cleanup(i.Close)
+	i.rotate(t, "key-1")
+	return i
+}
+
+// rotate replaces the key set with a single new key.
+func (i *testIssuer) rotate(t *testing.T, kid string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.mu.Lock()
+	i.keys = map[string]*rsa.PrivateKey{kid: key}
+	i.kid = kid
+	i.mu.Unlock()
+}
+
+// sign returns a token for claims, signed with the current key.
+func (i *testIssuer) sign(claims map[string]interface{}) string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return signTestJWT(i.keys[i.kid], i.kid, claims)
+}
+
+func signTestJWT(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// withTestAccess puts the service behind an Access application of issuer.
+func withTestAccess(t *testing.T, issuer *testIssuer) {
+	t.Helper()
+	orig := cfAccess
+	cfAccess = newAccessVerifier(issuer.URL, "test-aud")
+	t.Cleanup(func() { cfAccess = orig })
+}
+
+func accessClaims(issuer *testIssuer, email string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   issuer.URL,
+		"aud":   []string{"test-aud"},
+		"sub":   "user-" + email,
+		"email": email,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+// whoAmI answers with the email of the authenticated user.
+var whoAmI = authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	id, _ := identityFrom(r.Context())
+	w.Write([]byte(id.Email))
+}))
+
+func callWithAccessToken(handler http.Handler, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/status", nil)
+	if token != "" {
+		req.Header.Set("Cf-Access-Jwt-Assertion", token)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAuthenticateCloudflareAccess(t *testing.T) {
+	issuer := newTestIssuer(t)
+	withTestAccess(t, issuer)
+	stranger, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	with := func(change func(c map[string]interface{})) map[string]interface{} {
+		c := accessClaims(issuer, "alice@example.com")
+		change(c)
+		return c
+	}
+	valid := issuer.sign(accessClaims(issuer, "alice@example.com"))
+	parts := strings.Split(valid, ".")
+	forged, _ := json.Marshal(accessClaims(issuer, "mallory@example.com"))
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"valid", valid, http.StatusOK},
+		{"missing", "", http.StatusUnauthorized},
+		{"garbage", "not-a-jwt", http.StatusUnauthorized},
+		{"expired", issuer.sign(with(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() })), http.StatusUnauthorized},
+		{"not yet valid", issuer.sign(with(func(c map[string]interface{}) { c["nbf"] = time.Now().Add(time.Hour).Unix() })), http.StatusUnauthorized},
+		{"other application", issuer.sign(with(func(c map[string]interface{}) { c["aud"] = "other-aud" })), http.StatusUnauthorized},
+		{"other team", issuer.sign(with(func(c map[string]interface{}) { c["iss"] = "https://other.cloudflareaccess.com" })), http.StatusUnauthorized},
+		{"service token", issuer.sign(with(func(c map[string]interface{}) { delete(c, "email") })), http.StatusUnauthorized},
+		{"unknown key", signTestJWT(stranger, "key-1", accessClaims(issuer, "alice@example.com")), http.StatusUnauthorized},
+		{"forged claims", parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2], http.StatusUnauthorized},
+		{"unsigned", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := callWithAccessToken(whoAmI, tt.token)
+			if rr.Code != tt.want {
+				t.Fatalf("status = %d, want %d (%s)", rr.Code, tt.want, rr.Body)
+			}
+			if tt.want == http.StatusOK && rr.Body.String() != "alice@example.com" {
+				t.Errorf("identity = %q", rr.Body)
+			}
+		})
+	}
+}
+
+func TestAccessGroupsMapToRoles(t *testing.T) {
+	issuer := newTestIssuer(t)
+	withTestAccess(t, issuer)
+	withTestRoles(t)
+	whatRole := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(caller(r).Role))
+	}))
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		want   string
+	}{
+		{"no groups", nil, roleUser},
+		{"groups claim", map[string]interface{}{"groups": []string{"eng", "ops"}}, roleOperator},
+		{"custom OIDC claim", map[string]interface{}{"custom": map[string]interface{}{"groups": []string{"sre"}}}, roleAdmin},
+		{"other groups", map[string]interface{}{"custom": map[string]interface{}{"groups": "eng"}}, roleUser},
+	}
+	for _, tt := range tests {
+		c := accessClaims(issuer, "alice@example.com")
+		for k, v := range tt.claims {
+			c[k] = v
+		}
+		rr := callWithAccessToken(whatRole, issuer.sign(c))
+		if rr.Code != http.StatusOK || rr.Body.String() != tt.want {
+			t.Errorf("%s: role = %q (status %d), want %q", tt.name, rr.Body, rr.Code, tt.want)
+		}
+	}
+}
+
+func TestAccessKeysCachedAndRotated(t *testing.T) {
+	issuer := newTestIssuer(t)
+	withTestAccess(t, issuer)
+
+	old := issuer.sign(accessClaims(issuer, "alice@example.com"))
+	for i := 0; i < 3; i++ {
+		if rr := callWithAccessToken(whoAmI, old); rr.Code != http.StatusOK {
+			t.Fatalf("status = %d", rr.Code)
+		}
+	}
+	if n := atomic.LoadInt32(&issuer.fetches); n != 1 {
+		t.Errorf("key set fetched %d times, want once", n)
+	}
+
+	// A minute later, a token signed with a new key makes the verifier
+	// fetch the keys again
+	issuer.rotate(t, "key-2")
+	cfAccess.keys.lastFetch = time.Now().Add(-jwksMinRefetch)
+	if rr := callWithAccessToken(whoAmI, issuer.sign(accessClaims(issuer, "alice@example.com"))); rr.Code != http.StatusOK {
+		t.Fatalf("status after rotation = %d", rr.Code)
+	}
+	if n := atomic.LoadInt32(&issuer.fetches); n != 2 {
+		t.Errorf("key set fetched %d times, want twice", n)
+	}
+
+	// The retired key is gone, and looking for it again is rate limited
+	for i := 0; i < 3; i++ {
+		if rr := callWithAccessToken(whoAmI, old); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("token of a retired key: status = %d", rr.Code)
+		}
+	}
+	if n := atomic.LoadInt32(&issuer.fetches); n != 2 {
+		t.Errorf("key set fetched %d times for a retired key, want no refetch", n)
+	}
+}
+
+func TestAccessUserOwnsEntry(t *testing.T) {
+	withTestStore(t, newFakeProvider())
+	path := withTestAuditLog(t)
+	issuer := newTestIssuer(t)
+	withTestAccess(t, issuer)
+
+	req := httptest.NewRequest("POST", "/whitelist", strings.NewReader(`{"duration":"60"}`))
+	req.Header.Set("CF-Connecting-IP", "203.0.113.50")
+	req.Header.Set("Cf-Access-Jwt-Assertion", issuer.sign(accessClaims(issuer, "alice@example.com")))
+	rr := httptest.NewRecorder()
+	authenticate(http.HandlerFunc(handleWhitelist)).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body)
+	}
+
+	if entry, _, _ := store.Entry("203.0.113.50"); entry.CreatedBy != "alice@example.com" {
+		t.Errorf("CreatedBy = %q, want the user's email", entry.CreatedBy)
+	}
+	if recs := readAuditLog(t, path); len(recs) != 1 || recs[0].Actor != "alice@example.com" {
+		t.Errorf("audit records = %+v", recs)
+	}
+}
+
+func TestAuthenticateWithoutAccess(t *testing.T) {
+	orig := cfAccess
+	cfAccess = nil
+	defer func() { cfAccess = orig }()
+
+	if rr := callWithAccessToken(whoAmI, ""); rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Errorf("anonymous request: status = %d, identity %q", rr.Code, rr.Body)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// cacheRefreshTimeout bounds one fetch of the provider's rules, so a slow
+// or rate-limited API cannot hold up a refresh indefinitely.
+const cacheRefreshTimeout = 30 * time.Second
+
+// cachedProvider wraps a Provider with an in-memory copy of its rules so
+// GET /status can be answered without a Cloudflare API call per request.
+//
+// The copy is refreshed every interval (by startRefresher, or lazily when a
+// read finds it stale) and dropped whenever this process writes through
+// Add or Remove, so our own changes are visible on the next read. Rules
+// are fetched without holding mu, so reads of a valid copy never wait on
+// the API; concurrent refreshes share a single fetch.
+type cachedProvider struct {
+	Provider
+	interval time.Duration
+
+	mu        sync.Mutex
+	prefixes  []netip.Prefix
+	fetchedAt time.Time // zero when there is no valid copy
+	// generation is bumped by invalidate, so a fetch that started before
+	// one of our writes is not kept as the copy
+	generation uint64
+	inflight   *cacheFetch
+}
+
+// cacheFetch is a fetch of the provider's rules in progress. The fields
+// are set before done is closed.
+type cacheFetch struct {
+	done      chan struct{}
+	prefixes  []netip.Prefix
+	fetchedAt time.Time
+	err       error
+}
+
+func newCachedProvider(p Provider, interval time.Duration) *cachedProvider {
+	return &cachedProvider{Provider: p, interval: interval}
+}
+
+func (c *cachedProvider) Add(ctx context.Context, req RuleRequest) (string, error) {
+	defer c.invalidate()
+	return c.Provider.Add(ctx, req)
+}
+
+func (c *cachedProvider) Remove(ctx context.Context, ip, ruleID string) error {
+	defer c.invalidate()
+	return c.Provider.Remove(ctx, ip, ruleID)
+}
+
+func (c *cachedProvider) invalidate() {
+	c.mu.Lock()
+	c.fetchedAt = time.Time{}
+	c.generation++
+	c.mu.Unlock()
+}
+
+// refresh fetches the provider's current rules, or joins the fetch already
+// in progress, and returns them. They replace the copy unless it was
+// invalidated in the meantime. The fetch runs on its own deadline; ctx
+// only bounds how long the caller waits for it.
+func (c *cachedProvider) refresh(ctx context.Context) (*cacheFetch, error) {
+	c.mu.Lock()
+	f := c.inflight
+	if f == nil {
+		f = &cacheFetch{done: make(chan struct{})}
+		c.inflight = f
+		go c.fetch(f, c.generation)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *cachedProvider) fetch(f *cacheFetch, generation uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), cacheRefreshTimeout)
+	defer cancel()
+
+	ips, err := c.Provider.List(ctx)
+	if err == nil {
+		f.prefixes = make([]netip.Prefix, 0, len(ips))
+		for _, ip := range ips {
+			if prefix, err := parseIPOrPrefix(ip); err == nil {
+				f.prefixes = append(f.prefixes, prefix)
+			}
+		}
+		f.fetchedAt = time.Now()
+	}
+	f.err = err
+
+	c.mu.Lock()
+	if err == nil && c.generation == generation {
+		c.prefixes = f.prefixes
+		c.fetchedAt = f.fetchedAt
+	}
+	c.inflight = nil
+	c.mu.Unlock()
+	close(f.done)
+}
+
+// ContainsCached reports whether ip is whitelisted according to the cached
+// rules, refreshing them first if they are stale or fresh is set. age is how
+// old the data used for the answer is.
+func (c *cachedProvider) ContainsCached(ctx context.Context, ip string, fresh bool) (found bool, age time.Duration, err error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false, 0, err
+	}
+	addr = addr.Unmap().WithZone("")
+
+	c.mu.Lock()
+	prefixes, fetchedAt := c.prefixes, c.fetchedAt
+	c.mu.Unlock()
+
+	if fresh || fetchedAt.IsZero() || time.Since(fetchedAt) >= c.interval {
+		f, err := c.refresh(ctx)
+		if err != nil {
+			return false, 0, err
+		}
+		prefixes, fetchedAt = f.prefixes, f.fetchedAt
+	}
+
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true, time.Since(fetchedAt), nil
+		}
+	}
+	return false, time.Since(fetchedAt), nil
+}
+
+// startRefresher keeps the copy warm so status reads rarely wait on the API.
+func (c *cachedProvider) startRefresher() {
+	ticker := time.NewTicker(c.interval)
+	log.Printf("Policy cache refresher started (every %s)", c.interval)
+	for range ticker.C {
+		if _, err := c.refresh(context.Background()); err != nil {
+			log.Printf("Policy cache: refresh failed: %v", err)
+		}
+	}
+}
+
+// providerContains checks ip against the configured provider, using the
+// cache when there is one. age is zero for uncached answers.
+func providerContains(ctx context.Context, ip string, fresh bool) (found bool, age time.Duration, err error) {
+	if c, ok := provider.(*cachedProvider); ok {
+		return c.ContainsCached(ctx, ip, fresh)
+	}
+	found, err = provider.Contains(ctx, ip)
+	return found, 0, err
+}
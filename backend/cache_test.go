@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCachedProvider(t *testing.T) {
+	fake := newFakeProvider("203.0.113.0/24")
+	c := newCachedProvider(fake, time.Hour)
+	ctx := context.Background()
+
+	found, _, err := c.ContainsCached(ctx, "203.0.113.7", false)
+	if err != nil || !found {
+		t.Fatalf("ContainsCached(203.0.113.7) = %v, %v; want covered by the /24", found, err)
+	}
+	c.ContainsCached(ctx, "198.51.100.1", false)
+	if fake.lists != 1 {
+		t.Errorf("List calls = %d, want 1 while the cache is fresh", fake.lists)
+	}
+
+	// Our own writes invalidate the copy
+	if _, err := c.Add(ctx, RuleRequest{IP: "198.51.100.1"}); err != nil {
+		t.Fatalf("Add() error: %v", err)
+	}
+	found, _, _ = c.ContainsCached(ctx, "198.51.100.1", false)
+	if !found || fake.lists != 2 {
+		t.Errorf("after Add: found = %v, List calls = %d; want true, 2", found, fake.lists)
+	}
+
+	// Edits made elsewhere are only seen after a refresh or with fresh
+	fake.ips["192.0.2.1"] = true
+	found, _, _ = c.ContainsCached(ctx, "192.0.2.1", false)
+	if found {
+		t.Error("external edit visible before refresh")
+	}
+	found, age, _ := c.ContainsCached(ctx, "192.0.2.1", true)
+	if !found || age > time.Second {
+		t.Errorf("fresh read: found = %v, age = %s; want true, ~0", found, age)
+	}
+}
+
+// slowListProvider is a fakeProvider whose List blocks until release is
+// closed. listing, if set, is signalled when a List starts waiting.
+type slowListProvider struct {
+	*fakeProvider
+	release chan struct{}
+	listing chan struct{}
+}
+
+func (p *slowListProvider) List(ctx context.Context) ([]string, error) {
+	if p.listing != nil {
+		select {
+		case p.listing <- struct{}{}:
+		default:
+		}
+	}
+	select {
+	case <-p.release:
+		return p.fakeProvider.List(ctx)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestCachedAccessRulesAgreeWithContains(t *testing.T) {
+	fake := &fakeAccessRules{rules: map[string]CFAccessRule{
+		"manual": {ID: "manual", Mode: "whitelist", Notes: "office", Configuration: CFAccessRuleTarget{Target: "ip", Value: "9.9.9.9"}},
+	}}
+	withFakeCloudflare(t, fake)
+	p := &accessRulesProvider{}
+	c := newCachedProvider(p, time.Hour)
+	ctx := context.Background()
+	if _, err := c.Add(ctx, RuleRequest{IP: "1.2.3.4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A manual or adopted rule whitelists its IP just like ours
+	for _, ip := range []string{"1.2.3.4", "9.9.9.9", "5.5.5.5"} {
+		want, _ := p.Contains(ctx, ip)
+		if got, _, err := c.ContainsCached(ctx, ip, false); got != want || err != nil {
+			t.Errorf("ContainsCached(%s) = %v, %v; Contains says %v", ip, got, err, want)
+		}
+	}
+}
+
+func TestCachedProviderReadsDuringSlowRefresh(t *testing.T) {
+	slow := &slowListProvider{fakeProvider: newFakeProvider("203.0.113.7"), release: make(chan struct{})}
+	c := newCachedProvider(slow, time.Hour)
+	ctx := context.Background()
+
+	close(slow.release)
+	if found, _, err := c.ContainsCached(ctx, "203.0.113.7", false); err != nil || !found {
+		t.Fatalf("ContainsCached() = %v, %v; want true, nil", found, err)
+	}
+
+	// A refresh stuck on the API does not hold up reads of the valid copy
+	slow.release = make(chan struct{})
+	refreshed := make(chan error, 1)
+	go func() {
+		_, err := c.refresh(ctx)
+		refreshed <- err
+	}()
+	done := make(chan bool, 1)
+	go func() {
+		found, _, _ := c.ContainsCached(ctx, "203.0.113.7", false)
+		done <- found
+	}()
+	select {
+	case found := <-done:
+		if !found {
+			t.Error("cached read during refresh = false, want true")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cached read blocked behind a slow refresh")
+	}
+
+	// A caller that gives up on a stale read is not stuck either
+	waitCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := c.ContainsCached(waitCtx, "203.0.113.7", true); err == nil {
+		t.Error("fresh read while the API hangs: want the caller's deadline error")
+	}
+
+	close(slow.release)
+	if err := <-refreshed; err != nil {
+		t.Errorf("refresh() error: %v", err)
+	}
+}
+
+func TestHandleStatusUsesCache(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "whitelist_store_status.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	origStore, origStoreFile, origProvider := store, storeFile, provider
+	defer func() { store, storeFile, provider = origStore, origStoreFile, origProvider }()
+	storeFile = tmpfile.Name()
+	store = &WhitelistStore{Entries: make(map[string]time.Time)}
+	store.Add("8.8.8.8", time.Now().Add(time.Hour), EntryMeta{})
+
+	fake := newFakeProvider("8.8.8.8")
+	provider = newCachedProvider(fake, time.Hour)
+
+	status := func(query string) StatusResponse {
+		req := httptest.NewRequest("GET", "/status"+query, nil)
+		req.Header.Set("CF-Connecting-IP", "8.8.8.8")
+		rr := httptest.NewRecorder()
+		handleStatus(rr, req)
+		var resp StatusResponse
+		json.NewDecoder(rr.Body).Decode(&resp)
+		return resp
+	}
+
+	if resp := status(""); !resp.Whitelisted {
+		t.Errorf("status = %+v, want whitelisted", resp)
+	}
+	status("")
+	status("?fresh=true")
+	if fake.lists != 2 {
+		t.Errorf("List calls = %d, want 2 (one cached read, one fresh)", fake.lists)
+	}
+}
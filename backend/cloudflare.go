@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cfAPIBase is the Cloudflare v4 API root. Tests point it at an httptest server.
+var cfAPIBase = "https://api.cloudflare.com/client/v4"
+
+// cf is the client used for every Cloudflare API call.
+var cf = newCFClient(
+	getEnvDuration("CLOUDFLARE_TIMEOUT", 30*time.Second),
+	getEnvInt("CLOUDFLARE_MAX_RETRIES", 4),
+	getEnvInt("CLOUDFLARE_RATE_LIMIT", 1200),
+)
+
+// cfRateWindow is the period Cloudflare's global API rate limit applies to:
+// 1200 requests per 5 minutes per user.
+const cfRateWindow = 5 * time.Minute
+
+// cfEnvelope is the response wrapper shared by every Cloudflare v4 endpoint.
+type cfEnvelope struct {
+	Success    bool            `json:"success"`
+	Errors     []CFError       `json:"errors"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo *cfResultInfo   `json:"result_info,omitempty"`
+}
+
+type cfResultInfo struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	TotalPages int `json:"total_pages"`
+	Count      int `json:"count"`
+	TotalCount int `json:"total_count"`
+	Cursors    struct {
+		After string `json:"after"`
+	} `json:"cursors"`
+}
+
+// CFError is one entry of the errors array of a Cloudflare response.
+type CFError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// CFAPIError is returned for every unsuccessful Cloudflare response, so
+// callers can inspect the HTTP status and Cloudflare error codes.
+type CFAPIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Errors     []CFError
+	RayID      string
+}
+
+func (e *CFAPIError) Error() string {
+	var msgs []string
+	for _, ce := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%d: %s", ce.Code, ce.Message))
+	}
+	if len(msgs) == 0 {
+		msgs = append(msgs, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("CF API Error: %s %s returned %d (%s)", e.Method, e.Path, e.StatusCode, strings.Join(msgs, "; "))
+}
+
+// HasCode reports whether Cloudflare returned the given error code.
+func (e *CFAPIError) HasCode(code int) bool {
+	for _, ce := range e.Errors {
+		if ce.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// cfClient sends Cloudflare API requests with a per-attempt timeout,
+// retries with exponential backoff and jitter (or after the server's
+// Retry-After), and a client-side token bucket that keeps us under
+// Cloudflare's rate limit.
+type cfClient struct {
+	http        *http.Client
+	maxRetries  int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	limiter     *tokenBucket
+
+	// sleep waits for d or until ctx is done. Tests replace it.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newCFClient(timeout time.Duration, maxRetries, ratePerWindow int) *cfClient {
+	return &cfClient{
+		http:        &http.Client{Timeout: timeout},
+		maxRetries:  maxRetries,
+		baseBackoff: 500 * time.Millisecond,
+		maxBackoff:  30 * time.Second,
+		limiter:     newTokenBucket(ratePerWindow, cfRateWindow),
+		sleep:       sleepContext,
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// cfCall sends a request to the Cloudflare API. path is relative to
+// cfAPIBase (e.g. "zones/<id>/firewall/access_rules/rules"). When out is
+// non-nil the result field is decoded into it.
+func cfCall(ctx context.Context, method, path string, body, out interface{}) (*cfEnvelope, error) {
+	return cf.call(ctx, method, path, body, out)
+}
+
+func (c *cfClient) call(ctx context.Context, method, path string, body, out interface{}) (*cfEnvelope, error) {
+	var payload []byte
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		payload = b
+	}
+
+	for attempt := 0; ; attempt++ {
+		env, retryAfter, err := c.attempt(ctx, method, path, payload)
+		if err == nil {
+			if out != nil && len(env.Result) > 0 {
+				if err := json.Unmarshal(env.Result, out); err != nil {
+					return nil, fmt.Errorf("failed to decode CF API result: %w", err)
+				}
+			}
+			return env, nil
+		}
+
+		if attempt >= c.maxRetries || !c.retryable(ctx, method, err) {
+			return nil, err
+		}
+
+		wait := c.backoff(attempt)
+		if retryAfter > 0 {
+			// Retrying any earlier is pointless: the server would only
+			// refuse again
+			wait = retryAfter
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			// Retrying cannot succeed before the caller gives up
+			return nil, err
+		}
+		log.Printf("[Cloudflare] %s %s failed (%v), retrying in %s (attempt %d/%d)", method, path, err, wait.Round(time.Millisecond), attempt+1, c.maxRetries)
+		if err := c.sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// attempt performs a single request. retryAfter is the server's Retry-After
+// hint, if any.
+func (c *cfClient) attempt(ctx context.Context, method, path string, payload []byte) (env *cfEnvelope, retryAfter time.Duration, err error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, 0, err
+	}
+
+	var bodyReader io.Reader
+	if payload != nil {
+		bodyReader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s/%s", cfAPIBase, path), bodyReader)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+apiToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	traceCFRay(ctx, resp.Header.Get("Cf-Ray"))
+
+	retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+
+	var decoded cfEnvelope
+	decodeErr := json.NewDecoder(resp.Body).Decode(&decoded)
+
+	if resp.StatusCode >= 300 || decodeErr != nil || !decoded.Success {
+		if decodeErr != nil && resp.StatusCode < 300 {
+			return nil, 0, fmt.Errorf("failed to decode CF API response: %w", decodeErr)
+		}
+		return nil, retryAfter, &CFAPIError{
+			Method:     method,
+			Path:       path,
+			StatusCode: resp.StatusCode,
+			Errors:     decoded.Errors,
+			RayID:      resp.Header.Get("Cf-Ray"),
+		}
+	}
+	return &decoded, 0, nil
+}
+
+// retryable decides whether a failed attempt is worth repeating. Rate
+// limiting is always retried; server errors and transport failures only for
+// idempotent methods, since a POST may have been applied already.
+func (c *cfClient) retryable(ctx context.Context, method string, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var apiErr *CFAPIError
+	if errors.As(err, &apiErr) {
+		if apiErr.StatusCode == http.StatusTooManyRequests {
+			return true
+		}
+		return apiErr.StatusCode >= 500 && method != http.MethodPost
+	}
+	return method != http.MethodPost
+}
+
+// backoff returns the delay before retry number attempt+1: exponential,
+// capped, with full jitter.
+func (c *cfClient) backoff(attempt int) time.Duration {
+	max := c.baseBackoff << attempt
+	if max <= 0 || max > c.maxBackoff {
+		max = c.maxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(max)) + 1)
+}
+
+// parseRetryAfter understands both delta-seconds and HTTP-date values.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// tokenBucket is a client-side rate limiter allowing at most limit
+// requests in any window: a burst of a tenth of limit, with the rest
+// refilled evenly over window. Sizing it so burst and refill add up to
+// limit keeps a full bucket from doubling the rate right after an idle
+// period.
+type tokenBucket struct {
+	mu       sync.Mutex
+	capacity float64
+	tokens   float64
+	perSec   float64
+	last     time.Time
+}
+
+func newTokenBucket(limit int, window time.Duration) *tokenBucket {
+	if limit <= 0 {
+		return &tokenBucket{}
+	}
+	burst := max(limit/10, 1)
+	refill := max(limit-burst, 1)
+	return &tokenBucket{
+		capacity: float64(burst),
+		tokens:   float64(burst),
+		perSec:   float64(refill) / window.Seconds(),
+		last:     time.Now(),
+	}
+}
+
+// wait blocks until a token is available or ctx is done. A bucket with no
+// capacity disables limiting.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	if b.capacity <= 0 {
+		return nil
+	}
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.perSec
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+		b.last = now
+
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - b.tokens) / b.perSec * float64(time.Second))
+		b.mu.Unlock()
+
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
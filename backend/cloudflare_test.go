@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withFakeCloudflare points cfAPIBase at a test server running handler and
+// fills in dummy credentials for the duration of the test.
+func withFakeCloudflare(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+
+	origBase, origToken, origAccountID, origZoneID, origPolicyID := cfAPIBase, apiToken, accountID, zoneID, policyID
+	cfAPIBase = srv.URL
+	apiToken, accountID, zoneID, policyID = "token", "account", "zone", "policy"
+	t.Cleanup(func() {
+		srv.Close()
+		cfAPIBase, apiToken, accountID, zoneID, policyID = origBase, origToken, origAccountID, origZoneID, origPolicyID
+	})
+	return srv
+}
+
+// writeCFResult writes a successful Cloudflare envelope around result.
+func writeCFResult(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"errors":  []interface{}{},
+		"result":  result,
+	})
+}
+
+// withTestCFClient installs a client whose sleeps are recorded instead of
+// waited for.
+func withTestCFClient(t *testing.T, maxRetries int) *[]time.Duration {
+	t.Helper()
+	orig := cf
+	var slept []time.Duration
+	cf = newCFClient(5*time.Second, maxRetries, 0)
+	cf.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+	t.Cleanup(func() { cf = orig })
+	return &slept
+}
+
+func TestCFClientRetriesServerErrors(t *testing.T) {
+	var calls int32
+	withFakeCloudflare(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("<html>bad gateway</html>"))
+			return
+		}
+		writeCFResult(w, map[string]string{"id": "ok"})
+	}))
+	slept := withTestCFClient(t, 4)
+
+	var out struct{ ID string }
+	if _, err := cfCall(context.Background(), "GET", "thing", nil, &out); err != nil {
+		t.Fatalf("cfCall() error: %v", err)
+	}
+	if out.ID != "ok" || calls != 3 || len(*slept) != 2 {
+		t.Errorf("out = %+v, calls = %d, sleeps = %v; want ok after 3 calls and 2 backoffs", out, calls, *slept)
+	}
+	for i, d := range *slept {
+		if limit := cf.baseBackoff << i; d <= 0 || d > limit {
+			t.Errorf("backoff %d = %s, want in (0, %s]", i, d, limit)
+		}
+	}
+}
+
+func TestCFClientHonoursRetryAfter(t *testing.T) {
+	var calls int32
+	withFakeCloudflare(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"errors":  []CFError{{Code: 10000, Message: "rate limited"}},
+			})
+			return
+		}
+		writeCFResult(w, nil)
+	}))
+	slept := withTestCFClient(t, 4)
+
+	// Rate limited requests are retried even for POST
+	if _, err := cfCall(context.Background(), "POST", "thing", map[string]string{"a": "b"}, nil); err != nil {
+		t.Fatalf("cfCall() error: %v", err)
+	}
+	if len(*slept) != 1 || (*slept)[0] != 7*time.Second {
+		t.Errorf("sleeps = %v, want [7s]", *slept)
+	}
+}
+
+func TestCFClientWaitsForLongRetryAfter(t *testing.T) {
+	var calls int32
+	withFakeCloudflare(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false})
+			return
+		}
+		writeCFResult(w, nil)
+	}))
+	slept := withTestCFClient(t, 4)
+
+	if _, err := cfCall(context.Background(), "GET", "thing", nil, nil); err != nil {
+		t.Fatalf("cfCall() error: %v", err)
+	}
+	// Longer than any backoff, but retrying sooner would only be refused
+	if len(*slept) != 1 || (*slept)[0] != time.Hour {
+		t.Errorf("sleeps = %v, want [1h]", *slept)
+	}
+
+	// A wait past the caller's deadline fails right away
+	calls = 0
+	*slept = nil
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := cfCall(ctx, "GET", "thing", nil, nil)
+	var apiErr *CFAPIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("error = %v, want the 429", err)
+	}
+	if len(*slept) != 0 || calls != 1 {
+		t.Errorf("calls = %d, sleeps = %v; want 1 call and no sleep", calls, *slept)
+	}
+}
+
+func TestCFClientTypedErrors(t *testing.T) {
+	var calls int32
+	withFakeCloudflare(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cf-Ray", "abc123")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"errors":  []CFError{{Code: 12130, Message: "access.api.error.conflict"}},
+		})
+	}))
+	withTestCFClient(t, 2)
+
+	// A POST that hit a server error is not retried: it may have been applied
+	_, err := cfCall(context.Background(), "POST", "thing", nil, nil)
+	var apiErr *CFAPIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("error = %v, want *CFAPIError", err)
+	}
+	if apiErr.StatusCode != 503 || !apiErr.HasCode(12130) || apiErr.RayID != "abc123" {
+		t.Errorf("CFAPIError = %+v, want 503 with code 12130 and ray ID", apiErr)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+
+	// The same failure on a GET is retried up to the limit
+	calls = 0
+	cfCall(context.Background(), "GET", "thing", nil, nil)
+	if calls != 3 {
+		t.Errorf("calls = %d, want 3 (1 + 2 retries)", calls)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("120"); got != 2*time.Minute {
+		t.Errorf("parseRetryAfter(120) = %s, want 2m", got)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got < 50*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter(%q) = %s, want ~1m", date, got)
+	}
+	if got := parseRetryAfter("soon"); got != 0 {
+		t.Errorf("parseRetryAfter(soon) = %s, want 0", got)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	// A burst of 2, then 18 more per 200ms
+	b := newTokenBucket(20, 200*time.Millisecond)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := b.wait(ctx); err != nil {
+			t.Fatalf("wait() error: %v", err)
+		}
+	}
+	// The burst of 2 is free; the third token takes 11ms to refill
+	if elapsed := time.Since(start); elapsed < 8*time.Millisecond {
+		t.Errorf("3 requests took %s, want the third to wait for a refill", elapsed)
+	}
+
+	// After an idle period no window holds more than the limit
+	time.Sleep(200 * time.Millisecond)
+	var times []time.Time
+	for deadline := time.Now().Add(400 * time.Millisecond); time.Now().Before(deadline); {
+		b.wait(ctx)
+		times = append(times, time.Now())
+	}
+	for i := range times {
+		n := 0
+		for _, at := range times[i:] {
+			if at.Sub(times[i]) < 200*time.Millisecond {
+				n++
+			}
+		}
+		if n > 20 {
+			t.Fatalf("%d requests within 200ms from request %d, want at most 20", n, i)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	b.tokens = 0
+	if err := b.wait(ctx); err == nil {
+		t.Error("wait() with cancelled context expected an error")
+	}
+}
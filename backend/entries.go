@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// EntryMeta records who whitelisted an IP, when and why. Entries written
+// before metadata existed have none: a zero CreatedAt means unknown.
+type EntryMeta struct {
+	CreatedAt time.Time `json:"createdAt"`
+	// CreatedBy owns the entry: the email of the user who asked for it,
+	// or their IP when the service runs without authentication
+	CreatedBy string `json:"createdBy,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Ticket    string `json:"ticket,omitempty"`
+	// Extensions counts how often the entry was extended after creation
+	Extensions int `json:"extensions"`
+	// Backend is the provider the entry was whitelisted in
+	Backend string `json:"backend,omitempty"`
+}
+
+// Entry is a whitelisted IP with everything the store knows about it.
+type Entry struct {
+	IP        string    `json:"ip"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	RuleID    string    `json:"ruleId,omitempty"`
+	EntryMeta
+}
+
+// newEntryMeta returns the metadata of an entry created by r.
+func newEntryMeta(r *http.Request, createdBy, reason, ticket string) EntryMeta {
+	return EntryMeta{
+		CreatedAt: time.Now(),
+		CreatedBy: createdBy,
+		UserAgent: r.UserAgent(),
+		Reason:    reason,
+		Ticket:    ticket,
+		Backend:   provider.Name(),
+	}
+}
+
+// handleEntries lists every entry with its metadata.
+func handleEntries(w http.ResponseWriter, r *http.Request) {
+	entries, err := store.ListEntries()
+	if err != nil {
+		writeOpError(w, storeUnavailable(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWhitelistRecordsMetadata(t *testing.T) {
+	withTestStore(t, newFakeProvider())
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("CF-Connecting-IP", "203.0.113.30")
+		req.Header.Set("User-Agent", "curl/8.0")
+		rr := httptest.NewRecorder()
+		switch path {
+		case "/whitelist":
+			handleWhitelist(rr, req)
+		case "/status":
+			handleStatus(rr, req)
+		case "/admin/entries":
+			handleEntries(rr, req)
+		}
+		return rr
+	}
+
+	if rr := do("POST", "/whitelist", `{"duration":"60","reason":"on call","ticket":"OPS-42"}`); rr.Code != http.StatusOK {
+		t.Fatalf("whitelist: status = %d (%s)", rr.Code, rr.Body.String())
+	}
+	// An extension keeps the original reason
+	if rr := do("POST", "/whitelist", `{"duration":"120","reason":"changed"}`); rr.Code != http.StatusOK {
+		t.Fatalf("extend: status = %d (%s)", rr.Code, rr.Body.String())
+	}
+
+	var status StatusResponse
+	json.NewDecoder(do("GET", "/status", "").Body).Decode(&status)
+	e := status.Entry
+	if e == nil {
+		t.Fatal("GET /status returned no entry")
+	}
+	if e.CreatedBy != "203.0.113.30" || e.UserAgent != "curl/8.0" || e.Reason != "on call" || e.Ticket != "OPS-42" {
+		t.Errorf("entry metadata = %+v", e.EntryMeta)
+	}
+	if e.Extensions != 1 || e.Backend != "fake" || e.RuleID != "rule-203.0.113.30" || e.CreatedAt.IsZero() {
+		t.Errorf("entry = %+v, want 1 extension, backend fake and a rule ID", e)
+	}
+
+	var entries []Entry
+	json.NewDecoder(do("GET", "/admin/entries", "").Body).Decode(&entries)
+	if len(entries) != 1 || entries[0].IP != "203.0.113.30" || entries[0].Reason != "on call" {
+		t.Errorf("GET /admin/entries = %+v", entries)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// Every store records a history of whitelist changes per IP, kept for
+// HISTORY_RETENTION. GET /admin/history (or GET /history) lists it and
+// answers "was this IP whitelisted at that time?".
+
+// History events recorded per IP.
+const (
+	HistoryWhitelisted = "whitelisted"
+	HistoryExtended    = "extended"
+	HistoryRemoved     = "removed"
+	HistoryExpired     = "expired"
+)
+
+// HistoryEvent is a change to the entry of an IP. ExpiresAt is the new
+// expiry, for whitelisted and extended events. Removed events are explicit
+// removals, expired events the expiry daemon's removal of the rule
+// completing.
+type HistoryEvent struct {
+	IP        string     `json:"ip"`
+	Event     string     `json:"event"`
+	At        time.Time  `json:"at"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+func newHistoryEvent(ip, event string, at, expiry time.Time) HistoryEvent {
+	e := HistoryEvent{IP: ip, Event: event, At: at}
+	if !expiry.IsZero() {
+		e.ExpiresAt = &expiry
+	}
+	return e
+}
+
+// historyCutoff returns the time before which history is dropped, or the
+// zero time if it is kept forever.
+func historyCutoff(now time.Time) time.Time {
+	if historyRetention <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-historyRetention)
+}
+
+// inRange reports whether t lies within [from, to]; zero bounds are open.
+func inRange(t, from, to time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || !t.After(to))
+}
+
+type HistoryResponse struct {
+	IP     string         `json:"ip,omitempty"`
+	Events []HistoryEvent `json:"events"`
+}
+
+// PointInTimeResponse answers GET /history?ip=...&at=... CoveredBy is the
+// entry that whitelisted the IP, when that was a wider prefix.
+type PointInTimeResponse struct {
+	IP          string     `json:"ip"`
+	At          time.Time  `json:"at"`
+	Whitelisted bool       `json:"whitelisted"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	CoveredBy   string     `json:"coveredBy,omitempty"`
+}
+
+// whitelistedAt replays the events of one IP up to at: it was whitelisted
+// if the last of them (re-)whitelisted it until after at, or until before
+// at but its rule was only removed after at.
+func whitelistedAt(events []HistoryEvent, at time.Time) (bool, *time.Time) {
+	var last, next *HistoryEvent
+	for i := range events {
+		if events[i].At.After(at) {
+			next = &events[i]
+			break
+		}
+		last = &events[i]
+	}
+	if last == nil || last.Event == HistoryRemoved || last.Event == HistoryExpired || last.ExpiresAt == nil {
+		return false, nil
+	}
+	if !last.ExpiresAt.After(at) && (next == nil || next.Event != HistoryExpired) {
+		return false, nil
+	}
+	return true, last.ExpiresAt
+}
+
+// coveredAt replays the history of every entry covering prefix, the prefix
+// itself or a wider one, and returns the narrowest that whitelisted it at
+// at, or "" if none did.
+func coveredAt(events []HistoryEvent, prefix netip.Prefix, at time.Time) (string, *time.Time) {
+	byEntry := make(map[netip.Prefix][]HistoryEvent)
+	for _, e := range events {
+		p, err := parseIPOrPrefix(e.IP)
+		if err != nil || p.Bits() > prefix.Bits() || !p.Contains(prefix.Addr()) {
+			continue
+		}
+		byEntry[p] = append(byEntry[p], e)
+	}
+	entries := make([]netip.Prefix, 0, len(byEntry))
+	for p := range byEntry {
+		entries = append(entries, p)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Bits() > entries[j].Bits() })
+	for _, p := range entries {
+		if ok, expiry := whitelistedAt(byEntry[p], at); ok {
+			return prefixString(p), expiry
+		}
+	}
+	return "", nil
+}
+
+// handleHistory lists history events, optionally of one IP (?ip=) and
+// between ?from= and ?to= (RFC 3339). With ?ip= and ?at= it reports
+// whether the IP was whitelisted at that time instead, by its own entry or
+// by one for a prefix covering it.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var ip string
+	var prefix netip.Prefix
+	if v := q.Get("ip"); v != "" {
+		var err error
+		prefix, err = parseIPOrPrefix(v)
+		if err != nil {
+			http.Error(w, "Invalid IP address or prefix", http.StatusBadRequest)
+			return
+		}
+		ip = prefixString(prefix)
+	}
+
+	var times [3]time.Time
+	for i, name := range []string{"from", "to", "at"} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "Invalid "+name+" time, want RFC 3339", http.StatusBadRequest)
+				return
+			}
+			times[i] = t
+		}
+	}
+	from, to, at := times[0], times[1], times[2]
+
+	if !at.IsZero() {
+		if ip == "" {
+			http.Error(w, "at requires ip", http.StatusBadRequest)
+			return
+		}
+		// Covering entries and removals completed after at both matter
+		events, err := store.History("", time.Time{}, time.Time{})
+		if err != nil {
+			log.Printf("Error reading history of %s: %v", ip, err)
+			http.Error(w, "Failed to read history", http.StatusInternalServerError)
+			return
+		}
+		resp := PointInTimeResponse{IP: ip, At: at}
+		var entry string
+		entry, resp.ExpiresAt = coveredAt(events, prefix, at)
+		resp.Whitelisted = entry != ""
+		if entry != ip {
+			resp.CoveredBy = entry
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	events, err := store.History(ip, from, to)
+	if err != nil {
+		log.Printf("Error reading history: %v", err)
+		http.Error(w, "Failed to read history", http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []HistoryEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HistoryResponse{IP: ip, Events: events})
+}
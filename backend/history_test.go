@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWhitelistedAt(t *testing.T) {
+	base := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(min int) time.Time { return base.Add(time.Duration(min) * time.Minute) }
+	events := []HistoryEvent{
+		newHistoryEvent("1.1.1.1", HistoryWhitelisted, at(0), at(60)),
+		newHistoryEvent("1.1.1.1", HistoryExtended, at(30), at(120)),
+		newHistoryEvent("1.1.1.1", HistoryRemoved, at(90), time.Time{}),
+		newHistoryEvent("1.1.1.1", HistoryWhitelisted, at(200), at(230)),
+		newHistoryEvent("1.1.1.1", HistoryWhitelisted, at(300), at(330)),
+		newHistoryEvent("1.1.1.1", HistoryExpired, at(350), time.Time{}),
+	}
+
+	tests := []struct {
+		name string
+		min  int
+		want bool
+	}{
+		{"before anything", -1, false},
+		{"just whitelisted", 0, true},
+		{"after extension past first expiry", 70, true},
+		{"after removal", 100, false},
+		{"whitelisted again", 210, true},
+		{"expired without removal", 240, false},
+		{"expired, removal still failing", 340, true},
+		{"removal completed", 360, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, expiry := whitelistedAt(events, at(tt.min))
+			if got != tt.want || (expiry != nil) != tt.want {
+				t.Errorf("whitelistedAt(+%dm) = %v, %v; want %v", tt.min, got, expiry, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveExpiredRecordsExpiry(t *testing.T) {
+	withTestStore(t, newFakeProvider("198.51.100.1"))
+	store.Add("198.51.100.1", time.Now().Add(-time.Minute), EntryMeta{})
+
+	removeExpired(time.Now())
+
+	events, _ := store.History("198.51.100.1", time.Time{}, time.Time{})
+	if len(events) != 2 || events[1].Event != HistoryExpired {
+		t.Errorf("history = %+v, want whitelisted then expired", events)
+	}
+	if ok, _ := whitelistedAt(events, events[1].At); ok {
+		t.Error("IP still whitelisted once expired")
+	}
+}
+
+func TestExpiryRecordedWhenRemovalCompletes(t *testing.T) {
+	fake := newFakeProvider("198.51.100.1")
+	withTestStore(t, fake)
+	store.Add("198.51.100.1", time.Now().Add(-time.Minute), EntryMeta{})
+
+	fake.removeErr = errors.New("cloudflare is down")
+	removeExpired(time.Now())
+	if events, _ := store.History("198.51.100.1", time.Time{}, time.Time{}); len(events) != 1 {
+		t.Errorf("history with the removal queued = %+v, want only whitelisted", events)
+	}
+
+	fake.removeErr = nil
+	processOutbox(context.Background(), time.Now().Add(time.Hour))
+	events, _ := store.History("198.51.100.1", time.Time{}, time.Time{})
+	if len(events) != 2 || events[1].Event != HistoryExpired {
+		t.Errorf("history once removed = %+v, want whitelisted then expired", events)
+	}
+}
+
+func TestHandleHistory(t *testing.T) {
+	withTestStore(t, newFakeProvider())
+	store.Add("1.1.1.1", time.Now().Add(time.Hour), EntryMeta{})
+	store.Add("2.2.2.2", time.Now().Add(time.Hour), EntryMeta{})
+	store.Remove("1.1.1.1")
+	store.Add("203.0.113.0/24", time.Now().Add(time.Hour), EntryMeta{})
+
+	get := func(query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handleHistory(rr, httptest.NewRequest("GET", "/history?"+query, nil))
+		return rr
+	}
+
+	var resp HistoryResponse
+	json.NewDecoder(get("ip=1.1.1.1").Body).Decode(&resp)
+	if len(resp.Events) != 2 || resp.Events[0].Event != HistoryWhitelisted || resp.Events[1].Event != HistoryRemoved {
+		t.Errorf("history of 1.1.1.1 = %+v", resp.Events)
+	}
+	json.NewDecoder(get("").Body).Decode(&resp)
+	if len(resp.Events) != 4 {
+		t.Errorf("full history has %d events, want 4", len(resp.Events))
+	}
+	future := time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+	json.NewDecoder(get("from=" + future).Body).Decode(&resp)
+	if len(resp.Events) != 0 {
+		t.Errorf("history from the future = %+v", resp.Events)
+	}
+
+	var pit PointInTimeResponse
+	json.NewDecoder(get("ip=2.2.2.2&at=" + future).Body).Decode(&pit)
+	if !pit.Whitelisted || pit.ExpiresAt == nil {
+		t.Errorf("2.2.2.2 at %s = %+v, want whitelisted", future, pit)
+	}
+	json.NewDecoder(get("ip=1.1.1.1&at=" + future).Body).Decode(&pit)
+	if pit.Whitelisted {
+		t.Errorf("removed 1.1.1.1 at %s = %+v, want not whitelisted", future, pit)
+	}
+	pit = PointInTimeResponse{}
+	json.NewDecoder(get("ip=203.0.113.7&at=" + future).Body).Decode(&pit)
+	if !pit.Whitelisted || pit.CoveredBy != "203.0.113.0/24" {
+		t.Errorf("203.0.113.7 at %s = %+v, want covered by 203.0.113.0/24", future, pit)
+	}
+	pit = PointInTimeResponse{}
+	json.NewDecoder(get("ip=203.0.113.0/16&at=" + future).Body).Decode(&pit)
+	if pit.Whitelisted {
+		t.Errorf("203.0.0.0/16 at %s = %+v, want not whitelisted by a narrower entry", future, pit)
+	}
+
+	for _, bad := range []string{"ip=nope", "from=yesterday", "at=" + future} {
+		if rr := get(bad); rr.Code != http.StatusBadRequest {
+			t.Errorf("GET /history?%s: status = %d, want 400", bad, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Identity tokens (Cloudflare Access assertions, OIDC ID tokens) are JWTs
+// signed with RS256 by a key from the issuer's JSON Web Key Set. Keys are
+// cached and fetched again hourly, or as soon as a token names a key the
+// cache does not know, which is how a key rotation shows up.
+
+const (
+	// jwksRefreshInterval is how long fetched keys are used as they are
+	jwksRefreshInterval = time.Hour
+	// jwksMinRefetch limits fetches for unknown key IDs, so tokens with
+	// made-up key IDs cannot hammer the issuer
+	jwksMinRefetch   = time.Minute
+	jwksFetchTimeout = 10 * time.Second
+	// jwtLeeway is the clock skew tolerated when checking exp and nbf
+	jwtLeeway = time.Minute
+)
+
+// jwks is the cached key set behind url.
+type jwks struct {
+	url    string
+	client *http.Client
+
+	fetchMu   sync.Mutex // serializes fetches
+	lastFetch time.Time  // last attempt, guarded by fetchMu
+
+	mu        sync.RWMutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+func newJWKS(url string) *jwks {
+	return &jwks{url: url, client: &http.Client{Timeout: jwksFetchTimeout}}
+}
+
+// cached returns the key with ID kid and whether the key set is fresh.
+func (k *jwks) cached(kid string) (*rsa.PublicKey, bool, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[kid]
+	return key, ok, time.Since(k.fetchedAt) < jwksRefreshInterval
+}
+
+// key returns the public key with ID kid, fetching the key set if it is
+// stale or does not contain kid yet. A stale key is still used when the
+// key set cannot be fetched.
+func (k *jwks) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	if key, ok, fresh := k.cached(kid); ok && fresh {
+		return key, nil
+	}
+
+	k.fetchMu.Lock()
+	defer k.fetchMu.Unlock()
+	// Another caller may have fetched it in the meantime
+	key, ok, fresh := k.cached(kid)
+	if ok && fresh {
+		return key, nil
+	}
+	if !ok && time.Since(k.lastFetch) < jwksMinRefetch {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	k.lastFetch = time.Now()
+	keys, err := k.fetch(ctx)
+	if err != nil {
+		if ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("fetching signing keys: %w", err)
+	}
+	k.mu.Lock()
+	k.keys, k.fetchedAt = keys, time.Now()
+	k.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// fetch downloads the key set, keeping its RSA signing keys.
+func (k *jwks) fetch(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", k.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", k.url, resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("%s: %w", k.url, err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no RSA signing keys", k.url)
+	}
+	return keys, nil
+}
+
+// jwtAudience is the aud claim, a string or an array of strings.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = jwtAudience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a jwtAudience) contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// jwtClaims are the claims of a verified token the service looks at.
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt int64       `json:"exp"`
+	NotBefore int64       `json:"nbf"`
+	Email     string      `json:"email"`
+	// EmailVerified is nil when the issuer does not say
+	EmailVerified *bool  `json:"email_verified"`
+	Nonce         string `json:"nonce"`
+
+	// raw holds every claim, for claims whose name is configured
+	raw map[string]json.RawMessage
+}
+
+// strings returns the claim called name as a list: a string is a list of
+// one, anything but strings counts as missing.
+func (c *jwtClaims) strings(name string) []string {
+	var many []string
+	if err := json.Unmarshal(c.raw[name], &many); err == nil {
+		return many
+	}
+	var one string
+	if err := json.Unmarshal(c.raw[name], &one); err == nil && one != "" {
+		return []string{one}
+	}
+	return nil
+}
+
+var errInvalidToken = errors.New("invalid token")
+
+// verifyJWT checks the signature of token against keys and that it was
+// issued by issuer for audience and is valid now. It returns the claims.
+func verifyJWT(ctx context.Context, token string, keys *jwks, issuer, audience string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a JWT", errInvalidToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", errInvalidToken, err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", errInvalidToken, header.Alg)
+	}
+
+	key, err := keys.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", errInvalidToken, err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("%w: bad signature", errInvalidToken)
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", errInvalidToken, err)
+	}
+	if err := decodeJWTPart(parts[1], &claims.raw); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", errInvalidToken, err)
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != issuer:
+		return nil, fmt.Errorf("%w: issued by %q", errInvalidToken, claims.Issuer)
+	case !claims.Audience.contains(audience):
+		return nil, fmt.Errorf("%w: not issued for this application", errInvalidToken)
+	case claims.ExpiresAt == 0 || now.Add(-jwtLeeway).After(time.Unix(claims.ExpiresAt, 0)):
+		return nil, fmt.Errorf("%w: expired", errInvalidToken)
+	case claims.NotBefore != 0 && now.Add(jwtLeeway).Before(time.Unix(claims.NotBefore, 0)):
+		return nil, fmt.Errorf("%w: not valid yet", errInvalidToken)
+	}
+	return &claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// With several replicas only one of them, the leader, runs the expiry
+// daemon (including the outbox) and the reconciler; the others just serve
+// requests. Leadership is a lock that fits the store: a file lock for the
+// JSON store (single host), a lease row for SQLite and a lease key for
+// Redis. The leader renews it every LEADER_LEASE_TTL/3; if it stops (crash,
+// lost connection), another replica takes over once the lease runs out.
+
+// leaderLock is held by at most one replica at a time.
+type leaderLock interface {
+	// Acquire takes the lock for id, or renews it if id already holds it,
+	// for ttl. It reports whether id holds the lock afterwards.
+	Acquire(ctx context.Context, id string, ttl time.Duration) (bool, error)
+}
+
+type HealthResponse struct {
+	Status  string `json:"status"`
+	Replica string `json:"replica"`
+	Leader  bool   `json:"leader"`
+	Store   string `json:"store"`
+}
+
+// leading is whether this replica currently holds the leader lock.
+var leading atomic.Bool
+
+func isLeader() bool {
+	return leading.Load()
+}
+
+// defaultReplicaID identifies this process: the hostname (the container ID
+// under Docker) plus a random suffix.
+func defaultReplicaID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "replica"
+	}
+	return host + "-" + newID()[:6]
+}
+
+// newLeaderLock returns the lock matching the store backend.
+func newLeaderLock(s Store) leaderLock {
+	if l, ok := s.(leaderLock); ok {
+		return l
+	}
+	return &fileLock{path: storeFile + ".lock"}
+}
+
+// campaign tries once to take or keep the leader lock, logging changes.
+func campaign(ctx context.Context, lock leaderLock) {
+	held, err := lock.Acquire(ctx, replicaID, leaderLeaseTTL)
+	if err != nil {
+		log.Printf("Leader: lock check failed: %v", err)
+		held = false
+	}
+	if was := leading.Swap(held); was != held {
+		if held {
+			log.Printf("Leader: replica %s is now the leader", replicaID)
+		} else {
+			log.Printf("Leader: replica %s lost leadership", replicaID)
+		}
+	}
+}
+
+// startLeaderElection keeps campaigning, well within the lease TTL.
+func startLeaderElection(lock leaderLock) {
+	ticker := time.NewTicker(leaderLeaseTTL / 3)
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), leaderLeaseTTL/3)
+		campaign(ctx, lock)
+		cancel()
+	}
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HealthResponse{
+		Status:  "ok",
+		Replica: replicaID,
+		Leader:  isLeader(),
+		Store:   storeBackend,
+	})
+}
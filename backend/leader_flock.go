@@ -0,0 +1,56 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fileLock is an exclusive flock(2) on a file next to the JSON store. The
+// kernel releases it when the process exits, so the TTL is not needed.
+type fileLock struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File // open while held
+}
+
+func (l *fileLock) Acquire(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		return true, nil
+	}
+
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		}
+		return false, err
+	}
+	// Only informational: who holds the lock
+	f.Truncate(0)
+	f.WriteAt([]byte(id+"\n"), 0)
+	l.f = f
+	return true, nil
+}
+
+// release drops the lock, as exiting would.
+func (l *fileLock) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+}
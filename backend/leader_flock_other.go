@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// fileLock is always held where flock(2) is unavailable: run a single
+// replica on such systems.
+type fileLock struct {
+	path string
+}
+
+func (l *fileLock) Acquire(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (l *fileLock) release() {}
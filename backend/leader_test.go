@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestLeaderLocks(t *testing.T) {
+	const ttl = 100 * time.Millisecond
+
+	tests := []struct {
+		name string
+		// open returns two replicas' handles on the same lock, and a
+		// function making the first one's lease lapse as if it had crashed
+		open func(t *testing.T) (a, b leaderLock, crash func())
+	}{
+		{"file", func(t *testing.T) (leaderLock, leaderLock, func()) {
+			path := filepath.Join(t.TempDir(), "whitelist_store.json.lock")
+			a, b := &fileLock{path: path}, &fileLock{path: path}
+			t.Cleanup(func() { a.release(); b.release() })
+			return a, b, a.release
+		}},
+		{"sqlite", func(t *testing.T) (leaderLock, leaderLock, func()) {
+			path := filepath.Join(t.TempDir(), "whitelist.db")
+			a, err := openSQLiteStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := openSQLiteStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { a.Close(); b.Close() })
+			return a, b, func() { time.Sleep(ttl + 10*time.Millisecond) }
+		}},
+		{"redis", func(t *testing.T) (leaderLock, leaderLock, func()) {
+			mr := miniredis.RunT(t)
+			return openTestRedisStore(t, mr.Addr()), openTestRedisStore(t, mr.Addr()), func() { mr.FastForward(ttl) }
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			a, b, crash := tt.open(t)
+
+			if held, err := a.Acquire(ctx, "a", ttl); !held || err != nil {
+				t.Fatalf("a.Acquire() = %v, %v; want the free lock", held, err)
+			}
+			if held, err := b.Acquire(ctx, "b", ttl); held || err != nil {
+				t.Fatalf("b.Acquire() = %v, %v; want it held by a", held, err)
+			}
+			if held, err := a.Acquire(ctx, "a", ttl); !held || err != nil {
+				t.Fatalf("a renewing = %v, %v", held, err)
+			}
+
+			// Failover once a stops renewing
+			crash()
+			if held, err := b.Acquire(ctx, "b", ttl); !held || err != nil {
+				t.Fatalf("b.Acquire() after a crashed = %v, %v", held, err)
+			}
+			if tt.name != "file" {
+				if held, _ := a.Acquire(ctx, "a", ttl); held {
+					t.Error("a took the lock back from b")
+				}
+			}
+		})
+	}
+}
+
+func TestHealthzLeadership(t *testing.T) {
+	origReplica := replicaID
+	replicaID = "replica-1"
+	defer func() { replicaID = origReplica; leading.Store(false) }()
+
+	lock := &fileLock{path: filepath.Join(t.TempDir(), "lock")}
+	defer lock.release()
+	other := &fileLock{path: lock.path}
+	defer other.release()
+	other.Acquire(context.Background(), "replica-2", leaderLeaseTTL)
+
+	for _, wantLeader := range []bool{false, true} {
+		if wantLeader {
+			other.release()
+		}
+		campaign(context.Background(), lock)
+
+		rr := httptest.NewRecorder()
+		handleHealthz(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		var resp HealthResponse
+		json.NewDecoder(rr.Body).Decode(&resp)
+		if resp.Leader != wantLeader || resp.Replica != "replica-1" || resp.Status != "ok" {
+			t.Errorf("GET /healthz = %+v, want leader %v", resp, wantLeader)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+// listOperationPollInterval is how often a pending bulk operation is polled.
+var listOperationPollInterval = time.Second
+
+// listOperationTimeout bounds the wait for one bulk operation, so a stuck
+// operation cannot hold up a caller without a deadline of its own.
+var listOperationTimeout = 2 * time.Minute
+
+// CFListItem is an entry of an account-level IP list.
+type CFListItem struct {
+	ID      string `json:"id,omitempty"`
+	IP      string `json:"ip"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// CFListOperation is the handle returned by list mutations, which Cloudflare
+// applies asynchronously.
+type CFListOperation struct {
+	OperationID string `json:"operation_id"`
+}
+
+// CFBulkOperation is the status of a list bulk operation.
+type CFBulkOperation struct {
+	ID     string `json:"id"`
+	Status string `json:"status"` // pending, running, completed or failed
+	Error  string `json:"error,omitempty"`
+}
+
+// listsProvider whitelists IPs as items of an account-level IP list
+// (CLOUDFLARE_LIST_ID), typically referenced by a WAF custom rule.
+type listsProvider struct{}
+
+func (p *listsProvider) Name() string { return "lists" }
+
+func (p *listsProvider) MissingConfig() []string {
+	var missing []string
+	if apiToken == "" {
+		missing = append(missing, "CLOUDFLARE_API_TOKEN")
+	}
+	if accountID == "" {
+		missing = append(missing, "CLOUDFLARE_ACCOUNT_ID")
+	}
+	if listID == "" {
+		missing = append(missing, "CLOUDFLARE_LIST_ID")
+	}
+	return missing
+}
+
+func (p *listsProvider) itemsPath() string {
+	return fmt.Sprintf("accounts/%s/rules/lists/%s/items", accountID, listID)
+}
+
+// waitForOperation polls a bulk operation until it completes, fails or
+// listOperationTimeout passes.
+func (p *listsProvider) waitForOperation(ctx context.Context, operationID string) error {
+	if operationID == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, listOperationTimeout)
+	defer cancel()
+	path := fmt.Sprintf("accounts/%s/rules/lists/bulk_operations/%s", accountID, operationID)
+
+	for {
+		var op CFBulkOperation
+		if _, err := cfCall(ctx, "GET", path, nil, &op); err != nil {
+			return fmt.Errorf("failed to get bulk operation %s: %w", operationID, err)
+		}
+		switch op.Status {
+		case "completed":
+			return nil
+		case "failed":
+			return fmt.Errorf("bulk operation %s failed: %s", operationID, op.Error)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("bulk operation %s still %s: %w", operationID, op.Status, ctx.Err())
+		case <-time.After(listOperationPollInterval):
+		}
+	}
+}
+
+// find returns the list items for exactly ip, however either is written.
+// The search matches substrings, so every page of results is checked.
+func (p *listsProvider) find(ctx context.Context, ip string) ([]CFListItem, error) {
+	prefix, err := parseIPOrPrefix(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []CFListItem
+	cursor := ""
+	for {
+		q := url.Values{}
+		q.Set("search", prefixString(prefix))
+		if cursor != "" {
+			q.Set("cursor", cursor)
+		}
+
+		var items []CFListItem
+		env, err := cfCall(ctx, "GET", p.itemsPath()+"?"+q.Encode(), nil, &items)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			if itemPrefix, err := parseIPOrPrefix(item.IP); err == nil && itemPrefix == prefix {
+				matches = append(matches, item)
+			}
+		}
+		if env.ResultInfo == nil || env.ResultInfo.Cursors.After == "" {
+			break
+		}
+		cursor = env.ResultInfo.Cursors.After
+	}
+	return matches, nil
+}
+
+func (p *listsProvider) Add(ctx context.Context, req RuleRequest) (string, error) {
+	ip := req.IP
+	if !providerConfigured(p) {
+		log.Println("Skipping Cloudflare update: API credentials not configured")
+		return "", nil
+	}
+
+	log.Printf("[Cloudflare] Attempting to add IP %s to list %s", ip, listID)
+
+	var op CFListOperation
+	items := []CFListItem{{IP: ip, Comment: req.Comment()}}
+	if _, err := cfCall(ctx, "POST", p.itemsPath(), items, &op); err != nil {
+		return "", fmt.Errorf("failed to add list item: %w", err)
+	}
+	if err := p.waitForOperation(ctx, op.OperationID); err != nil {
+		return "", err
+	}
+
+	// The bulk operation does not return item IDs, so look the new item up
+	matches, err := p.find(ctx, ip)
+	if err != nil {
+		return "", fmt.Errorf("failed to verify list update: %w", err)
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("verification failed: IP %s not found in list after update", ip)
+	}
+
+	log.Printf("[Cloudflare] Added IP %s to list as item %s", ip, matches[0].ID)
+	return matches[0].ID, nil
+}
+
+// deleteItems removes the items with the given IDs and waits for the
+// resulting bulk operation.
+func (p *listsProvider) deleteItems(ctx context.Context, ids []string) error {
+	type itemRef struct {
+		ID string `json:"id"`
+	}
+	body := struct {
+		Items []itemRef `json:"items"`
+	}{}
+	for _, id := range ids {
+		body.Items = append(body.Items, itemRef{ID: id})
+	}
+
+	var op CFListOperation
+	if _, err := cfCall(ctx, "DELETE", p.itemsPath(), body, &op); err != nil {
+		return fmt.Errorf("failed to delete list items: %w", err)
+	}
+	return p.waitForOperation(ctx, op.OperationID)
+}
+
+func (p *listsProvider) Remove(ctx context.Context, ip, itemID string) error {
+	if !providerConfigured(p) {
+		log.Println("Skipping Cloudflare removal: API credentials not configured")
+		return nil
+	}
+
+	// Fast path: delete the item we created directly
+	if itemID != "" {
+		err := p.deleteItems(ctx, []string{itemID})
+		if err == nil {
+			log.Printf("[Cloudflare] Removed list item %s for IP %s", itemID, ip)
+			return nil
+		}
+		log.Printf("[Cloudflare] Deleting list item %s failed (%v), looking up items for IP %s", itemID, err, ip)
+	}
+
+	// Only items carrying our comment: one added by hand is not ours to
+	// delete
+	matches, err := p.find(ctx, ip)
+	if err != nil {
+		return fmt.Errorf("failed to look up list items: %w", err)
+	}
+	var ids []string
+	for _, item := range matches {
+		if _, _, ok := parseRuleComment(item.Comment); ok {
+			ids = append(ids, item.ID)
+		}
+	}
+	if len(ids) == 0 {
+		log.Printf("[Cloudflare] No item of this service for IP %s in list (%d others), nothing to remove", ip, len(matches))
+		return nil
+	}
+	if err := p.deleteItems(ctx, ids); err != nil {
+		return err
+	}
+
+	log.Printf("[Cloudflare] Removed IP %s from list", ip)
+	return nil
+}
+
+func (p *listsProvider) Contains(ctx context.Context, ip string) (bool, error) {
+	if !providerConfigured(p) {
+		return false, fmt.Errorf("cloudflare credentials not configured")
+	}
+
+	matches, err := p.find(ctx, ip)
+	if err != nil {
+		return false, err
+	}
+	return len(matches) > 0, nil
+}
+
+func (p *listsProvider) FindRule(ctx context.Context, ip string) (string, bool, error) {
+	if !providerConfigured(p) {
+		return "", false, fmt.Errorf("cloudflare credentials not configured")
+	}
+
+	matches, err := p.find(ctx, ip)
+	if err != nil || len(matches) == 0 {
+		return "", false, err
+	}
+	return matches[0].ID, true, nil
+}
+
+func (p *listsProvider) List(ctx context.Context) ([]string, error) {
+	items, err := p.listItems(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]string, 0, len(items))
+	for _, item := range items {
+		ips = append(ips, item.IP)
+	}
+	return ips, nil
+}
+
+// ListManaged returns the items whose comment was written by this service.
+func (p *listsProvider) ListManaged(ctx context.Context) ([]ManagedRule, error) {
+	items, err := p.listItems(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var managed []ManagedRule
+	for _, item := range items {
+		if expiresAt, by, ok := parseRuleComment(item.Comment); ok {
+			managed = append(managed, ManagedRule{IP: item.IP, RuleID: item.ID, ExpiresAt: expiresAt, By: by})
+		}
+	}
+	return managed, nil
+}
+
+// listItems returns every item of the list, following the cursors.
+func (p *listsProvider) listItems(ctx context.Context) ([]CFListItem, error) {
+	if !providerConfigured(p) {
+		return nil, fmt.Errorf("cloudflare credentials not configured")
+	}
+
+	var all []CFListItem
+	cursor := ""
+	for {
+		path := p.itemsPath()
+		if cursor != "" {
+			path += "?cursor=" + url.QueryEscape(cursor)
+		}
+
+		var items []CFListItem
+		env, err := cfCall(ctx, "GET", path, nil, &items)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, items...)
+		if env.ResultInfo == nil || env.ResultInfo.Cursors.After == "" {
+			break
+		}
+		cursor = env.ResultInfo.Cursors.After
+	}
+	return all, nil
+}
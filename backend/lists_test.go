@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeList is an in-memory stand-in for the lists items and bulk operations
+// API. Operations report "running" once before completing, or forever if
+// stuck is set. With pageSize set, item reads are paginated.
+type fakeList struct {
+	mu       sync.Mutex
+	items    map[string]CFListItem
+	polls    map[string]int
+	nextID   int
+	stuck    bool
+	pageSize int
+}
+
+func (f *fakeList) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	const items = "/accounts/account/rules/lists/list/items"
+	const ops = "/accounts/account/rules/lists/bulk_operations/"
+	switch {
+	case r.Method == "GET" && r.URL.Path == items:
+		search := r.URL.Query().Get("search")
+		result := []CFListItem{}
+		for _, item := range f.items {
+			if strings.Contains(item.IP, search) {
+				result = append(result, item)
+			}
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+		if f.pageSize == 0 {
+			writeCFResult(w, result)
+			return
+		}
+		start, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+		end := min(start+f.pageSize, len(result))
+		var info cfResultInfo
+		if end < len(result) {
+			info.Cursors.After = strconv.Itoa(end)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "result": result[start:end], "result_info": info})
+	case r.Method == "POST" && r.URL.Path == items:
+		var added []CFListItem
+		json.NewDecoder(r.Body).Decode(&added)
+		for _, item := range added {
+			f.nextID++
+			item.ID = fmt.Sprintf("item%d", f.nextID)
+			f.items[item.ID] = item
+		}
+		writeCFResult(w, CFListOperation{OperationID: fmt.Sprintf("op%d", f.nextID)})
+	case r.Method == "DELETE" && r.URL.Path == items:
+		var body struct {
+			Items []struct {
+				ID string `json:"id"`
+			} `json:"items"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		for _, ref := range body.Items {
+			delete(f.items, ref.ID)
+		}
+		writeCFResult(w, CFListOperation{OperationID: "op-delete"})
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, ops):
+		id := strings.TrimPrefix(r.URL.Path, ops)
+		f.polls[id]++
+		status := "running"
+		if f.polls[id] > 1 && !f.stuck {
+			status = "completed"
+		}
+		writeCFResult(w, CFBulkOperation{ID: id, Status: status})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestListsProvider(t *testing.T) {
+	fake := &fakeList{items: map[string]CFListItem{}, polls: map[string]int{}}
+	withFakeCloudflare(t, fake)
+
+	origListID, origInterval := listID, listOperationPollInterval
+	listID, listOperationPollInterval = "list", time.Millisecond
+	defer func() { listID, listOperationPollInterval = origListID, origInterval }()
+
+	ctx := context.Background()
+	p := &listsProvider{}
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	itemID, err := p.Add(ctx, RuleRequest{IP: "1.2.3.4", ExpiresAt: expiry, By: "alice"})
+	if err != nil {
+		t.Fatalf("Add() error: %v", err)
+	}
+	item, ok := fake.items[itemID]
+	if !ok {
+		t.Fatalf("Add() returned %q, not a stored item ID", itemID)
+	}
+	if want := "whitelisted until 2030-01-02T03:04:05Z by alice"; item.Comment != want {
+		t.Errorf("comment = %q, want %q", item.Comment, want)
+	}
+	if fake.polls[fmt.Sprintf("op%d", fake.nextID)] < 2 {
+		t.Error("Add() did not wait for the bulk operation to complete")
+	}
+
+	// Substring search results must not count as a match
+	fake.items["other"] = CFListItem{ID: "other", IP: "11.2.3.45"}
+	found, err := p.Contains(ctx, "1.2.3.4")
+	if err != nil || !found {
+		t.Errorf("Contains(1.2.3.4) = %v, %v; want true, nil", found, err)
+	}
+	found, _ = p.Contains(ctx, "1.2.3.45")
+	if found {
+		t.Error("Contains(1.2.3.45) = true, want false")
+	}
+
+	if err := p.Remove(ctx, "1.2.3.4", itemID); err != nil {
+		t.Fatalf("Remove() error: %v", err)
+	}
+	if _, ok := fake.items[itemID]; ok {
+		t.Error("item still present after Remove")
+	}
+
+	ips, err := p.List(ctx)
+	if err != nil || len(ips) != 1 || ips[0] != "11.2.3.45" {
+		t.Errorf("List() = %v, %v; want [11.2.3.45]", ips, err)
+	}
+}
+
+func TestListsProviderLookups(t *testing.T) {
+	fake := &fakeList{items: map[string]CFListItem{
+		"a": {ID: "a", IP: "11.2.3.45"},
+		"b": {ID: "b", IP: "198.51.100.0/24", Comment: "office"},
+		"c": {ID: "c", IP: "2001:db8::1", Comment: RuleRequest{ExpiresAt: time.Now()}.Comment()},
+		"d": {ID: "d", IP: "1.2.3.4", Comment: RuleRequest{ExpiresAt: time.Now()}.Comment()},
+	}, polls: map[string]int{}, pageSize: 1}
+	withFakeCloudflare(t, fake)
+
+	origListID, origInterval, origTimeout := listID, listOperationPollInterval, listOperationTimeout
+	listID, listOperationPollInterval = "list", time.Millisecond
+	defer func() {
+		listID, listOperationPollInterval, listOperationTimeout = origListID, origInterval, origTimeout
+	}()
+	ctx := context.Background()
+	p := &listsProvider{}
+
+	// Matches are found on later pages and however the IP is written
+	for _, ip := range []string{"1.2.3.4", "2001:DB8:0::1", "::ffff:1.2.3.4"} {
+		if found, err := p.Contains(ctx, ip); !found || err != nil {
+			t.Errorf("Contains(%s) = %v, %v; want true", ip, found, err)
+		}
+	}
+
+	// Without an item ID only items with our comment are deleted
+	if err := p.Remove(ctx, "198.51.100.0/24", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.items["b"]; !ok {
+		t.Error("Remove fallback deleted an item added by hand")
+	}
+	if err := p.Remove(ctx, "2001:db8::1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.items["c"]; ok {
+		t.Error("Remove fallback kept our item")
+	}
+
+	// A bulk operation that never finishes is given up on
+	fake.stuck = true
+	listOperationTimeout = 20 * time.Millisecond
+	if _, err := p.Add(ctx, RuleRequest{IP: "5.6.7.8"}); err == nil || !strings.Contains(err.Error(), "bulk operation") {
+		t.Errorf("Add() with a stuck operation = %v", err)
+	}
+}
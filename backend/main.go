@@ -1,15 +1,17 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,6 +23,15 @@ import (
 
 type WhitelistRequest struct {
 	Duration string `json:"duration"`
+	// IP is an IP or CIDR range to whitelist instead of the client's own,
+	// for API keys with the whitelist:any scope
+	IP string `json:"ip,omitempty"`
+	// Reason and Ticket are recorded with the entry
+	Reason string `json:"reason,omitempty"`
+	Ticket string `json:"ticket,omitempty"`
+	// TOTPCode is a code from the user's authenticator, or a recovery
+	// code, when the TOTP policy asks for one (see totp.go)
+	TOTPCode string `json:"totpCode,omitempty"`
 }
 
 type WhitelistResponse struct {
@@ -33,6 +44,15 @@ type StatusResponse struct {
 	Whitelisted   bool   `json:"whitelisted"`
 	ExpiresAt     string `json:"expiresAt,omitempty"`
 	TimeRemaining string `json:"timeRemaining,omitempty"`
+	// CacheAgeSeconds is how old the Cloudflare data behind Whitelisted is
+	CacheAgeSeconds int `json:"cacheAgeSeconds"`
+	// Entry is the stored entry with its metadata, if there is one
+	Entry *Entry `json:"entry,omitempty"`
+	// User is who is signed in, when authentication is enabled
+	User *Identity `json:"user,omitempty"`
+	// TOTP is what POST /whitelist needs from the user: "code" for a
+	// TOTP code, "enroll" to enroll an authenticator first, or nothing
+	TOTP string `json:"totp,omitempty"`
 }
 
 var (
@@ -46,10 +66,112 @@ var (
 	// We'll implement updating an Access Policy (Account Level).
 	accountID = os.Getenv("CLOUDFLARE_ACCOUNT_ID")
 	policyID  = os.Getenv("CLOUDFLARE_POLICY_ID")
-
-	// Persistence
-	storeFile = getEnv("WHITELIST_STORE", "whitelist_store.json")
-	store     = &WhitelistStore{
+	groupID   = os.Getenv("CLOUDFLARE_GROUP_ID")
+
+	// IP list referenced by a WAF custom rule (lists provider)
+	listID = os.Getenv("CLOUDFLARE_LIST_ID")
+
+	// Changes to an Access policy or group arriving within this window are
+	// applied in a single update
+	writeCoalesceWindow = getEnvDuration("WRITE_COALESCE_WINDOW", 200*time.Millisecond)
+
+	// GET /status answers from a copy of the provider's rules refreshed this
+	// often (0 disables the cache)
+	policyCacheInterval = getEnvDuration("POLICY_CACHE_INTERVAL", 30*time.Second)
+
+	// How often the store is diffed against the provider (0 disables it)
+	reconcileInterval = getEnvDuration("RECONCILE_INTERVAL", 5*time.Minute)
+
+	// IP Access Rules can live on the zone (CLOUDFLARE_ZONE_ID) or the account
+	accessRuleScope = getEnv("CLOUDFLARE_ACCESS_RULE_SCOPE", "zone")
+
+	// Failed provider changes are retried with exponential backoff from
+	// OUTBOX_BASE_BACKOFF up to OUTBOX_MAX_BACKOFF, and dead-lettered after
+	// OUTBOX_MAX_ATTEMPTS attempts
+	outboxBaseBackoff = getEnvDuration("OUTBOX_BASE_BACKOFF", 30*time.Second)
+	outboxMaxBackoff  = getEnvDuration("OUTBOX_MAX_BACKOFF", time.Hour)
+	outboxMaxAttempts = getEnvInt("OUTBOX_MAX_ATTEMPTS", 10)
+
+	// The expiry daemon and the outbox apply at most DAEMON_WORKERS
+	// provider changes at once, each given up after DAEMON_OPERATION_TIMEOUT
+	daemonWorkers          = getEnvInt("DAEMON_WORKERS", 8)
+	daemonOperationTimeout = getEnvDuration("DAEMON_OPERATION_TIMEOUT", 2*time.Minute)
+
+	// Leader election between replicas: this replica's ID and how long a
+	// leader's lease outlives its last renewal
+	replicaID      = getEnv("REPLICA_ID", defaultReplicaID())
+	leaderLeaseTTL = getEnvDuration("LEADER_LEASE_TTL", 15*time.Second)
+
+	// Hash-chained audit log of every whitelist mutation (empty disables
+	// it), one per replica: "{replica}" in the path becomes REPLICA_ID.
+	// AUDIT_HMAC_KEY keys the chain, so it cannot be recomputed without it
+	auditLogPath = getEnv("AUDIT_LOG", "audit.log")
+	auditHMACKey = os.Getenv("AUDIT_HMAC_KEY")
+
+	// How long whitelist history is kept (0 keeps it forever)
+	historyRetention = getEnvDuration("HISTORY_RETENTION", 90*24*time.Hour)
+
+	// Proxies whose CF-Connecting-IP and X-Forwarded-For headers are
+	// believed, as IPs and CIDR ranges; "cloudflare" stands for
+	// Cloudflare's ranges. Parsed into trustedProxies at startup
+	trustedProxiesEnv = getEnv("TRUSTED_PROXIES", "cloudflare")
+	trustedProxies    []netip.Prefix
+
+	// Bearer token with the admin role (unset disables it)
+	adminToken = os.Getenv("ADMIN_TOKEN")
+
+	// Signed-in members of these IdP groups are operators or admins instead
+	// of users (see rbac.go)
+	rbacOperatorGroups = getEnvList("RBAC_OPERATOR_GROUPS")
+	rbacAdminGroups    = getEnvList("RBAC_ADMIN_GROUPS")
+
+	// Cloudflare Access application in front of the service. Set both to
+	// require a valid Cf-Access-Jwt-Assertion on the whitelisting endpoints
+	accessTeamDomain = os.Getenv("CF_ACCESS_TEAM_DOMAIN")
+	accessAUD        = os.Getenv("CF_ACCESS_AUD")
+	// Claim of the Access assertion with the user's IdP groups, which
+	// RBAC_OPERATOR_GROUPS and RBAC_ADMIN_GROUPS are matched against
+	accessGroupsClaim = getEnv("CF_ACCESS_GROUPS_CLAIM", "groups")
+
+	// OpenID Connect sign-in (OIDC_ISSUER unset disables it). Only users
+	// of OIDC_ALLOWED_DOMAINS and OIDC_ALLOWED_GROUPS (read from the
+	// OIDC_GROUPS_CLAIM claim) get in; empty lists allow everyone
+	oidcIssuer         = os.Getenv("OIDC_ISSUER")
+	oidcClientID       = os.Getenv("OIDC_CLIENT_ID")
+	oidcClientSecret   = os.Getenv("OIDC_CLIENT_SECRET")
+	oidcRedirectURL    = os.Getenv("OIDC_REDIRECT_URL")
+	oidcScopes         = strings.Fields(getEnv("OIDC_SCOPES", "openid email profile"))
+	oidcAllowedDomains = getEnvList("OIDC_ALLOWED_DOMAINS")
+	oidcGroupsClaim    = getEnv("OIDC_GROUPS_CLAIM", "groups")
+	oidcAllowedGroups  = getEnvList("OIDC_ALLOWED_GROUPS")
+
+	// Sign-in sessions last SESSION_TTL; their cookies are sealed with
+	// SESSION_SECRET, which replicas must share
+	sessionTTL    = getEnvDuration("SESSION_TTL", 8*time.Hour)
+	sessionSecret = os.Getenv("SESSION_SECRET")
+
+	// TOTP codes on POST /whitelist for signed-in users: "off", "enrolled"
+	// (users who enrolled an authenticator) or "required" (everyone).
+	// TOTP_TARGET_POLICIES overrides it per enforcement target as
+	// "target=policy" entries, the target being a provider name or
+	// "provider:id" (see totp.go). TOTP_ISSUER names the service in
+	// authenticator apps
+	totpPolicy         = getEnv("TOTP_POLICY", totpEnrolled)
+	totpTargetPolicies = getEnvList("TOTP_TARGET_POLICIES")
+	totpIssuer         = getEnv("TOTP_ISSUER", "Cloudflare IP Whitelist")
+
+	// Enforcement backend
+	providerName          = getEnv("WHITELIST_PROVIDER", "access_policy")
+	provider     Provider = newAccessPolicyProvider()
+
+	// Persistence. The JSON store keeps STORE_BACKUPS previous versions.
+	storeBackups       = getEnvInt("STORE_BACKUPS", 5)
+	storeBackend       = getEnv("STORE_BACKEND", "json")
+	storeFile          = getEnv("WHITELIST_STORE", "whitelist_store.json")
+	sqlitePath         = getEnv("SQLITE_PATH", "whitelist.db")
+	redisURL           = getEnv("REDIS_URL", "redis://localhost:6379/0")
+	redisPrefix        = getEnv("REDIS_PREFIX", "whitelist:")
+	store        Store = &WhitelistStore{
 		Entries: make(map[string]time.Time),
 	}
 )
@@ -61,85 +183,84 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-// WhitelistStore handles persistence
-type WhitelistStore struct {
-	sync.RWMutex
-	Entries map[string]time.Time `json:"entries"`
-}
-
-func (s *WhitelistStore) Load() error {
-	s.Lock()
-	defer s.Unlock()
-
-	f, err := os.Open(storeFile)
-	if os.IsNotExist(err) {
-		return nil
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
 	}
+	d, err := time.ParseDuration(value)
 	if err != nil {
-		return err
+		log.Printf("Invalid %s %q, using default %s", key, value, fallback)
+		return fallback
 	}
-	defer f.Close()
-
-	bytes, err := io.ReadAll(f)
-	if err != nil {
-		return err
-	}
-
-	return json.Unmarshal(bytes, &s.Entries)
+	return d
 }
 
-func (s *WhitelistStore) Save() error {
-	s.RLock()
-	defer s.RUnlock()
-
-	bytes, err := json.MarshalIndent(s.Entries, "", "  ")
+func getEnvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
 	if err != nil {
-		return err
+		log.Printf("Invalid %s %q, using default %d", key, value, fallback)
+		return fallback
 	}
-
-	return os.WriteFile(storeFile, bytes, 0644)
+	return n
 }
 
-func (s *WhitelistStore) Add(ip string, expiry time.Time) {
-	s.Lock()
-	s.Entries[ip] = expiry
-	s.Unlock()
-	s.Save()
-}
-
-func (s *WhitelistStore) Remove(ip string) {
-	s.Lock()
-	delete(s.Entries, ip)
-	s.Unlock()
-	s.Save()
+// getEnvList returns the comma-separated values of key, without blanks.
+func getEnvList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		os.Exit(runVerifyAudit(os.Args[2:]))
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
+	p, err := newProvider(providerName)
+	if err != nil {
+		log.Fatalf("Invalid WHITELIST_PROVIDER: %v", err)
+	}
+	provider = p
+	if policyCacheInterval > 0 {
+		provider = newCachedProvider(p, policyCacheInterval)
+	}
+
+	if trustedProxies, err = parseTrustedProxies(trustedProxiesEnv); err != nil {
+		log.Fatal(err)
+	}
+
 	// Log configuration status
 	log.Println("=== Cloudflare IP Whitelist Service ===")
 	log.Printf("Port: %s", port)
+	log.Printf("Provider: %s", provider.Name())
 	log.Printf("Cloudflare API Token: %s", maskString(apiToken))
 	log.Printf("Cloudflare Account ID: %s", maskString(accountID))
+	log.Printf("Cloudflare Zone ID: %s", maskString(zoneID))
+	log.Printf("Cloudflare List ID: %s", maskString(listID))
 	log.Printf("Cloudflare Policy ID: %s", maskString(policyID))
+	log.Printf("Cloudflare Group ID: %s", maskString(groupID))
 
-	// Require all Cloudflare credentials
-	if apiToken == "" || accountID == "" || policyID == "" {
+	// Require all credentials for the selected provider
+	if missing := provider.MissingConfig(); len(missing) > 0 {
 		log.Println("")
 		log.Println("ERROR: Missing required Cloudflare credentials!")
 		log.Println("The following environment variables must be set:")
-		if apiToken == "" {
-			log.Println("  - CLOUDFLARE_API_TOKEN")
-		}
-		if accountID == "" {
-			log.Println("  - CLOUDFLARE_ACCOUNT_ID")
-		}
-		if policyID == "" {
-			log.Println("  - CLOUDFLARE_POLICY_ID")
+		for _, name := range missing {
+			log.Printf("  - %s", name)
 		}
 		log.Println("")
 		log.Println("Please set these variables in your .env file and restart.")
@@ -147,8 +268,102 @@ func main() {
 	}
 
 	log.Println("Cloudflare integration: ENABLED")
+	if accessTeamDomain != "" || accessAUD != "" {
+		if accessTeamDomain == "" || accessAUD == "" {
+			log.Fatal("CF_ACCESS_TEAM_DOMAIN and CF_ACCESS_AUD must be set together")
+		}
+		cfAccess = newAccessVerifier(accessTeamDomain, accessAUD)
+		log.Printf("Cloudflare Access authentication: ENABLED (%s)", cfAccess.issuer)
+	}
+	if oidcIssuer != "" {
+		if oidcClientID == "" || oidcRedirectURL == "" {
+			log.Fatal("OIDC_ISSUER needs OIDC_CLIENT_ID and OIDC_REDIRECT_URL")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		oidc, err = newOIDCClient(ctx, oidcIssuer, oidcClientID, oidcClientSecret, oidcRedirectURL)
+		cancel()
+		if err != nil {
+			log.Fatalf("Error reading the OIDC provider's configuration: %v", err)
+		}
+		sessionKey = []byte(sessionSecret)
+		if sessionSecret == "" {
+			log.Println("WARNING: SESSION_SECRET is not set; sessions end when the service restarts and are not shared between replicas")
+			sessionKey = []byte(randomToken())
+		}
+		log.Printf("OIDC sign-in: ENABLED (%s)", oidcIssuer)
+	}
+	if !authRequired() {
+		log.Println("Authentication: DISABLED (anyone who can reach the service can whitelist their IP)")
+	}
+	if err := checkTOTPConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if policy := totpPolicyFor(enforcementTarget()); policy != totpOff {
+		log.Printf("TOTP: %s for %s", policy, enforcementTarget())
+		if !authRequired() {
+			log.Println("WARNING: TOTP only applies to signed-in users, and authentication is disabled")
+		}
+	}
 	log.Println("")
 
+	r := newRouter()
+
+	// Load state
+	s, err := openStore(storeBackend)
+	if err != nil {
+		log.Fatalf("Error opening %s store: %v", storeBackend, err)
+	}
+	store = s
+	if auditLogPath != "" {
+		if auditor, err = openAuditLog(replicaAuditLogPath()); err != nil {
+			log.Fatalf("Error opening audit log: %v", err)
+		}
+		if auditHMACKey == "" {
+			log.Printf("Audit: AUDIT_HMAC_KEY is not set; anyone who can write %s can rewrite it undetected", auditor.path)
+		}
+	}
+	expiries, err := store.Expiries()
+	if err != nil {
+		log.Fatalf("Error reading store: %v", err)
+	}
+	pending, _, err := store.QueuedOps()
+	if err != nil {
+		log.Fatalf("Error reading store: %v", err)
+	}
+	log.Printf("Loaded %d whitelisted IPs and %d queued operations from %s store", len(expiries), len(pending), storeBackend)
+
+	// Only the leader runs the expiry daemon and the reconciler
+	lock := newLeaderLock(store)
+	ctx, cancel := context.WithTimeout(context.Background(), leaderLeaseTTL)
+	campaign(ctx, lock)
+	cancel()
+	if !isLeader() {
+		log.Printf("Replica %s is a follower; expiry and reconciliation run on the leader", replicaID)
+	}
+	go startLeaderElection(lock)
+
+	if isLeader() {
+		reconcileStaleStore()
+	}
+
+	// Start Daemon
+	go startExpiryDaemon()
+	if c, ok := provider.(*cachedProvider); ok {
+		go c.startRefresher()
+	}
+	if reconcileInterval > 0 {
+		go startReconciler(reconcileInterval)
+	}
+
+	fmt.Printf("Starting server on port %s...\n", port)
+	if err := http.ListenAndServe(":"+port, r); err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+}
+
+// newRouter returns the service's routes. Everything but /healthz, the
+// sign-in endpoints and the web UI is authenticated and needs a permission.
+func newRouter() chi.Router {
 	r := chi.NewRouter()
 
 	// Middleware
@@ -168,25 +383,52 @@ func main() {
 	filesDir := http.Dir(fmt.Sprintf("%s/dist", workDir))
 	FileServer(r, "/", filesDir)
 
-	r.Get("/ip", handleGetIP)
-	r.Get("/status", handleStatus)
-	r.Post("/whitelist", handleWhitelist)
-	r.Delete("/whitelist", handleDeleteWhitelist)
-
-	// Load state
-	if err := store.Load(); err != nil {
-		log.Printf("Error loading store: %v", err)
-	} else {
-		log.Printf("Loaded %d whitelisted IPs from store", len(store.Entries))
-	}
-
-	// Start Daemon
-	go startExpiryDaemon()
-
-	fmt.Printf("Starting server on port %s...\n", port)
-	if err := http.ListenAndServe(":"+port, r); err != nil {
-		log.Fatalf("Error starting server: %v", err)
-	}
+	r.Get("/healthz", handleHealthz)
+	if oidc != nil {
+		r.Get("/auth/login", handleLogin)
+		r.Get("/auth/callback", handleCallback)
+		r.Get("/auth/logout", handleLogout)
+	}
+
+	r.Group(func(r chi.Router) {
+		r.Use(authenticate)
+
+		r.Group(func(r chi.Router) {
+			r.Use(requirePermission(permWhitelistSelf))
+			r.Get("/ip", handleGetIP)
+			r.Get("/status", handleStatus)
+			r.Post("/whitelist", handleWhitelist)
+			r.Delete("/whitelist", handleDeleteWhitelist)
+			r.Get("/operations/{id}", handleOperation)
+			r.Get("/totp", handleTOTPStatus)
+			r.Post("/totp/enroll", handleTOTPEnroll)
+			r.Post("/totp/confirm", handleTOTPConfirm)
+			r.Delete("/totp", handleTOTPDisable)
+		})
+
+		// Original path of /admin/history
+		r.With(requirePermission(permAdminRead)).Get("/history", handleHistory)
+
+		r.Route("/admin", func(r chi.Router) {
+			r.Group(func(r chi.Router) {
+				r.Use(requirePermission(permAdminRead))
+				r.Get("/entries", handleEntries)
+				r.Get("/drift", handleDrift)
+				r.Get("/history", handleHistory)
+				r.Get("/outbox", handleOutbox)
+				r.Get("/api-keys", handleAPIKeys)
+			})
+			r.Group(func(r chi.Router) {
+				r.Use(requirePermission(permAdminWrite))
+				r.Post("/adopt", handleAdopt)
+				r.Post("/outbox/{id}/retry", handleRetryDeadLetter)
+				r.Post("/api-keys", handleCreateAPIKey)
+				r.Delete("/api-keys/{id}", handleRevokeAPIKey)
+				r.Delete("/totp/{user}", handleResetTOTP)
+			})
+		})
+	})
+	return r
 }
 
 func handleGetIP(w http.ResponseWriter, r *http.Request) {
@@ -262,33 +504,53 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check local store
-	store.RLock()
-	expiry, existsInStore := store.Entries[ip]
-	store.RUnlock()
+	entry, existsInStore, err := store.Entry(ip)
+	if err != nil {
+		writeOpError(w, storeUnavailable(err))
+		return
+	}
 
-	// Also check Cloudflare policy if credentials are configured
+	// Also check the provider if credentials are configured.
+	// ?fresh=true bypasses the policy cache.
 	existsInCloudflare := false
-	if apiToken != "" && accountID != "" && policyID != "" {
-		if err := checkIPInCloudflarePolicy(r.Context(), ip); err == nil {
-			existsInCloudflare = true
+	var cacheAge time.Duration
+	configured := providerConfigured(provider)
+	if configured {
+		fresh := r.URL.Query().Get("fresh") == "true"
+		if found, age, err := providerContains(r.Context(), ip, fresh); err == nil {
+			existsInCloudflare = found
+			cacheAge = age
+		} else {
+			log.Printf("Error checking Cloudflare status for %s: %v", ip, err)
 		}
 	}
 
 	// IP is whitelisted if it exists in BOTH store AND Cloudflare (or if Cloudflare is not configured)
 	whitelisted := existsInStore
-	if apiToken != "" && accountID != "" && policyID != "" {
+	if configured {
 		whitelisted = existsInStore && existsInCloudflare
 	}
 
 	resp := StatusResponse{
-		IP:          ip,
-		Whitelisted: whitelisted,
+		IP:              ip,
+		Whitelisted:     whitelisted,
+		CacheAgeSeconds: int(cacheAge.Seconds()),
+	}
+	if id, ok := identityFrom(r.Context()); ok {
+		resp.User = &id
+	}
+	need, _, err := totpRequirement(r)
+	if err != nil {
+		writeOpError(w, err)
+		return
 	}
+	resp.TOTP = need
 
 	if existsInStore {
-		resp.ExpiresAt = expiry.Format(time.RFC3339)
-		timeRemaining := time.Until(expiry)
+		resp.ExpiresAt = entry.ExpiresAt.Format(time.RFC3339)
+		timeRemaining := time.Until(entry.ExpiresAt)
 		resp.TimeRemaining = formatTimeRemaining(timeRemaining)
+		resp.Entry = &entry
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -308,31 +570,89 @@ func handleDeleteWhitelist(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Removing IP from whitelist: %s", ip)
-
-	// Always attempt to remove from Cloudflare (even if not in local store)
-	// This ensures sync if local store and Cloudflare are out of sync
-	if err := removeFromCloudflareAccessPolicy(r.Context(), ip); err != nil {
-		log.Printf("Error removing from Cloudflare: %v", err)
-		if apiToken != "" {
-			http.Error(w, "Failed to remove from Cloudflare policy", http.StatusInternalServerError)
+	// ?ip= removes another IP or range, like WhitelistRequest.IP
+	target := ip
+	if v := r.URL.Query().Get("ip"); v != "" {
+		prefix, err := parseIPOrPrefix(v)
+		if err != nil {
+			http.Error(w, "Invalid IP address or prefix", http.StatusBadRequest)
 			return
 		}
+		target = prefixString(prefix)
+	}
+	if err := authorizeTarget(r, ip, target, 0); err != nil {
+		writeOpError(w, err)
+		return
 	}
 
-	// Remove from store (if exists)
-	store.Remove(ip)
-	log.Printf("IP %s removed from whitelist and Cloudflare policy", ip)
+	// Never touch rules this service did not create, e.g. a hand-curated
+	// office IP that the caller happens to be behind
+	owned, err := store.Owns(target)
+	if err != nil {
+		writeOpError(w, storeUnavailable(err))
+		return
+	}
+	if !owned {
+		log.Printf("Refusing to remove IP %s: not managed by this service", target)
+		http.Error(w, "IP is not whitelisted by this service", http.StatusNotFound)
+		return
+	}
+
+	apply := audited(newAuditSource(r, requestOwner(r, ip)), "remove", target, func(ctx context.Context) error {
+		return unwhitelistIP(ctx, target)
+	})
+	if wantsAsync(r) {
+		writeAccepted(w, startOperation(OperationRemove, target, apply))
+		return
+	}
+	if err := apply(r.Context()); err != nil {
+		writeOpError(w, err)
+		return
+	}
 
 	resp := map[string]string{
 		"message": "IP removed from whitelist",
-		"ip":      ip,
+		"ip":      target,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
+// unwhitelistIP removes ip from the provider and the store.
+func unwhitelistIP(ctx context.Context, ip string) error {
+	log.Printf("Removing IP from whitelist: %s", ip)
+
+	mutationMu.RLock()
+	defer mutationMu.RUnlock()
+
+	owned, err := store.Owns(ip)
+	if err != nil {
+		return storeUnavailable(err)
+	}
+	if !owned {
+		return &opError{http.StatusNotFound, "IP is not whitelisted by this service"}
+	}
+	ruleID, err := store.RuleID(ip)
+	if err != nil {
+		return storeUnavailable(err)
+	}
+
+	if err := provider.Remove(ctx, ip, ruleID); err != nil {
+		log.Printf("Error removing from Cloudflare: %v", err)
+		if providerConfigured(provider) {
+			return &opError{http.StatusInternalServerError, "Failed to remove from Cloudflare policy"}
+		}
+	}
+
+	if err := store.Remove(ip); err != nil {
+		log.Printf("Error saving removal of IP %s: %v", ip, err)
+		return &opError{http.StatusInternalServerError, "Removed from Cloudflare but failed to save the store"}
+	}
+	log.Printf("IP %s removed from whitelist and Cloudflare policy", ip)
+	return nil
+}
+
 func handleWhitelist(w http.ResponseWriter, r *http.Request) {
 	// 1. Extract IP
 	ip := getClientIP(r)
@@ -347,77 +667,169 @@ func handleWhitelist(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 2. Parse Duration
+	// 2. Parse Duration and target
 	var req WhitelistRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	duration := 60 * time.Minute // default
-	// Support "0.5" for 30s, or explicit units if frontend sent them.
-	// We assume frontend sends string minutes usually.
-	if d, err := time.ParseDuration(req.Duration + "m"); err == nil {
-		duration = d
-	} else if d, err := time.ParseDuration(req.Duration); err == nil {
-		// Fallback for "30s" or "720h" etc
-		duration = d
+	duration := parseWhitelistDuration(req.Duration)
+	target := ip
+	if req.IP != "" {
+		prefix, err := parseIPOrPrefix(req.IP)
+		if err != nil {
+			http.Error(w, "Invalid IP address or prefix", http.StatusBadRequest)
+			return
+		}
+		target = prefixString(prefix)
+	}
+	if err := authorizeTarget(r, ip, target, duration); err != nil {
+		writeOpError(w, err)
+		return
+	}
+	if err := checkTOTP(r, req.TOTPCode); err != nil {
+		writeOpError(w, err)
+		return
+	}
+	owner := requestOwner(r, ip)
+	meta := newEntryMeta(r, owner, req.Reason, req.Ticket)
+
+	// 3. Apply it, in the background if the client asked for that
+	apply := audited(newAuditSource(r, owner), "whitelist", target, func(ctx context.Context) error {
+		return whitelistIP(ctx, target, duration, meta)
+	})
+	if wantsAsync(r) {
+		writeAccepted(w, startOperation(OperationWhitelist, target, apply))
+		return
+	}
+	if err := apply(r.Context()); err != nil {
+		writeOpError(w, err)
+		return
+	}
+
+	resp := WhitelistResponse{
+		Message: "Success",
+		IP:      target,
 	}
 
-	// 3. Check if IP already exists (extension case)
-	store.RLock()
-	existingExpiry, exists := store.Entries[ip]
-	store.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// whitelistIP whitelists ip for duration, or extends an existing entry.
+// meta describes a new entry; extensions keep the original metadata.
+func whitelistIP(ctx context.Context, ip string, duration time.Duration, meta EntryMeta) error {
+	mutationMu.RLock()
+	defer mutationMu.RUnlock()
+
+	// Check if IP already exists (extension case)
+	existingExpiry, exists, err := store.Expiry(ip)
+	if err != nil {
+		return storeUnavailable(err)
+	}
 
 	if exists {
 		log.Printf("Extending whitelist for IP: %s by %v (current expiry: %s)", ip, duration, existingExpiry)
 		// Extend from now, not from existing expiry
 		newExpiry := time.Now().Add(duration)
-		store.Add(ip, newExpiry)
+		if err := store.Add(ip, newExpiry, meta); err != nil {
+			log.Printf("Error saving IP %s: %v", ip, err)
+			return &opError{http.StatusInternalServerError, "Failed to save whitelist entry"}
+		}
 		log.Printf("IP %s expiry extended to %s", ip, newExpiry)
-	} else {
-		log.Printf("Whitelisting IP: %s for %v", ip, duration)
+		return nil
+	}
 
-		// 4. Update Cloudflare (only for new IPs)
-		if err := addToCloudflareAccessPolicy(r.Context(), ip); err != nil {
-			log.Printf("Error updating Cloudflare: %v", err)
-			http.Error(w, fmt.Sprintf("Failed to update Cloudflare policy: %v", err), http.StatusInternalServerError)
-			return
-		}
+	log.Printf("Whitelisting IP: %s for %v", ip, duration)
 
-		// Persist Expiry only after successful Cloudflare update
-		expiry := time.Now().Add(duration)
-		store.Add(ip, expiry)
-		log.Printf("IP %s added to store, expires at %s", ip, expiry)
+	// A rule we did not create would be removed when our entry expires.
+	// One still queued for removal is ours and simply kept.
+	owned, err := store.Owns(ip)
+	if err != nil {
+		return storeUnavailable(err)
+	}
+	if providerConfigured(provider) && !owned {
+		_, found, err := provider.FindRule(ctx, ip)
+		if err != nil {
+			log.Printf("Error looking up existing rule for %s: %v", ip, err)
+			return &opError{http.StatusInternalServerError, "Failed to look up Cloudflare rules"}
+		}
+		if found {
+			log.Printf("IP %s already has a rule not managed by this service", ip)
+			return &opError{http.StatusConflict, errForeignRule.Error()}
+		}
 	}
 
-	resp := WhitelistResponse{
-		Message: "Success",
-		IP:      ip,
+	// Update Cloudflare (only for new IPs)
+	expiry := time.Now().Add(duration)
+	ruleID, err := provider.Add(ctx, RuleRequest{IP: ip, ExpiresAt: expiry, By: meta.CreatedBy})
+	if errors.Is(err, errForeignRule) {
+		return &opError{http.StatusConflict, errForeignRule.Error()}
+	}
+	if err != nil {
+		log.Printf("Error updating Cloudflare: %v", err)
+		return &opError{http.StatusInternalServerError, fmt.Sprintf("Failed to update Cloudflare policy: %v", err)}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	// Persist Expiry only after successful Cloudflare update
+	if err := store.AddWithRule(ip, expiry, ruleID, meta); err != nil {
+		log.Printf("Error saving IP %s: %v", ip, err)
+		// Do not leave a rule behind that the store does not know about
+		if err := provider.Remove(ctx, ip, ruleID); err != nil {
+			log.Printf("Error rolling back Cloudflare rule for %s, it is now unmanaged: %v", ip, err)
+		}
+		store.Remove(ip)
+		return &opError{http.StatusInternalServerError, "Failed to save whitelist entry"}
+	}
+	log.Printf("IP %s added to store, expires at %s", ip, expiry)
+	return nil
 }
 
-func getClientIP(r *http.Request) string {
-	// Priority 1: CF-Connecting-IP (Cloudflare)
-	if ip := r.Header.Get("CF-Connecting-IP"); ip != "" {
-		return ip
+// parseWhitelistDuration parses a requested duration with parseDuration.
+// Anything it does not understand means the default of 60 minutes.
+func parseWhitelistDuration(s string) time.Duration {
+	if d, err := parseDuration(s); err == nil {
+		return d
 	}
+	return 60 * time.Minute
+}
 
-	// Priority 2: X-Forwarded-For
-	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
-		parts := strings.Split(ip, ",")
-		return strings.TrimSpace(parts[0])
+// parseDuration parses minutes as a number (the frontend sends e.g.
+// "1440"), or a Go duration such as "30s" or "720h".
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := time.ParseDuration(s + "m"); err == nil {
+		return d, nil
 	}
+	return time.ParseDuration(s)
+}
 
-	// Priority 3: RemoteAddr
+// getClientIP returns the client's IP in canonical form. CF-Connecting-IP
+// and X-Forwarded-For are only believed when the connection comes from a
+// trusted proxy (TRUSTED_PROXIES): anyone else could send them and pass
+// for any IP.
+func getClientIP(r *http.Request) string {
 	ip, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		ip = r.RemoteAddr
 	}
 
+	if isTrustedProxy(ip) {
+		// Priority 1: CF-Connecting-IP (Cloudflare)
+		if h := r.Header.Get("CF-Connecting-IP"); h != "" {
+			return canonicalIP(h)
+		}
+
+		// Priority 2: X-Forwarded-For, the last entry not added by a
+		// trusted proxy
+		if h := r.Header.Get("X-Forwarded-For"); h != "" {
+			return forwardedClientIP(h)
+		}
+	}
+
+	// Priority 3: RemoteAddr
+	ip = canonicalIP(ip)
+
 	// If the IP is private (Localhost or Docker Network), fallback to fetching public IP
 	// This ensures local testing works by whitelisting the actual Public IP.
 	if isPrivateIP(ip) {
@@ -431,6 +843,80 @@ func getClientIP(r *http.Request) string {
 	return ip
 }
 
+// canonicalIP returns ip the way netip formats it (IPv4-mapped addresses
+// unmapped), or ip unchanged if it is not an IP address, to be rejected
+// by the caller.
+func canonicalIP(ip string) string {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return ip
+	}
+	return addr.Unmap().WithZone("").String()
+}
+
+// parseTrustedProxies parses TRUSTED_PROXIES: IPs and CIDR ranges, and
+// "cloudflare" for Cloudflare's published ranges.
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if strings.EqualFold(entry, "cloudflare") {
+			for _, r := range cloudflareIPRanges {
+				prefixes = append(prefixes, netip.MustParsePrefix(r))
+			}
+			continue
+		}
+		prefix, err := parseIPOrPrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q", entry)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// isTrustedProxy reports whether ip is in TRUSTED_PROXIES.
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClientIP returns the client in an X-Forwarded-For header: the
+// rightmost address that is not a trusted proxy. Entries left of it were
+// sent by the client and prove nothing.
+func forwardedClientIP(header string) string {
+	parts := strings.Split(header, ",")
+	for i := len(parts) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(parts[i])
+		if i == 0 || !isTrustedProxy(ip) {
+			return canonicalIP(ip)
+		}
+	}
+	return ""
+}
+
+// cloudflareIPRanges are the ranges Cloudflare proxies requests from
+// (https://www.cloudflare.com/ips/).
+var cloudflareIPRanges = []string{
+	"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22", "103.31.4.0/22",
+	"141.101.64.0/18", "108.162.192.0/18", "190.93.240.0/20", "188.114.96.0/20",
+	"197.234.240.0/22", "198.41.128.0/17", "162.158.0.0/15", "104.16.0.0/13",
+	"104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+	"2400:cb00::/32", "2606:4700::/32", "2803:f800::/32", "2405:b500::/32",
+	"2405:8100::/32", "2a06:98c0::/29", "2c0f:f248::/32",
+}
+
 func isPrivateIP(ipStr string) bool {
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
@@ -476,27 +962,6 @@ func getPublicIP() (string, error) {
 	return string(ip), nil
 }
 
-// Structs for Cloudflare API
-type CFAccessPolicyResponse struct {
-	Success bool          `json:"success"`
-	Errors  []interface{} `json:"errors"`
-	Result  struct {
-		Name     string        `json:"name"`
-		Decision string        `json:"decision"`
-		Include  []interface{} `json:"include"`
-		Exclude  []interface{} `json:"exclude"`
-		Require  []interface{} `json:"require"`
-	} `json:"result"`
-}
-
-type CFAccessPolicyUpdate struct {
-	Name     string        `json:"name"`
-	Decision string        `json:"decision"`
-	Include  []interface{} `json:"include"`
-	Exclude  []interface{} `json:"exclude"`
-	Require  []interface{} `json:"require"`
-}
-
 // maskString masks sensitive strings for logging
 func maskString(s string) string {
 	if s == "" {
@@ -508,232 +973,85 @@ func maskString(s string) string {
 	return s[:4] + "****" + s[len(s)-4:]
 }
 
-// checkIPInCloudflarePolicy checks if an IP exists in the Cloudflare policy
-func checkIPInCloudflarePolicy(ctx context.Context, ip string) error {
-	if apiToken == "" || accountID == "" || policyID == "" {
-		return fmt.Errorf("cloudflare credentials not configured")
-	}
-
-	res, err := cfRequest(ctx, "GET", fmt.Sprintf("access/policies/%s", policyID), nil)
-	if err != nil {
-		return err
-	}
-
-	for _, rule := range res.Result.Include {
-		b, _ := json.Marshal(rule)
-		if strings.Contains(string(b), fmt.Sprintf(`"ip":"%s"`, ip)) {
-			return nil // Found
+func startExpiryDaemon() {
+	ticker := time.NewTicker(10 * time.Second)
+	log.Println("Expiry daemon started")
+	for range ticker.C {
+		if !isLeader() {
+			continue
 		}
+		now := time.Now()
+		removeExpired(now)
+		processOutbox(context.Background(), now)
 	}
-
-	return fmt.Errorf("IP not found in policy")
 }
 
-func cfRequest(ctx context.Context, method, path string, body interface{}) (*CFAccessPolicyResponse, error) {
-	url := fmt.Sprintf("https://api.cloudflare.com/client/v4/accounts/%s/%s", accountID, path)
-
-	var bodyReader io.Reader
-	if body != nil {
-		b, _ := json.Marshal(body)
-		bodyReader = bytes.NewReader(b)
-	}
-
-	req, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Authorization", "Bearer "+apiToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	var res CFAccessPolicyResponse
-	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
-		return nil, err
+// runWorkers calls fn(ctx, i) for every i below n on at most daemonWorkers
+// goroutines. Each call gets its own daemonOperationTimeout, so a hung
+// provider call only holds up its worker until then.
+func runWorkers(ctx context.Context, n int, fn func(ctx context.Context, i int)) {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(max(daemonWorkers, 1), n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				opCtx, cancel := context.WithTimeout(ctx, daemonOperationTimeout)
+				fn(opCtx, i)
+				cancel()
+			}
+		}()
 	}
-
-	if !res.Success {
-		return nil, fmt.Errorf("CF API Error: %v", res.Errors)
+	for i := 0; i < n; i++ {
+		jobs <- i
 	}
-	return &res, nil
+	close(jobs)
+	wg.Wait()
 }
 
-// addToCloudflareAccessPolicy adds the IP to a reusable Access Policy.
-func addToCloudflareAccessPolicy(ctx context.Context, ip string) error {
-	if apiToken == "" || accountID == "" || policyID == "" {
-		log.Println("Skipping Cloudflare update: API credentials not configured")
-		return nil
-	}
-
-	log.Printf("[Cloudflare] Attempting to add IP %s to policy %s", ip, policyID)
-
-	// 1. Get Policy
-	res, err := cfRequest(ctx, "GET", fmt.Sprintf("access/policies/%s", policyID), nil)
+// removeExpired removes every entry that expired before now. Removals are
+// submitted concurrently, up to daemonWorkers at a time, so providers that
+// coalesce writes can apply a sweep in few updates.
+func removeExpired(now time.Time) {
+	expiries, err := store.Expiries()
 	if err != nil {
-		return fmt.Errorf("failed to get policy: %w", err)
-	}
-	policy := res.Result
-
-	// 2. Check if exists
-	exists := false
-	for _, rule := range policy.Include {
-		b, _ := json.Marshal(rule)
-		if strings.Contains(string(b), fmt.Sprintf(`"ip":"%s"`, ip)) {
-			exists = true
-			break
-		}
-	}
-	if exists {
-		log.Printf("[Cloudflare] IP %s already exists in policy, skipping add", ip)
-		return nil
-	}
-
-	// 3. Add IP
-	newRule := map[string]interface{}{
-		"ip": map[string]string{"ip": ip},
-	}
-	policy.Include = append(policy.Include, newRule)
-
-	// 4. Update
-	updatePayload := CFAccessPolicyUpdate{
-		Name:     policy.Name,
-		Decision: policy.Decision,
-		Include:  policy.Include,
-		Exclude:  policy.Exclude,
-		Require:  policy.Require,
-	}
-
-	log.Printf("[Cloudflare] Sending PUT request to update policy")
-	_, err = cfRequest(ctx, "PUT", fmt.Sprintf("access/policies/%s", policyID), updatePayload)
-	if err != nil {
-		return fmt.Errorf("failed to update policy: %w", err)
-	}
-
-	// 5. Verify the IP was added
-	log.Printf("[Cloudflare] Verifying IP %s was added to policy", ip)
-	verifyRes, err := cfRequest(ctx, "GET", fmt.Sprintf("access/policies/%s", policyID), nil)
-	if err != nil {
-		return fmt.Errorf("failed to verify policy update: %w", err)
-	}
-
-	verified := false
-	for _, rule := range verifyRes.Result.Include {
-		b, _ := json.Marshal(rule)
-		if strings.Contains(string(b), fmt.Sprintf(`"ip":"%s"`, ip)) {
-			verified = true
-			break
-		}
-	}
-
-	if !verified {
-		return fmt.Errorf("verification failed: IP %s not found in policy after update", ip)
-	}
-
-	log.Printf("[Cloudflare] Successfully added and verified IP %s in policy", ip)
-	return nil
-}
-
-func removeFromCloudflareAccessPolicy(ctx context.Context, ip string) error {
-	if apiToken == "" || accountID == "" || policyID == "" {
-		log.Println("Skipping Cloudflare removal: API credentials not configured")
-		return nil
+		log.Printf("Daemon: Error reading the store: %v", err)
+		return
 	}
-
-	log.Printf("[Cloudflare] Attempting to remove IP %s from policy %s", ip, policyID)
-
-	// 1. Get Policy
-	res, err := cfRequest(ctx, "GET", fmt.Sprintf("access/policies/%s", policyID), nil)
-	if err != nil {
-		return fmt.Errorf("failed to get policy: %w", err)
-	}
-	policy := res.Result
-
-	// 2. Filter IP
-	newIncludes := []interface{}{}
-	removed := false
-	for _, rule := range policy.Include {
-		b, _ := json.Marshal(rule)
-		s := string(b)
-		// Check for ip or ip/32
-		if strings.Contains(s, fmt.Sprintf(`"ip":"%s"`, ip)) || strings.Contains(s, fmt.Sprintf(`"ip":"%s/32"`, ip)) {
-			removed = true
-			log.Printf("[Cloudflare] Found IP %s in policy, removing", ip)
-			continue
+	toRemove := []string{}
+	for ip, expiry := range expiries {
+		if now.After(expiry) {
+			toRemove = append(toRemove, ip)
 		}
-		newIncludes = append(newIncludes, rule)
 	}
 
-	if !removed {
-		log.Printf("[Cloudflare] IP %s not found in policy, nothing to remove", ip)
-		return nil
-	}
-
-	// 3. Update
-	updatePayload := CFAccessPolicyUpdate{
-		Name:     policy.Name,
-		Decision: policy.Decision,
-		Include:  newIncludes,
-		Exclude:  policy.Exclude,
-		Require:  policy.Require,
-	}
-
-	log.Printf("[Cloudflare] Sending PUT request to remove IP from policy")
-	_, err = cfRequest(ctx, "PUT", fmt.Sprintf("access/policies/%s", policyID), updatePayload)
-	if err != nil {
-		return fmt.Errorf("failed to update policy: %w", err)
-	}
-
-	// 4. Verify the IP was removed
-	log.Printf("[Cloudflare] Verifying IP %s was removed from policy", ip)
-	verifyRes, err := cfRequest(ctx, "GET", fmt.Sprintf("access/policies/%s", policyID), nil)
-	if err != nil {
-		return fmt.Errorf("failed to verify policy update: %w", err)
-	}
+	runWorkers(context.Background(), len(toRemove), func(ctx context.Context, i int) {
+		ip := toRemove[i]
+		mutationMu.RLock()
+		defer mutationMu.RUnlock()
 
-	for _, rule := range verifyRes.Result.Include {
-		b, _ := json.Marshal(rule)
-		s := string(b)
-		if strings.Contains(s, fmt.Sprintf(`"ip":"%s"`, ip)) || strings.Contains(s, fmt.Sprintf(`"ip":"%s/32"`, ip)) {
-			return fmt.Errorf("verification failed: IP %s still found in policy after removal", ip)
+		ruleID, err := store.RuleID(ip)
+		if err != nil {
+			log.Printf("Daemon: Error reading the store for IP %s: %v", ip, err)
+			return
 		}
-	}
-
-	log.Printf("[Cloudflare] Successfully removed and verified IP %s from policy", ip)
-	return nil
-}
-
-func startExpiryDaemon() {
-	ticker := time.NewTicker(10 * time.Second)
-	log.Println("Expiry daemon started")
-	for range ticker.C {
-		now := time.Now()
-
-		// Snapshot entries to avoid long lock
-		store.RLock()
-		toRemove := []string{}
-		for ip, expiry := range store.Entries {
-			if now.After(expiry) {
-				toRemove = append(toRemove, ip)
+		log.Printf("Daemon: Removing expired IP %s", ip)
+		ctx, trace := withCFTrace(ctx)
+		err = provider.Remove(ctx, ip, ruleID)
+		recordAudit(auditSource{Actor: "expiry-daemon"}, "expire", ip, trace, err)
+		if err != nil {
+			// Queue it so the removal is retried, even across restarts
+			log.Printf("Daemon: Error removing IP %s: %v", ip, err)
+			if err := store.EnqueueRemoval(ip, err); err != nil {
+				log.Printf("Daemon: Error queueing removal of IP %s: %v", ip, err)
 			}
+			return
 		}
-		store.RUnlock()
-
-		for _, ip := range toRemove {
-			log.Printf("Daemon: Removing expired IP %s", ip)
-			if err := removeFromCloudflareAccessPolicy(context.Background(), ip); err != nil {
-				log.Printf("Daemon: Error removing IP %s: %v", ip, err)
-			} else {
-				// Only remove from store if successfully removed from Cloudflare (or if error is not temporary?)
-				// For this MVP, we remove from store to avoid loop.
-			}
-			store.Remove(ip)
+		if err := store.Expire(ip); err != nil {
+			log.Printf("Daemon: Error saving removal of IP %s: %v", ip, err)
 		}
-	}
+	})
 }
 
 // FileServer conveniently sets up a http.FileServer handler to serve
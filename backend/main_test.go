@@ -2,13 +2,28 @@ package main
 
 import (
 	"net/http/httptest"
+	"net/netip"
 	"os"
 	"strings"
 	"testing"
 	"time"
 )
 
+// TestMain trusts 192.0.2.1, the peer of every httptest request, as the
+// proxy that sets CF-Connecting-IP.
+func TestMain(m *testing.M) {
+	trustedProxies = []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")}
+	os.Exit(m.Run())
+}
+
 func TestGetClientIP(t *testing.T) {
+	orig := trustedProxies
+	defer func() { trustedProxies = orig }()
+	var err error
+	if trustedProxies, err = parseTrustedProxies("cloudflare, 10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+
 	tests := []struct {
 		name     string
 		headers  map[string]string
@@ -21,18 +36,48 @@ func TestGetClientIP(t *testing.T) {
 			addr:     "10.0.0.1:1234",
 			expected: "1.2.3.4",
 		},
+		{
+			name:     "CF-Connecting-IP from Cloudflare over IPv6",
+			headers:  map[string]string{"CF-Connecting-IP": "2001:DB8::0:1"},
+			addr:     "[2606:4700::1]:443",
+			expected: "2001:db8::1",
+		},
 		{
 			name:     "X-Forwarded-For",
 			headers:  map[string]string{"X-Forwarded-For": "5.6.7.8, 1.2.3.4"},
 			addr:     "10.0.0.1:1234",
+			expected: "1.2.3.4",
+		},
+		{
+			name:     "X-Forwarded-For through several proxies",
+			headers:  map[string]string{"X-Forwarded-For": "6.6.6.6, 5.6.7.8, 10.0.0.2"},
+			addr:     "10.0.0.1:1234",
 			expected: "5.6.7.8",
 		},
+		{
+			name:     "CF-Connecting-IP from an untrusted peer",
+			headers:  map[string]string{"CF-Connecting-IP": "1.2.3.4"},
+			addr:     "9.9.9.9:1234",
+			expected: "9.9.9.9",
+		},
+		{
+			name:     "X-Forwarded-For from an untrusted peer",
+			headers:  map[string]string{"X-Forwarded-For": "1.2.3.4"},
+			addr:     "9.9.9.9:1234",
+			expected: "9.9.9.9",
+		},
 		{
 			name:     "RemoteAddr",
 			headers:  map[string]string{},
 			addr:     "9.9.9.9:1234",
 			expected: "9.9.9.9",
 		},
+		{
+			name:     "IPv4-mapped RemoteAddr",
+			headers:  map[string]string{},
+			addr:     "[::ffff:9.9.9.9]:1234",
+			expected: "9.9.9.9",
+		},
 	}
 
 	for _, tt := range tests {
@@ -49,6 +94,10 @@ func TestGetClientIP(t *testing.T) {
 			}
 		})
 	}
+
+	if _, err := parseTrustedProxies("cloudflare, nonsense"); err == nil {
+		t.Error("parseTrustedProxies accepted an invalid entry")
+	}
 }
 
 func TestWhitelistStore(t *testing.T) {
@@ -66,9 +115,9 @@ func TestWhitelistStore(t *testing.T) {
 
 	// Test Add
 	expiry := time.Now().Add(1 * time.Hour)
-	store.Add("1.1.1.1", expiry)
+	store.Add("1.1.1.1", expiry, EntryMeta{})
 
-	if _, ok := store.Entries["1.1.1.1"]; !ok {
+	if _, ok, _ := store.Expiry("1.1.1.1"); !ok {
 		t.Error("Add failed: IP not found in memory")
 	}
 
@@ -87,7 +136,7 @@ func TestWhitelistStore(t *testing.T) {
 
 	// Test Remove
 	store.Remove("1.1.1.1")
-	if _, ok := store.Entries["1.1.1.1"]; ok {
+	if _, ok, _ := store.Expiry("1.1.1.1"); ok {
 		t.Error("Remove failed: IP still in memory")
 	}
 
@@ -101,6 +150,44 @@ func TestWhitelistStore(t *testing.T) {
 	}
 }
 
+func TestWhitelistStoreLegacyFormat(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "whitelist_store_legacy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	// Files written before rule IDs were tracked hold the bare entries map
+	tmpfile.WriteString(`{"1.1.1.1": "2030-01-01T00:00:00Z"}`)
+	tmpfile.Close()
+	storeFile = tmpfile.Name()
+
+	s := &WhitelistStore{Entries: make(map[string]time.Time)}
+	if err := s.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if _, ok := s.Entries["1.1.1.1"]; !ok {
+		t.Fatal("Load failed: legacy entry not found")
+	}
+
+	s.AddWithRule("2.2.2.2", time.Now().Add(time.Hour), "rule-1", EntryMeta{})
+	reloaded := &WhitelistStore{Entries: make(map[string]time.Time)}
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(reloaded.Entries) != 2 || ruleIDOf(t, reloaded, "2.2.2.2") != "rule-1" {
+		t.Errorf("reloaded store = %v / %v, want both entries and rule-1", reloaded.Entries, reloaded.RuleIDs)
+	}
+	// Legacy entries have no metadata until they are extended
+	if e, ok, _ := reloaded.Entry("1.1.1.1"); !ok || !e.CreatedAt.IsZero() {
+		t.Errorf("legacy entry = %+v, %v, want one without metadata", e, ok)
+	}
+	reloaded.Add("1.1.1.1", time.Now().Add(time.Hour), EntryMeta{})
+	if e, _, _ := reloaded.Entry("1.1.1.1"); e.Extensions != 1 {
+		t.Errorf("extended legacy entry = %+v, want 1 extension", e.EntryMeta)
+	}
+}
+
 func TestHandleWhitelistIPValidation(t *testing.T) {
 	// Save original env vars and restore after test
 	origToken := apiToken
@@ -127,28 +214,28 @@ func TestHandleWhitelistIPValidation(t *testing.T) {
 		{
 			name:           "Valid IPv4",
 			headers:        map[string]string{"CF-Connecting-IP": "8.8.8.8"},
-			remoteAddr:     "192.168.1.1:1234",
+			remoteAddr:     "192.0.2.1:1234",
 			expectedStatus: 200,
 			description:    "Should accept valid IPv4 address",
 		},
 		{
 			name:           "Valid IPv6",
 			headers:        map[string]string{"CF-Connecting-IP": "2001:4860:4860::8888"},
-			remoteAddr:     "192.168.1.1:1234",
+			remoteAddr:     "192.0.2.1:1234",
 			expectedStatus: 200,
 			description:    "Should accept valid IPv6 address",
 		},
 		{
 			name:           "Invalid IP - malformed",
 			headers:        map[string]string{"CF-Connecting-IP": "999.999.999.999"},
-			remoteAddr:     "192.168.1.1:1234",
+			remoteAddr:     "192.0.2.1:1234",
 			expectedStatus: 400,
 			description:    "Should reject malformed IP address",
 		},
 		{
 			name:           "Invalid IP - text",
 			headers:        map[string]string{"CF-Connecting-IP": "not-an-ip"},
-			remoteAddr:     "192.168.1.1:1234",
+			remoteAddr:     "192.0.2.1:1234",
 			expectedStatus: 400,
 			description:    "Should reject non-IP text",
 		},
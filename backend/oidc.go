@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// With OIDC_ISSUER set, users sign in at the identity provider with the
+// authorization-code flow and PKCE. /auth/login sends them there and
+// /auth/callback exchanges the code for an ID token. If the user's email
+// domain and groups are allowed, it sets a session cookie that
+// authenticate accepts. /auth/logout clears it.
+//
+// Sessions are stateless: the cookie holds the identity and its expiry,
+// sealed with an HMAC keyed with SESSION_SECRET. Replicas must share the
+// secret; without one, sessions end when the process restarts.
+
+const (
+	sessionCookie  = "wl_session"
+	oidcFlowCookie = "wl_oidc_flow"
+	// oidcFlowTTL is how long a user has to sign in at the provider
+	oidcFlowTTL     = 10 * time.Minute
+	oidcHTTPTimeout = 10 * time.Second
+)
+
+// errUserNotAllowed is returned for users who signed in at the provider
+// but whose email domain or groups are not allowed.
+var errUserNotAllowed = errors.New("user is not allowed to use this service")
+
+// oidcClient is this service as a client of the OpenID provider.
+type oidcClient struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+
+	// From the provider's discovery document
+	authURL       string
+	tokenURL      string
+	endSessionURL string // optional
+	keys          *jwks
+
+	http *http.Client
+}
+
+// oidc signs users in; nil when OIDC is not configured.
+var oidc *oidcClient
+
+// sessionKey seals session and sign-in cookies.
+var sessionKey []byte
+
+// newOIDCClient reads the discovery document of issuer.
+func newOIDCClient(ctx context.Context, issuer, clientID, clientSecret, redirectURL string) (*oidcClient, error) {
+	c := &oidcClient{
+		issuer:       issuer,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		http:         &http.Client{Timeout: oidcHTTPTimeout},
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery: %s", resp.Status)
+	}
+
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+		EndSessionEndpoint    string `json:"end_session_endpoint"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if doc.Issuer != issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, not %q", doc.Issuer, issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("discovery document lacks the authorization, token or JWKS endpoint")
+	}
+	c.authURL, c.tokenURL, c.endSessionURL = doc.AuthorizationEndpoint, doc.TokenEndpoint, doc.EndSessionEndpoint
+	c.keys = newJWKS(doc.JWKSURI)
+	return c, nil
+}
+
+// oidcFlow is what the callback needs to know about a sign-in it started.
+type oidcFlow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"` // PKCE code verifier
+	Return   string `json:"return"`   // local path to go back to
+	Expires  int64  `json:"exp"`
+}
+
+// session is the content of the session cookie.
+type session struct {
+	Email   string   `json:"email"`
+	Subject string   `json:"sub"`
+	Groups  []string `json:"groups,omitempty"`
+	Expires int64    `json:"exp"`
+}
+
+// handleLogin starts a sign-in, returning to ?return= afterwards.
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	flow := oidcFlow{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+		Return:   localPath(r.URL.Query().Get("return")),
+		Expires:  time.Now().Add(oidcFlowTTL).Unix(),
+	}
+	oidc.setCookie(w, oidcFlowCookie, sealCookie(oidcFlowCookie, flow), oidcFlowTTL)
+
+	challenge := sha256.Sum256([]byte(flow.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidc.clientID},
+		"redirect_uri":          {oidc.redirectURL},
+		"scope":                 {strings.Join(oidcScopes, " ")},
+		"state":                 {flow.State},
+		"nonce":                 {flow.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, withQuery(oidc.authURL, q), http.StatusFound)
+}
+
+// handleCallback finishes a sign-in: it checks the state, redeems the code
+// and sets the session cookie.
+func handleCallback(w http.ResponseWriter, r *http.Request) {
+	var flow oidcFlow
+	cookie, err := r.Cookie(oidcFlowCookie)
+	if err == nil {
+		err = openCookie(oidcFlowCookie, cookie.Value, &flow)
+	}
+	if err != nil || time.Now().Unix() > flow.Expires {
+		http.Error(w, "Sign-in expired or was not started here, please try again", http.StatusBadRequest)
+		return
+	}
+	// A flow is good for one attempt
+	oidc.setCookie(w, oidcFlowCookie, "", -1)
+
+	q := r.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(flow.State)) != 1 {
+		http.Error(w, "Sign-in state mismatch, please try again", http.StatusBadRequest)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		log.Printf("OIDC: sign-in failed at the provider: %s: %s", e, q.Get("error_description"))
+		http.Error(w, "Sign-in failed: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	id, err := oidc.exchange(r.Context(), q.Get("code"), flow)
+	if errors.Is(err, errUserNotAllowed) {
+		log.Printf("OIDC: refusing %s: %v", id.Email, err)
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("OIDC: sign-in failed: %v", err)
+		http.Error(w, "Sign-in failed", http.StatusBadGateway)
+		return
+	}
+
+	s := session{Email: id.Email, Subject: id.Subject, Groups: id.Groups, Expires: time.Now().Add(sessionTTL).Unix()}
+	oidc.setCookie(w, sessionCookie, sealCookie(sessionCookie, s), sessionTTL)
+	log.Printf("OIDC: %s signed in", id.Email)
+	http.Redirect(w, r, flow.Return, http.StatusFound)
+}
+
+// handleLogout clears the session and signs the user out at the provider
+// too, if it supports that.
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	oidc.setCookie(w, sessionCookie, "", -1)
+	target := "/"
+	if oidc.endSessionURL != "" {
+		home := "/"
+		if u, err := url.Parse(oidc.redirectURL); err == nil {
+			home = (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}).String()
+		}
+		target = withQuery(oidc.endSessionURL, url.Values{
+			"client_id":                {oidc.clientID},
+			"post_logout_redirect_uri": {home},
+		})
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// exchange redeems an authorization code and returns the identity in the
+// ID token, if the user is allowed in.
+func (c *oidcClient) exchange(ctx context.Context, code string, flow oidcFlow) (Identity, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.redirectURL},
+		"client_id":     {c.clientID},
+		"code_verifier": {flow.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if c.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(c.clientSecret))
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return Identity{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return Identity{}, fmt.Errorf("token endpoint: %s: %s", resp.Status, body)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return Identity{}, fmt.Errorf("token endpoint: %w", err)
+	}
+
+	claims, err := verifyJWT(ctx, tokens.IDToken, c.keys, c.issuer, c.clientID)
+	if err != nil {
+		return Identity{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(flow.Nonce)) != 1 {
+		return Identity{}, fmt.Errorf("%w: nonce mismatch", errInvalidToken)
+	}
+	id := Identity{Email: claims.Email, Subject: claims.Subject, Groups: claims.strings(oidcGroupsClaim), Method: "oidc"}
+	if claims.EmailVerified != nil && !*claims.EmailVerified {
+		return id, fmt.Errorf("%w: email not verified", errUserNotAllowed)
+	}
+	return id, oidcAllowed(id)
+}
+
+// oidcAllowed checks id against OIDC_ALLOWED_DOMAINS and
+// OIDC_ALLOWED_GROUPS; an empty list allows everyone.
+func oidcAllowed(id Identity) error {
+	if id.Email == "" {
+		return fmt.Errorf("%w: no email", errUserNotAllowed)
+	}
+	if len(oidcAllowedDomains) > 0 {
+		_, domain, _ := strings.Cut(strings.ToLower(id.Email), "@")
+		if !containsFold(oidcAllowedDomains, domain) {
+			return fmt.Errorf("%w: email domain %q", errUserNotAllowed, domain)
+		}
+	}
+	if len(oidcAllowedGroups) > 0 {
+		for _, g := range id.Groups {
+			if containsFold(oidcAllowedGroups, g) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: not in an allowed group", errUserNotAllowed)
+	}
+	return nil
+}
+
+// sessionIdentity returns the identity of a valid session cookie. The
+// allowed domains and groups are checked again, so tightening them takes
+// effect for existing sessions.
+func sessionIdentity(r *http.Request) (Identity, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return Identity{}, false
+	}
+	var s session
+	if err := openCookie(sessionCookie, cookie.Value, &s); err != nil || time.Now().Unix() >= s.Expires {
+		return Identity{}, false
+	}
+	id := Identity{Email: s.Email, Subject: s.Subject, Groups: s.Groups, Method: "oidc", Role: roleForGroups(s.Groups)}
+	return id, oidcAllowed(id) == nil
+}
+
+func (c *oidcClient) setCookie(w http.ResponseWriter, name, value string, maxAge time.Duration) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(c.redirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// sealCookie encodes v for the cookie called name, with an HMAC that
+// binds it to that name.
+func sealCookie(name string, v interface{}) string {
+	data, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + cookieMAC(name, payload)
+}
+
+// openCookie decodes a value sealed for the cookie called name into v.
+func openCookie(name, value string, v interface{}) error {
+	payload, mac, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(mac), []byte(cookieMAC(name, payload))) {
+		return errInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return errInvalidToken
+	}
+	return json.Unmarshal(data, v)
+}
+
+func cookieMAC(name, payload string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(name + "\x00" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// randomToken returns 256 random bits, URL-safe.
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// localPath returns p if it is a path on this site, "/" otherwise, so the
+// return target cannot send users elsewhere.
+func localPath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.HasPrefix(p, "/\\") {
+		return "/"
+	}
+	return p
+}
+
+// withQuery adds q to the query of endpoint.
+func withQuery(endpoint string, q url.Values) string {
+	if strings.Contains(endpoint, "?") {
+		return endpoint + "&" + q.Encode()
+	}
+	return endpoint + "?" + q.Encode()
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockOIDC is a local OpenID provider. Its authorization endpoint signs
+// in user right away; its token endpoint checks the client credentials
+// and the PKCE verifier before issuing an ID token.
+type mockOIDC struct {
+	*testIssuer
+
+	mu     sync.Mutex
+	user   map[string]interface{} // claims of the user signing in
+	grants map[string]url.Values  // authorization requests by code
+	nonce  string                 // overrides the nonce, if set
+}
+
+const (
+	testClientID    = "whitelist"
+	testRedirectURL = "http://whitelist.test/auth/callback"
+)
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	t.Helper()
+	m := &mockOIDC{testIssuer: newTestIssuer(t), grants: map[string]url.Values{}}
+	m.user = map[string]interface{}{"email": "alice@example.com", "email_verified": true, "groups": []string{"dev"}}
+
+	m.mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+			"end_session_endpoint":   m.URL + "/logout",
+		})
+	})
+	m.mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("response_type") != "code" || q.Get("client_id") != testClientID || q.Get("code_challenge_method") != "S256" {
+			http.Error(w, "bad authorization request", http.StatusBadRequest)
+			return
+		}
+		code := randomToken()
+		m.mu.Lock()
+		m.grants[code] = q
+		m.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	m.mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		m.mu.Lock()
+		grant, ok := m.grants[r.PostForm.Get("code")]
+		delete(m.grants, r.PostForm.Get("code"))
+		claims := map[string]interface{}{}
+		for k, v := range m.user {
+			claims[k] = v
+		}
+		nonce := m.nonce
+		m.mu.Unlock()
+
+		id, secret, _ := r.BasicAuth()
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		switch {
+		case id != testClientID || secret != "s3cret":
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		case !ok || r.PostForm.Get("redirect_uri") != grant.Get("redirect_uri"):
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		case base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.Get("code_challenge"):
+			http.Error(w, `{"error":"invalid_grant","error_description":"PKCE verification failed"}`, http.StatusBadRequest)
+			return
+		}
+		if nonce == "" {
+			nonce = grant.Get("nonce")
+		}
+		claims["iss"] = m.URL
+		claims["aud"] = testClientID
+		claims["sub"] = "user-1"
+		claims["nonce"] = nonce
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(claims), "token_type": "Bearer", "access_token": "opaque"})
+	})
+	return m
+}
+
+func (m *mockOIDC) setUser(change func(claims map[string]interface{})) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	change(m.user)
+}
+
+// withTestOIDC signs users in at m for the duration of the test.
+func withTestOIDC(t *testing.T, m *mockOIDC) {
+	t.Helper()
+	origOIDC, origKey, origDomains, origGroups := oidc, sessionKey, oidcAllowedDomains, oidcAllowedGroups
+	t.Cleanup(func() {
+		oidc, sessionKey, oidcAllowedDomains, oidcAllowedGroups = origOIDC, origKey, origDomains, origGroups
+	})
+	c, err := newOIDCClient(context.Background(), m.URL, testClientID, "s3cret", testRedirectURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oidc, sessionKey = c, []byte("session-secret")
+	oidcAllowedDomains, oidcAllowedGroups = nil, nil
+}
+
+var noRedirects = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+// startSignIn runs /auth/login and the provider's authorization endpoint,
+// returning the sign-in cookie and the callback query.
+func startSignIn(t *testing.T) (*http.Cookie, string) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	handleLogin(rr, httptest.NewRequest("GET", "/auth/login?return=/status", nil))
+	if rr.Code != http.StatusFound {
+		t.Fatalf("login status = %d", rr.Code)
+	}
+	resp, err := noRedirects.Get(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: status %d, location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	return rr.Result().Cookies()[0], callback.RawQuery
+}
+
+func callback(flow *http.Cookie, query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/auth/callback?"+query, nil)
+	if flow != nil {
+		req.AddCookie(flow)
+	}
+	rr := httptest.NewRecorder()
+	handleCallback(rr, req)
+	return rr
+}
+
+func sessionFrom(t *testing.T, rr *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == sessionCookie && c.MaxAge > 0 {
+			return c
+		}
+	}
+	t.Fatalf("no session cookie set (status %d: %s)", rr.Code, rr.Body)
+	return nil
+}
+
+func callWithSession(handler http.Handler, c *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/status", nil)
+	if c != nil {
+		req.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	m := newMockOIDC(t)
+	withTestOIDC(t, m)
+
+	if rr := callWithSession(whoAmI, nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("anonymous request: status = %d", rr.Code)
+	}
+
+	rr := callback(startSignIn(t))
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/status" {
+		t.Fatalf("callback: status %d, location %q: %s", rr.Code, rr.Header().Get("Location"), rr.Body)
+	}
+	session := sessionFrom(t, rr)
+	if !session.HttpOnly || session.SameSite != http.SameSiteLaxMode {
+		t.Errorf("session cookie = %+v", session)
+	}
+	if rr := callWithSession(whoAmI, session); rr.Code != http.StatusOK || rr.Body.String() != "alice@example.com" {
+		t.Fatalf("with session: status %d, identity %q", rr.Code, rr.Body)
+	}
+
+	// Logging out clears the session and ends it at the provider too
+	rr = httptest.NewRecorder()
+	handleLogout(rr, httptest.NewRequest("GET", "/auth/logout", nil))
+	if loc := rr.Header().Get("Location"); !strings.HasPrefix(loc, m.URL+"/logout?") || !strings.Contains(loc, url.QueryEscape("http://whitelist.test/")) {
+		t.Errorf("logout redirects to %q", loc)
+	}
+	if c := rr.Result().Cookies(); len(c) != 1 || c[0].Name != sessionCookie || c[0].MaxAge >= 0 {
+		t.Errorf("logout cookies = %+v", c)
+	}
+}
+
+func TestOIDCSignInRefused(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(m *mockOIDC)
+		run   func(t *testing.T) *httptest.ResponseRecorder
+		want  int
+	}{
+		{"domain not allowed", func(m *mockOIDC) {
+			oidcAllowedDomains = []string{"example.org"}
+		}, nil, http.StatusForbidden},
+		{"group not allowed", func(m *mockOIDC) {
+			oidcAllowedGroups = []string{"ops"}
+		}, nil, http.StatusForbidden},
+		{"email not verified", func(m *mockOIDC) {
+			m.setUser(func(c map[string]interface{}) { c["email_verified"] = false })
+		}, nil, http.StatusForbidden},
+		{"replayed ID token", func(m *mockOIDC) {
+			m.nonce = "from-another-sign-in"
+		}, nil, http.StatusBadGateway},
+		{"state mismatch", nil, func(t *testing.T) *httptest.ResponseRecorder {
+			flow, query := startSignIn(t)
+			q, _ := url.ParseQuery(query)
+			q.Set("state", "forged")
+			return callback(flow, q.Encode())
+		}, http.StatusBadRequest},
+		{"not started here", nil, func(t *testing.T) *httptest.ResponseRecorder {
+			_, query := startSignIn(t)
+			return callback(nil, query)
+		}, http.StatusBadRequest},
+		{"code of another sign-in", nil, func(t *testing.T) *httptest.ResponseRecorder {
+			// An injected code fails PKCE: it was requested with another verifier
+			flow, query := startSignIn(t)
+			_, injected := startSignIn(t)
+			q, _ := url.ParseQuery(query)
+			other, _ := url.ParseQuery(injected)
+			q.Set("code", other.Get("code"))
+			return callback(flow, q.Encode())
+		}, http.StatusBadGateway},
+		{"provider error", nil, func(t *testing.T) *httptest.ResponseRecorder {
+			flow, query := startSignIn(t)
+			q, _ := url.ParseQuery(query)
+			q.Del("code")
+			q.Set("error", "access_denied")
+			return callback(flow, q.Encode())
+		}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockOIDC(t)
+			withTestOIDC(t, m)
+			if tt.setup != nil {
+				tt.setup(m)
+			}
+			var rr *httptest.ResponseRecorder
+			if tt.run != nil {
+				rr = tt.run(t)
+			} else {
+				rr = callback(startSignIn(t))
+			}
+			if rr.Code != tt.want {
+				t.Fatalf("callback status = %d, want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+			for _, c := range rr.Result().Cookies() {
+				if c.Name == sessionCookie && c.MaxAge > 0 {
+					t.Error("session cookie set for a refused sign-in")
+				}
+			}
+		})
+	}
+}
+
+func TestOIDCSessionCookie(t *testing.T) {
+	withTestOIDC(t, newMockOIDC(t))
+	valid := session{Email: "alice@example.com", Subject: "user-1", Expires: time.Now().Add(time.Hour).Unix()}
+	cookie := func(name string, s session) *http.Cookie {
+		return &http.Cookie{Name: sessionCookie, Value: sealCookie(name, s)}
+	}
+
+	if rr := callWithSession(whoAmI, cookie(sessionCookie, valid)); rr.Code != http.StatusOK {
+		t.Fatalf("valid session: status = %d", rr.Code)
+	}
+
+	tampered := cookie(sessionCookie, valid)
+	payload, _ := json.Marshal(session{Email: "mallory@example.com", Expires: valid.Expires})
+	tampered.Value = base64.RawURLEncoding.EncodeToString(payload) + tampered.Value[strings.Index(tampered.Value, "."):]
+	expired := valid
+	expired.Expires = time.Now().Add(-time.Minute).Unix()
+
+	for name, c := range map[string]*http.Cookie{
+		"tampered":             tampered,
+		"expired":              cookie(sessionCookie, expired),
+		"sealed for another":   cookie(oidcFlowCookie, valid),
+		"other session secret": {Name: sessionCookie, Value: "e30." + strings.Repeat("A", 43)},
+	} {
+		if rr := callWithSession(whoAmI, c); rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s session: status = %d, want 401", name, rr.Code)
+		}
+	}
+
+	// Tightening the allowed domains ends existing sessions
+	oidcAllowedDomains = []string{"example.org"}
+	if rr := callWithSession(whoAmI, cookie(sessionCookie, valid)); rr.Code != http.StatusUnauthorized {
+		t.Errorf("session of a no longer allowed domain: status = %d", rr.Code)
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	for in, want := range map[string]string{
+		"/status":            "/status",
+		"":                   "/",
+		"https://evil.test/": "/",
+		"//evil.test/":       "/",
+		"/\\evil.test/":      "/",
+	} {
+		if got := localPath(in); got != want {
+			t.Errorf("localPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Clients that ask for it (?async=true or "Prefer: respond-async") get
+// 202 Accepted and an operation ID instead of waiting on Cloudflare. The
+// change is applied in the background; GET /operations/{id} reports how it
+// went, optionally long-polling with ?wait=.
+
+const (
+	OperationWhitelist = "whitelist"
+	OperationRemove    = "remove"
+
+	OperationPending = "pending"
+	OperationApplied = "applied"
+	OperationFailed  = "failed"
+)
+
+const (
+	// operationTimeout bounds how long a background operation may take.
+	operationTimeout = 5 * time.Minute
+	// operationRetention is how long finished operations can be queried.
+	operationRetention = time.Hour
+	// maxOperationWait caps the ?wait= of GET /operations/{id}.
+	maxOperationWait = 60 * time.Second
+)
+
+// Operation is a whitelist change running in the background.
+type Operation struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"` // OperationWhitelist or OperationRemove
+	IP        string    `json:"ip"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	done chan struct{} // closed once Status leaves pending
+}
+
+// opError is a failed change together with the HTTP status it maps to when
+// applied synchronously.
+type opError struct {
+	status int
+	msg    string
+}
+
+func (e *opError) Error() string { return e.msg }
+
+func writeOpError(w http.ResponseWriter, err error) {
+	var oe *opError
+	if errors.As(err, &oe) {
+		http.Error(w, oe.msg, oe.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+var (
+	operationsMu sync.Mutex
+	operations   = map[string]*Operation{}
+)
+
+// wantsAsync reports whether the client asked not to wait for Cloudflare.
+func wantsAsync(r *http.Request) bool {
+	if r.URL.Query().Get("async") == "true" {
+		return true
+	}
+	for _, pref := range strings.Split(r.Header.Get("Prefer"), ",") {
+		if strings.TrimSpace(pref) == "respond-async" {
+			return true
+		}
+	}
+	return false
+}
+
+// startOperation runs apply in the background and returns a snapshot of
+// the pending operation tracking it.
+func startOperation(kind, ip string, apply func(ctx context.Context) error) Operation {
+	now := time.Now()
+	op := &Operation{
+		ID:        newID(),
+		Kind:      kind,
+		IP:        ip,
+		Status:    OperationPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+		done:      make(chan struct{}),
+	}
+
+	operationsMu.Lock()
+	pruneOperationsLocked(now)
+	operations[op.ID] = op
+	snapshot := *op
+	operationsMu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+		defer cancel()
+		err := apply(ctx)
+
+		operationsMu.Lock()
+		op.Status = OperationApplied
+		if err != nil {
+			op.Status = OperationFailed
+			op.Error = err.Error()
+			log.Printf("Operation %s (%s of IP %s) failed: %v", op.ID, kind, ip, err)
+		}
+		op.UpdatedAt = time.Now()
+		close(op.done)
+		operationsMu.Unlock()
+	}()
+	return snapshot
+}
+
+// pruneOperationsLocked forgets operations that finished more than
+// operationRetention ago. operationsMu must be held.
+func pruneOperationsLocked(now time.Time) {
+	for id, op := range operations {
+		if op.Status != OperationPending && now.Sub(op.UpdatedAt) > operationRetention {
+			delete(operations, id)
+		}
+	}
+}
+
+func writeAccepted(w http.ResponseWriter, op Operation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/operations/"+op.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(op)
+}
+
+// handleOperation reports the status of an operation. With ?wait=<duration>
+// (at most maxOperationWait) it waits for a pending operation to finish.
+func handleOperation(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	operationsMu.Lock()
+	op, ok := operations[id]
+	operationsMu.Unlock()
+	if !ok {
+		http.Error(w, "Unknown operation", http.StatusNotFound)
+		return
+	}
+
+	if v := r.URL.Query().Get("wait"); v != "" {
+		wait, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "Invalid wait duration", http.StatusBadRequest)
+			return
+		}
+		if wait > maxOperationWait {
+			wait = maxOperationWait
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-op.done:
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+		timer.Stop()
+	}
+
+	operationsMu.Lock()
+	snapshot := *op
+	operationsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestAsyncWhitelist(t *testing.T) {
+	fake := newFakeProvider()
+	withTestStore(t, fake)
+
+	r := chi.NewRouter()
+	r.Post("/whitelist", handleWhitelist)
+	r.Delete("/whitelist", handleDeleteWhitelist)
+	r.Get("/operations/{id}", handleOperation)
+
+	do := func(method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("CF-Connecting-IP", "203.0.113.20")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	await := func(rr *httptest.ResponseRecorder) Operation {
+		t.Helper()
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("status = %d, want 202 (%s)", rr.Code, rr.Body.String())
+		}
+		var op Operation
+		if err := json.NewDecoder(rr.Body).Decode(&op); err != nil {
+			t.Fatal(err)
+		}
+		if op.Status != OperationPending || rr.Header().Get("Location") != "/operations/"+op.ID {
+			t.Fatalf("accepted %+v at %q", op, rr.Header().Get("Location"))
+		}
+
+		rr = do("GET", "/operations/"+op.ID+"?wait=5s", "", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET operation: status = %d", rr.Code)
+		}
+		json.NewDecoder(rr.Body).Decode(&op)
+		return op
+	}
+
+	op := await(do("POST", "/whitelist?async=true", `{"duration":"60"}`, nil))
+	if op.Status != OperationApplied || op.Kind != OperationWhitelist {
+		t.Errorf("whitelist operation = %+v, want applied", op)
+	}
+	if !fake.ips["203.0.113.20"] || !ownsIP(t, store, "203.0.113.20") {
+		t.Error("IP not whitelisted after the operation was applied")
+	}
+
+	fake.removeErr = errors.New("cloudflare is down")
+	op = await(do("DELETE", "/whitelist", "", map[string]string{"Prefer": "respond-async"}))
+	if op.Status != OperationFailed || !strings.Contains(op.Error, "Failed to remove") {
+		t.Errorf("remove operation = %+v, want failed", op)
+	}
+
+	if rr := do("GET", "/operations/nope", "", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown operation: status = %d, want 404", rr.Code)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Provider changes that could not be applied right away are queued in an
+// outbox persisted with the store, so they survive restarts. The expiry
+// daemon retries due operations with exponential backoff; after
+// outboxMaxAttempts failures an operation is moved to the dead-letter list,
+// where it stays until an admin retries it.
+
+const (
+	OutboxAdd    = "add"
+	OutboxRemove = "remove"
+)
+
+// OutboxOp is a queued provider change.
+type OutboxOp struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"` // OutboxAdd or OutboxRemove
+	IP   string `json:"ip"`
+	// RuleID is the provider rule to delete, for removals.
+	RuleID string `json:"ruleId,omitempty"`
+	// ExpiresAt is the expiry of the entry being added, for adds.
+	ExpiresAt   time.Time `json:"expiresAt,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+type OutboxResponse struct {
+	Pending     []OutboxOp `json:"pending"`
+	DeadLetters []OutboxOp `json:"deadLetters"`
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// outboxBackoff returns the delay after the given number of failed
+// attempts: outboxBaseBackoff doubled per attempt, capped at
+// outboxMaxBackoff.
+func outboxBackoff(attempts int) time.Duration {
+	d := outboxBaseBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= outboxMaxBackoff {
+			return outboxMaxBackoff
+		}
+	}
+	return d
+}
+
+// enqueueLocked queues op, replacing any operation still queued for the
+// same IP: only the latest intent matters. s must be locked.
+func (s *WhitelistStore) enqueueLocked(op *OutboxOp) {
+	kept := s.Outbox[:0]
+	for _, queued := range s.Outbox {
+		if queued.IP != op.IP {
+			kept = append(kept, queued)
+		}
+	}
+	s.Outbox = append(kept, op)
+}
+
+// dropQueuedLocked forgets every queued or dead-lettered operation for ip.
+// s must be locked.
+func (s *WhitelistStore) dropQueuedLocked(ip string) {
+	kept := s.Outbox[:0]
+	for _, op := range s.Outbox {
+		if op.IP != ip {
+			kept = append(kept, op)
+		}
+	}
+	s.Outbox = kept
+
+	keptDead := s.DeadLetters[:0]
+	for _, op := range s.DeadLetters {
+		if op.IP != ip {
+			keptDead = append(keptDead, op)
+		}
+	}
+	s.DeadLetters = keptDead
+}
+
+// EnqueueRemoval drops ip from the active entries and queues its removal
+// from the provider. The rule ID moves into the operation; the expired
+// event is recorded once the removal completes.
+func (s *WhitelistStore) EnqueueRemoval(ip string, lastErr error) error {
+	now := time.Now()
+	s.Lock()
+	delete(s.Entries, ip)
+	delete(s.Meta, ip)
+	op := &OutboxOp{
+		ID:          newID(),
+		Kind:        OutboxRemove,
+		IP:          ip,
+		RuleID:      s.RuleIDs[ip],
+		CreatedAt:   now,
+		Attempts:    1,
+		NextAttempt: now.Add(outboxBackoff(1)),
+	}
+	if lastErr != nil {
+		op.LastError = lastErr.Error()
+	}
+	s.enqueueLocked(op)
+	s.Unlock()
+	return s.Save()
+}
+
+// EnqueueAdd queues (re-)applying the active entry for ip, due immediately.
+// It does nothing while an operation for ip is already queued or
+// dead-lettered, so repeated calls do not reset its attempts.
+func (s *WhitelistStore) EnqueueAdd(ip string, expiry time.Time) error {
+	now := time.Now()
+	s.Lock()
+	for _, ops := range [][]*OutboxOp{s.Outbox, s.DeadLetters} {
+		for _, op := range ops {
+			if op.IP == ip {
+				s.Unlock()
+				return nil
+			}
+		}
+	}
+	s.enqueueLocked(&OutboxOp{
+		ID:          newID(),
+		Kind:        OutboxAdd,
+		IP:          ip,
+		ExpiresAt:   expiry,
+		CreatedAt:   now,
+		NextAttempt: now,
+	})
+	s.Unlock()
+	return s.Save()
+}
+
+// QueuedRemovals returns the IPs with a queued or dead-lettered removal.
+func (s *WhitelistStore) QueuedRemovals() ([]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+	var ips []string
+	for _, ops := range [][]*OutboxOp{s.Outbox, s.DeadLetters} {
+		for _, op := range ops {
+			if op.Kind == OutboxRemove {
+				ips = append(ips, op.IP)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// hasQueuedRemovalLocked reports whether ip is waiting to be removed.
+// s must be at least read-locked.
+func (s *WhitelistStore) hasQueuedRemovalLocked(ip string) bool {
+	for _, ops := range [][]*OutboxOp{s.Outbox, s.DeadLetters} {
+		for _, op := range ops {
+			if op.Kind == OutboxRemove && op.IP == ip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DueOps returns copies of the queued operations due at now.
+func (s *WhitelistStore) DueOps(now time.Time) ([]OutboxOp, error) {
+	s.RLock()
+	defer s.RUnlock()
+	var due []OutboxOp
+	for _, op := range s.Outbox {
+		if !now.Before(op.NextAttempt) {
+			due = append(due, *op)
+		}
+	}
+	return due, nil
+}
+
+// CompleteOp removes a finished (or obsolete) operation from the outbox or
+// the dead-letter list. Completing a removal also forgets the rule ID and
+// records the expired event, unless ip was whitelisted again in the
+// meantime.
+func (s *WhitelistStore) CompleteOp(id string) error {
+	s.Lock()
+	s.Outbox = s.completeLocked(s.Outbox, id)
+	s.DeadLetters = s.completeLocked(s.DeadLetters, id)
+	s.Unlock()
+	return s.Save()
+}
+
+// completeLocked returns ops without the operation id. s must be locked.
+func (s *WhitelistStore) completeLocked(ops []*OutboxOp, id string) []*OutboxOp {
+	kept := ops[:0]
+	for _, op := range ops {
+		if op.ID != id {
+			kept = append(kept, op)
+			continue
+		}
+		if _, active := s.Entries[op.IP]; op.Kind == OutboxRemove && !active {
+			delete(s.RuleIDs, op.IP)
+			s.recordLocked(op.IP, HistoryExpired, time.Time{})
+		}
+	}
+	return kept
+}
+
+// FailOp records a failed attempt and schedules the next one, or moves the
+// operation to the dead-letter list once it has used up its attempts.
+func (s *WhitelistStore) FailOp(id string, err error, now time.Time) error {
+	s.Lock()
+	for i, op := range s.Outbox {
+		if op.ID != id {
+			continue
+		}
+		op.Attempts++
+		op.LastError = err.Error()
+		op.NextAttempt = now.Add(outboxBackoff(op.Attempts))
+		if op.Attempts >= outboxMaxAttempts {
+			s.Outbox = append(s.Outbox[:i], s.Outbox[i+1:]...)
+			s.DeadLetters = append(s.DeadLetters, op)
+		}
+		break
+	}
+	s.Unlock()
+	return s.Save()
+}
+
+// RetryDeadLetter moves a dead-lettered operation back into the outbox,
+// due immediately with a fresh set of attempts.
+func (s *WhitelistStore) RetryDeadLetter(id string) (bool, error) {
+	s.Lock()
+	found := false
+	for i, op := range s.DeadLetters {
+		if op.ID != id {
+			continue
+		}
+		s.DeadLetters = append(s.DeadLetters[:i], s.DeadLetters[i+1:]...)
+		op.Attempts = 0
+		op.NextAttempt = time.Now()
+		s.enqueueLocked(op)
+		found = true
+		break
+	}
+	s.Unlock()
+	if !found {
+		return false, nil
+	}
+	return true, s.Save()
+}
+
+// processOutbox attempts every operation due at now, on the daemon's
+// workers. There is at most one queued operation per IP, so they do not
+// race each other.
+func processOutbox(ctx context.Context, now time.Time) {
+	due, err := store.DueOps(now)
+	if err != nil {
+		log.Printf("Outbox: Error reading the store: %v", err)
+		return
+	}
+	runWorkers(ctx, len(due), func(ctx context.Context, i int) {
+		applyOutboxOp(ctx, due[i], now)
+	})
+}
+
+func applyOutboxOp(ctx context.Context, op OutboxOp, now time.Time) {
+	mutationMu.RLock()
+	defer mutationMu.RUnlock()
+
+	expiry, active, err := store.Expiry(op.IP)
+	if err != nil {
+		// Retried on the next run, without counting an attempt
+		log.Printf("Outbox: Error reading the store for IP %s: %v", op.IP, err)
+		return
+	}
+	ctx, trace := withCFTrace(ctx)
+
+	switch op.Kind {
+	case OutboxAdd:
+		if !active || !now.Before(expiry) {
+			// Removed or expired since it was queued
+			completeOutboxOp(op)
+			return
+		}
+		var ruleID string
+		if ruleID, err = provider.Add(ctx, RuleRequest{IP: op.IP, ExpiresAt: expiry, By: "outbox"}); err == nil {
+			if err := store.SetRuleID(op.IP, ruleID); err != nil {
+				log.Printf("Outbox: Error saving rule ID of IP %s: %v", op.IP, err)
+			}
+		}
+	case OutboxRemove:
+		if active {
+			// Whitelisted again since it was queued
+			completeOutboxOp(op)
+			return
+		}
+		err = provider.Remove(ctx, op.IP, op.RuleID)
+	}
+	recordAudit(auditSource{Actor: "outbox"}, "outbox."+op.Kind, op.IP, trace, err)
+
+	if err != nil {
+		log.Printf("Outbox: %s of IP %s failed (attempt %d): %v", op.Kind, op.IP, op.Attempts+1, err)
+		if failErr := store.FailOp(op.ID, err, now); failErr != nil {
+			log.Printf("Outbox: Error saving failed attempt: %v", failErr)
+		} else if op.Attempts+1 >= outboxMaxAttempts {
+			log.Printf("Outbox: giving up on %s of IP %s after %d attempts: %v", op.Kind, op.IP, op.Attempts+1, err)
+		}
+		return
+	}
+	log.Printf("Outbox: applied %s of IP %s", op.Kind, op.IP)
+	completeOutboxOp(op)
+}
+
+func completeOutboxOp(op OutboxOp) {
+	if err := store.CompleteOp(op.ID); err != nil {
+		// Applying it again on the next run is harmless
+		log.Printf("Outbox: Error completing %s of IP %s: %v", op.Kind, op.IP, err)
+	}
+}
+
+func (s *WhitelistStore) QueuedOps() (pending, dead []OutboxOp, err error) {
+	s.RLock()
+	defer s.RUnlock()
+	return copyOps(s.Outbox), copyOps(s.DeadLetters), nil
+}
+
+func copyOps(ops []*OutboxOp) []OutboxOp {
+	copied := make([]OutboxOp, 0, len(ops))
+	for _, op := range ops {
+		copied = append(copied, *op)
+	}
+	return copied
+}
+
+// handleOutbox lists queued and dead-lettered operations.
+func handleOutbox(w http.ResponseWriter, r *http.Request) {
+	var resp OutboxResponse
+	var err error
+	if resp.Pending, resp.DeadLetters, err = store.QueuedOps(); err != nil {
+		writeOpError(w, storeUnavailable(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleRetryDeadLetter requeues a dead-lettered operation.
+func handleRetryDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var ip string
+	_, dead, err := store.QueuedOps()
+	if err != nil {
+		writeOpError(w, storeUnavailable(err))
+		return
+	}
+	for _, op := range dead {
+		if op.ID == id {
+			ip = op.IP
+		}
+	}
+	found, err := store.RetryDeadLetter(id)
+	if found || err != nil {
+		recordAudit(newAuditSource(r, requestOwner(r, "admin")), "outbox.requeue", ip, nil, err)
+	}
+	if err != nil {
+		log.Printf("Error requeueing operation %s: %v", id, err)
+		http.Error(w, "Failed to save the outbox", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "No such dead-lettered operation", http.StatusNotFound)
+		return
+	}
+	log.Printf("Admin: requeued dead-lettered operation %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRemoveExpiredQueuesFailedRemovals(t *testing.T) {
+	forEachStore(t, func(t *testing.T, reopen func() Store) {
+		fake := newFakeProvider("198.51.100.1")
+		fake.removeErr = errors.New("cloudflare is down")
+		provider = fake
+		store.Add("198.51.100.1", time.Now().Add(-time.Minute), EntryMeta{})
+
+		removeExpired(time.Now())
+
+		if _, ok, _ := store.Expiry("198.51.100.1"); ok {
+			t.Error("expired entry still active")
+		}
+		if pending, _, _ := store.QueuedOps(); len(pending) != 1 || pending[0].Kind != OutboxRemove {
+			t.Fatalf("Outbox = %v, want one removal", pending)
+		}
+
+		// The queue survives a restart
+		store = reopen()
+		if pending, _, _ := store.QueuedOps(); len(pending) != 1 || pending[0].IP != "198.51.100.1" {
+			t.Fatalf("reloaded Outbox = %v", pending)
+		}
+
+		// Not due yet
+		processOutbox(context.Background(), time.Now())
+		if !fake.ips["198.51.100.1"] {
+			t.Fatal("removal retried before its backoff elapsed")
+		}
+
+		fake.removeErr = nil
+		processOutbox(context.Background(), time.Now().Add(outboxMaxBackoff))
+		if pending, _, _ := store.QueuedOps(); fake.ips["198.51.100.1"] || len(pending) != 0 {
+			t.Errorf("after retry: provider = %v, outbox = %v", fake.ips, pending)
+		}
+	})
+}
+
+// hangingProvider never answers a removal before the caller gives up.
+type hangingProvider struct {
+	*fakeProvider
+	active, peak int32
+}
+
+func (p *hangingProvider) Remove(ctx context.Context, ip, ruleID string) error {
+	n := atomic.AddInt32(&p.active, 1)
+	defer atomic.AddInt32(&p.active, -1)
+	for {
+		peak := atomic.LoadInt32(&p.peak)
+		if n <= peak || atomic.CompareAndSwapInt32(&p.peak, peak, n) {
+			break
+		}
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestDaemonBoundsWorkersAndTimesOut(t *testing.T) {
+	hanging := &hangingProvider{fakeProvider: newFakeProvider()}
+	withTestStore(t, hanging)
+	origWorkers, origTimeout := daemonWorkers, daemonOperationTimeout
+	daemonWorkers, daemonOperationTimeout = 2, 20*time.Millisecond
+	defer func() { daemonWorkers, daemonOperationTimeout = origWorkers, origTimeout }()
+
+	for i := 1; i <= 5; i++ {
+		store.Add(fmt.Sprintf("198.51.100.%d", i), time.Now().Add(-time.Minute), EntryMeta{})
+	}
+	removeExpired(time.Now())
+	if pending, _, _ := store.QueuedOps(); len(pending) != 5 {
+		t.Errorf("outbox has %d removals, want 5 timed out ones", len(pending))
+	}
+
+	processOutbox(context.Background(), time.Now().Add(outboxMaxBackoff))
+	if peak := atomic.LoadInt32(&hanging.peak); peak != 2 {
+		t.Errorf("peak concurrent removals = %d, want 2", peak)
+	}
+	if pending, _, _ := store.QueuedOps(); len(pending) != 5 || pending[0].Attempts != 2 {
+		t.Errorf("outbox after a timed out retry = %+v", pending)
+	}
+}
+
+func TestOutboxDeadLetter(t *testing.T) {
+	origMax := outboxMaxAttempts
+	outboxMaxAttempts = 3
+	defer func() { outboxMaxAttempts = origMax }()
+
+	forEachStore(t, func(t *testing.T, reopen func() Store) {
+		fake := newFakeProvider("198.51.100.1")
+		fake.removeErr = errors.New("cloudflare is down")
+		provider = fake
+
+		store.EnqueueRemoval("198.51.100.1", fake.removeErr)
+		now := time.Now()
+		for i := 0; i < 5; i++ {
+			now = now.Add(outboxMaxBackoff)
+			processOutbox(context.Background(), now)
+		}
+
+		pending, dead, _ := store.QueuedOps()
+		if len(pending) != 0 || len(dead) != 1 {
+			t.Fatalf("outbox = %v, dead letters = %v", pending, dead)
+		}
+		if dead[0].Attempts != 3 || dead[0].LastError == "" {
+			t.Errorf("dead letter = %+v, want 3 attempts and the last error", dead[0])
+		}
+		if !ownsIP(t, store, "198.51.100.1") {
+			t.Error("dead-lettered removal no longer owned")
+		}
+
+		fake.removeErr = nil
+		if found, err := store.RetryDeadLetter(dead[0].ID); !found || err != nil {
+			t.Fatalf("RetryDeadLetter() = %v, %v", found, err)
+		}
+		if found, _ := store.RetryDeadLetter("nope"); found {
+			t.Error("RetryDeadLetter() of an unknown ID = true")
+		}
+		processOutbox(context.Background(), time.Now())
+		pending, dead, _ = store.QueuedOps()
+		if fake.ips["198.51.100.1"] || len(pending)+len(dead) != 0 {
+			t.Errorf("after retry: provider = %v, outbox = %v, dead letters = %v", fake.ips, pending, dead)
+		}
+	})
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	origBase, origMax := outboxBaseBackoff, outboxMaxBackoff
+	outboxBaseBackoff, outboxMaxBackoff = time.Second, 5*time.Second
+	defer func() { outboxBaseBackoff, outboxMaxBackoff = origBase, origMax }()
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := outboxBackoff(i + 1); got != w {
+			t.Errorf("outboxBackoff(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+}
+
+func TestWhitelistStoreLegacyPendingRemovals(t *testing.T) {
+	withTestStore(t, newFakeProvider())
+	data := `{"entries":{},"ruleIds":{"1.2.3.4":"rule-1"},"pendingRemovals":{"1.2.3.4":"2025-01-01T00:00:00Z"}}`
+	if err := os.WriteFile(storeFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &WhitelistStore{Entries: make(map[string]time.Time)}
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Outbox) != 1 || s.Outbox[0].RuleID != "rule-1" || s.Outbox[0].Kind != OutboxRemove {
+		t.Errorf("Outbox = %v, want the pending removal of 1.2.3.4", s.Outbox)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The service only ever removes rules it created itself or that an admin
+// explicitly adopted: those are the IPs in the store (active or queued for
+// removal). Everything else in the provider, such as a hand-curated office
+// IP, is foreign and left alone.
+
+// AdoptRequest is the body of POST /admin/adopt.
+type AdoptRequest struct {
+	IP       string `json:"ip"`
+	Duration string `json:"duration"`
+	Reason   string `json:"reason,omitempty"`
+	Ticket   string `json:"ticket,omitempty"`
+}
+
+type AdoptResponse struct {
+	Message   string `json:"message"`
+	IP        string `json:"ip"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+// Owns reports whether ip is managed by this service.
+func (s *WhitelistStore) Owns(ip string) (bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if _, ok := s.Entries[ip]; ok {
+		return true, nil
+	}
+	return s.hasQueuedRemovalLocked(ip), nil
+}
+
+// handleAdopt takes over an existing provider rule the service did not
+// create, so it expires like any other entry. The rule must already exist.
+func handleAdopt(w http.ResponseWriter, r *http.Request) {
+	var req AdoptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	prefix, err := parseIPOrPrefix(req.IP)
+	if err != nil {
+		http.Error(w, "Invalid IP address or prefix", http.StatusBadRequest)
+		return
+	}
+	ip := prefixString(prefix)
+
+	mutationMu.RLock()
+	defer mutationMu.RUnlock()
+	src := newAuditSource(r, requestOwner(r, "admin"))
+
+	owned, err := store.Owns(ip)
+	if err != nil {
+		writeOpError(w, storeUnavailable(err))
+		return
+	}
+	if owned {
+		http.Error(w, "IP is already managed by this service", http.StatusConflict)
+		return
+	}
+	ruleID, found, err := provider.FindRule(r.Context(), ip)
+	if err != nil {
+		log.Printf("Error looking up rule for %s: %v", ip, err)
+		http.Error(w, "Failed to look up Cloudflare rules", http.StatusBadGateway)
+		return
+	}
+	if !found {
+		http.Error(w, "No rule for this IP exists in Cloudflare", http.StatusNotFound)
+		return
+	}
+
+	// Keep the rule ID, so removal deletes this exact rule. Providers
+	// only fall back to looking up rules they created themselves.
+	expiry := time.Now().Add(parseWhitelistDuration(req.Duration))
+	err = store.AddWithRule(ip, expiry, ruleID, newEntryMeta(r, src.Actor, req.Reason, req.Ticket))
+	recordAudit(src, "adopt", ip, nil, err)
+	if err != nil {
+		log.Printf("Error saving adopted IP %s: %v", ip, err)
+		http.Error(w, "Failed to save whitelist entry", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Admin: adopted rule for IP %s, expires at %s", ip, expiry)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AdoptResponse{
+		Message:   "Rule adopted",
+		IP:        ip,
+		ExpiresAt: expiry.Format(time.RFC3339),
+	})
+}
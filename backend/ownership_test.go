@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestDeleteLeavesForeignRules(t *testing.T) {
+	fake := newFakeProvider("203.0.113.10", "203.0.113.11")
+	withTestStore(t, fake)
+	store.Add("203.0.113.11", time.Now().Add(time.Hour), EntryMeta{})
+
+	tests := []struct {
+		ip         string
+		wantStatus int
+		wantInCF   bool
+	}{
+		{"203.0.113.10", http.StatusNotFound, true}, // e.g. the office IP
+		{"203.0.113.11", http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("DELETE", "/whitelist", nil)
+		req.Header.Set("CF-Connecting-IP", tt.ip)
+		rr := httptest.NewRecorder()
+		handleDeleteWhitelist(rr, req)
+
+		if rr.Code != tt.wantStatus {
+			t.Errorf("DELETE %s: status = %d, want %d", tt.ip, rr.Code, tt.wantStatus)
+		}
+		if fake.ips[tt.ip] != tt.wantInCF {
+			t.Errorf("DELETE %s: in provider = %v, want %v", tt.ip, fake.ips[tt.ip], tt.wantInCF)
+		}
+	}
+}
+
+func TestWhitelistRefusesForeignRule(t *testing.T) {
+	fake := newFakeProvider("203.0.113.10")
+	withTestStore(t, fake)
+
+	req := httptest.NewRequest("POST", "/whitelist", strings.NewReader(`{"duration":"1"}`))
+	req.Header.Set("CF-Connecting-IP", "203.0.113.10")
+	rr := httptest.NewRecorder()
+	handleWhitelist(rr, req)
+
+	if rr.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusConflict)
+	}
+	if ownsIP(t, store, "203.0.113.10") {
+		t.Error("foreign rule was taken over by POST /whitelist")
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	fake := newFakeProvider("203.0.113.0/24")
+	withTestStore(t, fake)
+	origToken := adminToken
+	defer func() { adminToken = origToken }()
+
+	r := chi.NewRouter()
+	r.With(authenticate, requirePermission(permAdminWrite)).Post("/admin/adopt", handleAdopt)
+
+	tests := []struct {
+		name       string
+		token      string
+		auth       string
+		body       string
+		wantStatus int
+	}{
+		{"disabled", "", "Bearer secret", `{"ip":"203.0.113.0/24"}`, http.StatusForbidden},
+		{"no token", "secret", "", `{"ip":"203.0.113.0/24"}`, http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer nope", `{"ip":"203.0.113.0/24"}`, http.StatusUnauthorized},
+		{"invalid ip", "secret", "Bearer secret", `{"ip":"nope"}`, http.StatusBadRequest},
+		{"no such rule", "secret", "Bearer secret", `{"ip":"198.51.100.1"}`, http.StatusNotFound},
+		{"adopt", "secret", "Bearer secret", `{"ip":"203.0.113.7/24","duration":"30"}`, http.StatusOK},
+		{"already owned", "secret", "Bearer secret", `{"ip":"203.0.113.0/24"}`, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adminToken = tt.token
+			req := httptest.NewRequest("POST", "/admin/adopt", strings.NewReader(tt.body))
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (%s)", rr.Code, tt.wantStatus, strings.TrimSpace(rr.Body.String()))
+			}
+		})
+	}
+
+	expiry, ok, _ := store.Expiry("203.0.113.0/24")
+	if !ok {
+		t.Fatal("adopted prefix not in store")
+	}
+	if d := time.Until(expiry); d < 29*time.Minute || d > 30*time.Minute {
+		t.Errorf("adopted entry expires in %s, want 30m", d)
+	}
+}
+
+func TestAccessRulesManualRuleIsForeign(t *testing.T) {
+	fake := &fakeAccessRules{rules: map[string]CFAccessRule{
+		"manual": {ID: "manual", Mode: "whitelist", Notes: "office", Configuration: CFAccessRuleTarget{Target: "ip", Value: "203.0.113.10"}},
+	}}
+	withFakeCloudflare(t, fake)
+	withTestStore(t, &accessRulesProvider{})
+	origToken := adminToken
+	adminToken = "secret"
+	defer func() { adminToken = origToken }()
+
+	req := httptest.NewRequest("POST", "/whitelist", strings.NewReader(`{"duration":"1"}`))
+	req.Header.Set("CF-Connecting-IP", "203.0.113.10")
+	rr := httptest.NewRecorder()
+	handleWhitelist(rr, req)
+	if rr.Code != http.StatusConflict || ownsIP(t, store, "203.0.113.10") {
+		t.Errorf("POST /whitelist: status = %d, owned = %v; want 409, not owned", rr.Code, ownsIP(t, store, "203.0.113.10"))
+	}
+
+	// Add never reuses a manual rule either
+	if _, err := provider.Add(context.Background(), RuleRequest{IP: "203.0.113.10"}); !errors.Is(err, errForeignRule) {
+		t.Errorf("Add() error = %v, want errForeignRule", err)
+	}
+	if _, ok := fake.rules["manual"]; !ok || len(fake.rules) != 1 {
+		t.Errorf("rules = %v, want only the manual rule", fake.rules)
+	}
+
+	// An admin can still adopt it, and removal then deletes exactly it
+	r := chi.NewRouter()
+	r.With(authenticate, requirePermission(permAdminWrite)).Post("/admin/adopt", handleAdopt)
+	req = httptest.NewRequest("POST", "/admin/adopt", strings.NewReader(`{"ip":"203.0.113.10"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || ruleIDOf(t, store, "203.0.113.10") != "manual" {
+		t.Fatalf("adopt: status = %d, rule ID = %q; want 200, manual", rr.Code, ruleIDOf(t, store, "203.0.113.10"))
+	}
+	if err := unwhitelistIP(context.Background(), "203.0.113.10"); err != nil {
+		t.Fatalf("unwhitelistIP() error: %v", err)
+	}
+	if len(fake.rules) != 0 {
+		t.Errorf("rules after removing the adopted IP = %v, want none", fake.rules)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RuleRequest describes an IP to whitelist.
+type RuleRequest struct {
+	IP        string
+	ExpiresAt time.Time
+	// By identifies who asked for the IP to be whitelisted. Providers that
+	// support comments record it next to the rule.
+	By string
+}
+
+// ruleCommentPrefix starts every comment written by RuleRequest.Comment.
+const ruleCommentPrefix = "whitelisted until "
+
+// Comment returns a human-readable description for providers that can
+// attach one to a rule.
+func (r RuleRequest) Comment() string {
+	comment := ruleCommentPrefix + r.ExpiresAt.UTC().Format(time.RFC3339)
+	if r.By != "" {
+		comment += " by " + r.By
+	}
+	return comment
+}
+
+// parseRuleComment reads back a comment written by RuleRequest.Comment.
+// ok is false for any other comment.
+func parseRuleComment(comment string) (expiresAt time.Time, by string, ok bool) {
+	rest, ok := strings.CutPrefix(comment, ruleCommentPrefix)
+	if !ok {
+		return time.Time{}, "", false
+	}
+	until, by, _ := strings.Cut(rest, " by ")
+	expiresAt, err := time.Parse(time.RFC3339, until)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return expiresAt, by, true
+}
+
+// Provider is an enforcement point that whitelisted IPs are pushed to.
+// The handlers and the expiry daemon only talk to the configured provider,
+// so new backends can be added without touching the HTTP layer.
+type Provider interface {
+	// Name returns the identifier used to select the provider.
+	Name() string
+	// MissingConfig returns the environment variables the provider needs
+	// but that are not set. An empty result means the provider is usable.
+	MissingConfig() []string
+	// Add whitelists req.IP and returns the provider's identifier for the
+	// created rule, or "" if the provider does not track rules individually.
+	// Adding an IP that is already present is not an error.
+	Add(ctx context.Context, req RuleRequest) (ruleID string, err error)
+	// Remove removes ip. ruleID is the value returned by Add, if known, and
+	// lets providers delete the rule directly instead of searching for it.
+	// Removing an IP that is not present is not an error.
+	Remove(ctx context.Context, ip, ruleID string) error
+	// Contains reports whether ip is currently whitelisted.
+	Contains(ctx context.Context, ip string) (bool, error)
+	// List returns every IP currently whitelisted.
+	List(ctx context.Context) ([]string, error)
+	// FindRule looks up the rule for exactly ip, whoever created it;
+	// broader rules that merely cover ip do not count. ruleID is "" if the
+	// provider does not track rules individually.
+	FindRule(ctx context.Context, ip string) (ruleID string, found bool, err error)
+}
+
+// ManagedRule is a rule whose note or comment says this service created
+// it, with the expiry and owner written there.
+type ManagedRule struct {
+	IP        string
+	RuleID    string
+	ExpiresAt time.Time
+	By        string
+}
+
+// managedLister is implemented by providers that tag the rules they create
+// (IP Access Rule notes, list item comments), so the reconciler can take
+// back rules the store lost. Access policies and groups cannot tag their
+// include rules.
+type managedLister interface {
+	// ListManaged returns every rule tagged by this service.
+	ListManaged(ctx context.Context) ([]ManagedRule, error)
+}
+
+// errForeignRule is returned by Add when ip already has a rule that this
+// service did not create and must not take over.
+var errForeignRule = errors.New("IP is already whitelisted by a rule not managed by this service")
+
+// providers maps WHITELIST_PROVIDER values to constructors.
+var providers = map[string]func() Provider{
+	"access_policy": func() Provider { return newAccessPolicyProvider() },
+	"access_group":  func() Provider { return newAccessGroupProvider() },
+	"access_rules":  func() Provider { return &accessRulesProvider{} },
+	"lists":         func() Provider { return &listsProvider{} },
+}
+
+// newProvider returns the provider registered under name.
+func newProvider(name string) (Provider, error) {
+	factory, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q (available: %s)", name, strings.Join(providerNames(), ", "))
+	}
+	return factory(), nil
+}
+
+func providerNames() []string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// providerConfigured reports whether p has all the configuration it needs.
+func providerConfigured(p Provider) bool {
+	return len(p.MissingConfig()) == 0
+}
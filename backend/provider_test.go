@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestNewProvider(t *testing.T) {
+	p, err := newProvider("access_policy")
+	if err != nil {
+		t.Fatalf("newProvider(access_policy) error: %v", err)
+	}
+	if p.Name() != "access_policy" {
+		t.Errorf("Name() = %q, want access_policy", p.Name())
+	}
+
+	if _, err := newProvider("does_not_exist"); err == nil {
+		t.Error("newProvider(does_not_exist) expected error, got nil")
+	}
+}
+
+func TestAccessPolicyProviderMissingConfig(t *testing.T) {
+	origToken, origAccountID, origPolicyID := apiToken, accountID, policyID
+	defer func() {
+		apiToken, accountID, policyID = origToken, origAccountID, origPolicyID
+	}()
+
+	apiToken, accountID, policyID = "token", "", "policy"
+	p := newAccessPolicyProvider()
+	missing := p.MissingConfig()
+	if len(missing) != 1 || missing[0] != "CLOUDFLARE_ACCOUNT_ID" {
+		t.Errorf("MissingConfig() = %v, want [CLOUDFLARE_ACCOUNT_ID]", missing)
+	}
+	if providerConfigured(p) {
+		t.Error("providerConfigured() = true, want false")
+	}
+}
+
+// fakeProvider is an in-memory Provider that counts calls.
+type fakeProvider struct {
+	mu        sync.Mutex
+	ips       map[string]bool
+	lists     int
+	addErr    error
+	removeErr error
+}
+
+func newFakeProvider(ips ...string) *fakeProvider {
+	f := &fakeProvider{ips: map[string]bool{}}
+	for _, ip := range ips {
+		f.ips[ip] = true
+	}
+	return f
+}
+
+func (f *fakeProvider) Name() string            { return "fake" }
+func (f *fakeProvider) MissingConfig() []string { return nil }
+
+func (f *fakeProvider) Add(ctx context.Context, req RuleRequest) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.addErr != nil {
+		return "", f.addErr
+	}
+	f.ips[req.IP] = true
+	return "rule-" + req.IP, nil
+}
+
+func (f *fakeProvider) Remove(ctx context.Context, ip, ruleID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.removeErr != nil {
+		return f.removeErr
+	}
+	delete(f.ips, ip)
+	return nil
+}
+
+func (f *fakeProvider) Contains(ctx context.Context, ip string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ips[ip], nil
+}
+
+func (f *fakeProvider) FindRule(ctx context.Context, ip string) (string, bool, error) {
+	prefix, err := parseIPOrPrefix(ip)
+	if err != nil {
+		return "", false, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for existing := range f.ips {
+		if p, err := parseIPOrPrefix(existing); err == nil && p == prefix {
+			return "rule-" + existing, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func (f *fakeProvider) List(ctx context.Context) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lists++
+	ips := make([]string, 0, len(f.ips))
+	for ip := range f.ips {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// Every route except /healthz, the sign-in endpoints and the web UI runs
+// authenticate and then requirePermission. Signed-in users hold the
+// permissions of their role, which comes from their IdP groups
+// (RBAC_OPERATOR_GROUPS, RBAC_ADMIN_GROUPS); API keys hold their scopes;
+// ADMIN_TOKEN holds the admin role. Without authentication configured,
+// anonymous callers are users.
+
+// Permissions, which are also the scopes of API keys
+const (
+	permWhitelistSelf = "whitelist:self" // whitelist the caller's own IP
+	permWhitelistAny  = "whitelist:any"  // whitelist any IP or CIDR range
+	permAdminRead     = "admin:read"     // read the GET /admin endpoints
+	permAdminWrite    = "admin:write"    // the other /admin endpoints
+)
+
+var permissions = []string{permWhitelistSelf, permWhitelistAny, permAdminRead, permAdminWrite}
+
+// impliedPermissions are the permissions included in another
+var impliedPermissions = map[string][]string{
+	permWhitelistAny: {permWhitelistSelf},
+	permAdminWrite:   {permAdminRead},
+}
+
+// Roles
+const (
+	roleUser     = "user"     // manages their own IP
+	roleOperator = "operator" // whitelists any IP or range, reads everything
+	roleAdmin    = "admin"    // everything
+)
+
+var rolePermissions = map[string][]string{
+	roleUser:     {permWhitelistSelf},
+	roleOperator: {permWhitelistAny, permAdminRead},
+	roleAdmin:    permissions,
+}
+
+func knownPermission(perm string) bool {
+	for _, p := range permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// grants reports whether holding perms allows perm.
+func grants(perms []string, perm string) bool {
+	for _, p := range perms {
+		if p == perm {
+			return true
+		}
+		for _, implied := range impliedPermissions[p] {
+			if implied == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// roleForGroups returns the role of a member of groups.
+func roleForGroups(groups []string) string {
+	role := roleUser
+	for _, g := range groups {
+		if containsFold(rbacAdminGroups, g) {
+			return roleAdmin
+		}
+		if containsFold(rbacOperatorGroups, g) {
+			role = roleOperator
+		}
+	}
+	return role
+}
+
+// can reports whether id holds perm.
+func (id Identity) can(perm string) bool {
+	if id.key != nil {
+		return grants(id.key.Scopes, perm)
+	}
+	return grants(rolePermissions[id.Role], perm)
+}
+
+// caller returns who sent r. Anonymous callers are users.
+func caller(r *http.Request) Identity {
+	if id, ok := identityFrom(r.Context()); ok {
+		return id
+	}
+	return Identity{Role: roleUser}
+}
+
+// permissionError refuses perm to the caller of r: 401 when anonymous,
+// since authenticating may help, 403 otherwise.
+func permissionError(r *http.Request, perm string) error {
+	if _, ok := identityFrom(r.Context()); !ok {
+		return &opError{http.StatusUnauthorized, "Unauthorized"}
+	}
+	return &opError{http.StatusForbidden, fmt.Sprintf("Forbidden: this needs the %s permission", perm)}
+}
+
+// requirePermission only lets callers holding perm through. It must run
+// after authenticate.
+func requirePermission(perm string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !caller(r).can(perm) {
+				writeOpError(w, permissionError(r, perm))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// authorizeTarget checks that the caller of r may whitelist or remove
+// target for d: the client's own IP needs whitelist:self, any other IP
+// or range whitelist:any. An API key's maximum duration applies.
+func authorizeTarget(r *http.Request, clientIP, target string, d time.Duration) error {
+	perm := permWhitelistAny
+	if isOwnIP(clientIP, target) {
+		perm = permWhitelistSelf
+	}
+	id := caller(r)
+	if !id.can(perm) {
+		return permissionError(r, perm)
+	}
+	if id.key != nil {
+		if max := id.key.maxDuration(); max > 0 && d > max {
+			return &opError{http.StatusBadRequest, fmt.Sprintf("Duration exceeds the API key's maximum of %s", max)}
+		}
+	}
+	return nil
+}
+
+// isOwnIP reports whether target is the single address clientIP, however
+// either is written.
+func isOwnIP(clientIP, target string) bool {
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return false
+	}
+	prefix, err := parseIPOrPrefix(target)
+	return err == nil && prefix.IsSingleIP() && prefix.Addr() == addr.Unmap().WithZone("")
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func withTestRoles(t *testing.T) {
+	t.Helper()
+	origOperators, origAdmins := rbacOperatorGroups, rbacAdminGroups
+	rbacOperatorGroups, rbacAdminGroups = []string{"ops"}, []string{"sre"}
+	t.Cleanup(func() { rbacOperatorGroups, rbacAdminGroups = origOperators, origAdmins })
+}
+
+// testSession returns a session cookie for a member of groups.
+func testSession(groups ...string) *http.Cookie {
+	s := session{Email: "alice@example.com", Groups: groups, Expires: time.Now().Add(time.Hour).Unix()}
+	return &http.Cookie{Name: sessionCookie, Value: sealCookie(sessionCookie, s)}
+}
+
+func TestRoleForGroups(t *testing.T) {
+	withTestRoles(t)
+	tests := []struct {
+		groups []string
+		want   string
+	}{
+		{nil, roleUser},
+		{[]string{"eng"}, roleUser},
+		{[]string{"eng", "OPS"}, roleOperator},
+		{[]string{"ops", "sre"}, roleAdmin},
+		{[]string{"sre", "ops"}, roleAdmin},
+	}
+	for _, tt := range tests {
+		if got := roleForGroups(tt.groups); got != tt.want {
+			t.Errorf("roleForGroups(%v) = %q, want %q", tt.groups, got, tt.want)
+		}
+	}
+}
+
+// routePermissions is the permission each authenticated route needs.
+var routePermissions = map[string]string{
+	"GET /ip":                       permWhitelistSelf,
+	"GET /status":                   permWhitelistSelf,
+	"POST /whitelist":               permWhitelistSelf,
+	"DELETE /whitelist":             permWhitelistSelf,
+	"GET /operations/{id}":          permWhitelistSelf,
+	"GET /totp":                     permWhitelistSelf,
+	"POST /totp/enroll":             permWhitelistSelf,
+	"POST /totp/confirm":            permWhitelistSelf,
+	"DELETE /totp":                  permWhitelistSelf,
+	"GET /admin/entries":            permAdminRead,
+	"GET /admin/drift":              permAdminRead,
+	"GET /admin/history":            permAdminRead,
+	"GET /history":                  permAdminRead,
+	"GET /admin/outbox":             permAdminRead,
+	"GET /admin/api-keys":           permAdminRead,
+	"POST /admin/adopt":             permAdminWrite,
+	"POST /admin/outbox/{id}/retry": permAdminWrite,
+	"POST /admin/api-keys":          permAdminWrite,
+	"DELETE /admin/api-keys/{id}":   permAdminWrite,
+	"DELETE /admin/totp/{user}":     permAdminWrite,
+}
+
+func TestEveryRouteRequiresPermission(t *testing.T) {
+	withTestStore(t, newFakeProvider())
+	withTestOIDC(t, newMockOIDC(t))
+	withTestRoles(t)
+	withTestAdminToken(t)
+	r := newRouter()
+
+	callers := []struct {
+		name    string
+		role    string
+		prepare func(req *http.Request)
+	}{
+		{"user", roleUser, func(req *http.Request) { req.AddCookie(testSession("eng")) }},
+		{"operator", roleOperator, func(req *http.Request) { req.AddCookie(testSession("ops")) }},
+		{"admin", roleAdmin, func(req *http.Request) { req.AddCookie(testSession("sre")) }},
+		{"admin token", roleAdmin, func(req *http.Request) { req.Header.Set("Authorization", "Bearer secret") }},
+	}
+
+	routes := 0
+	chi.Walk(r, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if route == "/healthz" || strings.HasPrefix(route, "/auth/") || route == "/*" {
+			return nil
+		}
+		perm, ok := routePermissions[method+" "+route]
+		if !ok {
+			t.Errorf("%s %s is missing from routePermissions", method, route)
+			return nil
+		}
+		routes++
+		path := strings.NewReplacer("{id}", "unknown", "{user}", "unknown").Replace(route)
+
+		req := httptest.NewRequest(method, path, strings.NewReader(`{}`))
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("anonymous %s %s: status = %d, want 401", method, route, rr.Code)
+		}
+
+		for _, c := range callers {
+			req := httptest.NewRequest(method, path, strings.NewReader(`{}`))
+			req.Header.Set("CF-Connecting-IP", "203.0.113.50")
+			c.prepare(req)
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			denied := rr.Code == http.StatusUnauthorized || rr.Code == http.StatusForbidden
+			if want := !grants(rolePermissions[c.role], perm); denied != want {
+				t.Errorf("%s %s as %s: status = %d (%s)", method, route, c.name, rr.Code, strings.TrimSpace(rr.Body.String()))
+			}
+		}
+		return nil
+	})
+	if routes != len(routePermissions) {
+		t.Errorf("walked %d authenticated routes, want %d", routes, len(routePermissions))
+	}
+}
+
+func TestOperatorWhitelistsAnyIP(t *testing.T) {
+	withTestStore(t, newFakeProvider())
+	withTestOIDC(t, newMockOIDC(t))
+	withTestRoles(t)
+	r := newRouter()
+
+	post := func(cookie *http.Cookie, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/whitelist", strings.NewReader(body))
+		req.Header.Set("CF-Connecting-IP", "203.0.113.50")
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := post(testSession("eng"), `{"ip":"198.51.100.0/24"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("user: status = %d, want 403", rr.Code)
+	}
+	if rr := post(testSession("ops"), `{"ip":"198.51.100.0/24"}`); rr.Code != http.StatusOK {
+		t.Errorf("operator: status = %d: %s", rr.Code, rr.Body)
+	}
+	if entry, ok, _ := store.Entry("198.51.100.0/24"); !ok || entry.CreatedBy != "alice@example.com" {
+		t.Errorf("entry = %+v, %v", entry, ok)
+	}
+}
+
+func TestUserWhitelistsOwnIPOnly(t *testing.T) {
+	withTestStore(t, newFakeProvider())
+	withTestOIDC(t, newMockOIDC(t))
+	withTestRoles(t)
+	r := newRouter()
+
+	post := func(remoteAddr, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/whitelist", strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("CF-Connecting-IP", "203.0.113.50")
+		req.AddCookie(testSession("eng"))
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	// The header is only believed from a trusted proxy
+	if rr := post("198.51.100.7:1234", `{"ip":"203.0.113.50"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("spoofed CF-Connecting-IP: status = %d, want 403", rr.Code)
+	}
+	if rr := post("192.0.2.1:1234", `{"ip":"203.0.113.50/32"}`); rr.Code != http.StatusOK {
+		t.Errorf("own IP as a /32: status = %d: %s", rr.Code, rr.Body)
+	}
+	if rr := post("[::ffff:198.51.100.7]:1234", `{"ip":"198.51.100.7"}`); rr.Code != http.StatusOK {
+		t.Errorf("own IP from a mapped peer: status = %d: %s", rr.Code, rr.Body)
+	}
+}
+
+func TestAPIKeyScopesLimitedToCreator(t *testing.T) {
+	withTestStore(t, newFakeProvider())
+	r := newRouter()
+	writer := createTestAPIKey(t, APIKey{Name: "writer", Scopes: []string{permAdminWrite}})
+
+	if rr := callAPI(r, "POST", "/admin/api-keys", writer, `{"name":"ci","scopes":["whitelist:any"]}`); rr.Code != http.StatusForbidden {
+		t.Errorf("granting a scope the creator lacks: status = %d, want 403", rr.Code)
+	}
+	if rr := callAPI(r, "POST", "/admin/api-keys", writer, `{"name":"ci","scopes":["admin:read"]}`); rr.Code != http.StatusCreated {
+		t.Errorf("granting an implied scope: status = %d: %s", rr.Code, rr.Body)
+	}
+}
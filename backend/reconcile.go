@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// mutationMu keeps the reconciler from diffing while a handler or the
+// expiry daemon is between its provider call and the matching store update.
+// Those take the read lock, so they still run concurrently with each other.
+var mutationMu sync.RWMutex
+
+// DriftReport describes the differences found by one reconciliation run.
+type DriftReport struct {
+	CheckedAt time.Time `json:"checkedAt"`
+	// Missing entries are active in the store but absent from the provider.
+	// They are queued in the outbox to be re-applied.
+	Missing []string `json:"missing"`
+	// Orphaned entries are queued for removal (or dead-lettered) but still
+	// present in the provider. The outbox keeps retrying them.
+	Orphaned []string `json:"orphaned"`
+	// Adopted entries are rules tagged by this service but unknown to the
+	// store, e.g. after it was restored from a backup. They are taken back
+	// with the expiry from their comment (or the default duration from
+	// now), so the expiry daemon removes them.
+	Adopted []string `json:"adopted"`
+	// Unmanaged entries are in the provider but unknown to the store and
+	// not tagged by this service, e.g. added by hand in the dashboard.
+	// They are reported, never touched.
+	Unmanaged []string `json:"unmanaged"`
+}
+
+// Drifted reports whether the run found anything to fix.
+func (r DriftReport) Drifted() bool {
+	return len(r.Missing) > 0 || len(r.Orphaned) > 0 || len(r.Adopted) > 0
+}
+
+var (
+	lastDriftMu sync.RWMutex
+	lastDrift   *DriftReport
+)
+
+// reconcile diffs the store against the provider and queues the repairs.
+//
+// The provider is listed without holding mutationMu, since that call may
+// retry and back off for minutes. Entries that changed while it ran are
+// left for the next run instead of being reported as missing.
+func reconcile(ctx context.Context) (DriftReport, error) {
+	report := DriftReport{
+		CheckedAt: time.Now(),
+		Missing:   []string{},
+		Orphaned:  []string{},
+		Adopted:   []string{},
+		Unmanaged: []string{},
+	}
+
+	// A store that cannot be read would make every rule look orphaned
+	before, err := store.Expiries()
+	if err != nil {
+		return report, err
+	}
+	listed, err := provider.List(ctx)
+	if err != nil {
+		return report, err
+	}
+	managed, err := listManaged(ctx)
+	if err != nil {
+		return report, err
+	}
+	present := make(map[netip.Prefix]bool, len(listed))
+	for _, ip := range listed {
+		if prefix, err := parseIPOrPrefix(ip); err == nil {
+			present[prefix] = true
+		}
+	}
+
+	mutationMu.Lock()
+	defer mutationMu.Unlock()
+
+	now := time.Now()
+	known := map[netip.Prefix]bool{}
+	active := map[netip.Prefix]string{}
+	expiries := map[string]time.Time{}
+	current, err := store.Expiries()
+	if err != nil {
+		return report, err
+	}
+	queued, dead, err := store.QueuedOps()
+	if err != nil {
+		return report, err
+	}
+	for ip, expiry := range current {
+		prefix, err := parseIPOrPrefix(ip)
+		if err != nil {
+			continue
+		}
+		// Expired entries are left to the expiry daemon
+		known[prefix] = true
+		if prev, ok := before[ip]; ok && prev.Equal(expiry) && now.Before(expiry) {
+			active[prefix] = ip
+			expiries[ip] = expiry
+		}
+	}
+	// Removed while listing: the rule may not be gone from the list yet
+	for ip := range before {
+		if prefix, err := parseIPOrPrefix(ip); err == nil {
+			known[prefix] = true
+		}
+	}
+
+	pending := map[netip.Prefix]OutboxOp{}
+	for _, op := range append(queued, dead...) {
+		if op.Kind != OutboxRemove {
+			continue
+		}
+		if prefix, err := parseIPOrPrefix(op.IP); err == nil {
+			known[prefix] = true
+			pending[prefix] = op
+		}
+	}
+
+	for prefix, ip := range active {
+		if !present[prefix] {
+			report.Missing = append(report.Missing, ip)
+			log.Printf("Reconciler: IP %s is missing from %s, queueing re-add", ip, provider.Name())
+			err := store.EnqueueAdd(ip, expiries[ip])
+			recordAudit(auditSource{Actor: "reconciler"}, "reconcile.queue-add", ip, nil, err)
+			if err != nil {
+				log.Printf("Reconciler: Error queueing re-add of IP %s: %v", ip, err)
+			}
+		}
+	}
+	for prefix, op := range pending {
+		if present[prefix] {
+			report.Orphaned = append(report.Orphaned, op.IP)
+			continue
+		}
+		// Gone already (removed by hand, or a retry raced us). Only this
+		// operation is done: another replica may have whitelisted the IP
+		// again since it was read, which drops the operation instead.
+		err := store.CompleteOp(op.ID)
+		recordAudit(auditSource{Actor: "reconciler"}, "reconcile.complete-remove", op.IP, nil, err)
+		if err != nil {
+			log.Printf("Reconciler: Error completing removal of IP %s: %v", op.IP, err)
+		}
+	}
+	for prefix := range present {
+		if known[prefix] {
+			continue
+		}
+		ip := prefixString(prefix)
+		rule, ok := managed[prefix]
+		if !ok {
+			report.Unmanaged = append(report.Unmanaged, ip)
+			continue
+		}
+		expiry := rule.ExpiresAt
+		if expiry.IsZero() {
+			expiry = now.Add(parseWhitelistDuration(""))
+		}
+		report.Adopted = append(report.Adopted, ip)
+		log.Printf("Reconciler: IP %s has a rule of this service in %s but no entry, adopting it until %s", ip, provider.Name(), expiry.Format(time.RFC3339))
+		meta := EntryMeta{CreatedAt: now, CreatedBy: rule.By, Reason: "adopted by the reconciler", Backend: provider.Name()}
+		err := store.AddWithRule(ip, expiry, rule.RuleID, meta)
+		recordAudit(auditSource{Actor: "reconciler"}, "reconcile.adopt", ip, nil, err)
+		if err != nil {
+			log.Printf("Reconciler: Error adopting IP %s: %v", ip, err)
+		}
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.Orphaned)
+	sort.Strings(report.Adopted)
+	sort.Strings(report.Unmanaged)
+
+	if report.Drifted() || len(report.Unmanaged) > 0 {
+		log.Printf("Reconciler: %d missing, %d orphaned, %d adopted, %d unmanaged",
+			len(report.Missing), len(report.Orphaned), len(report.Adopted), len(report.Unmanaged))
+	}
+
+	lastDriftMu.Lock()
+	lastDrift = &report
+	lastDriftMu.Unlock()
+	return report, nil
+}
+
+// listManaged returns the rules the provider tagged as created by this
+// service, or nothing for providers that cannot tag rules.
+func listManaged(ctx context.Context) (map[netip.Prefix]ManagedRule, error) {
+	p := provider
+	if c, ok := p.(*cachedProvider); ok {
+		p = c.Provider
+	}
+	lister, ok := p.(managedLister)
+	if !ok {
+		return nil, nil
+	}
+	rules, err := lister.ListManaged(ctx)
+	if err != nil {
+		return nil, err
+	}
+	managed := make(map[netip.Prefix]ManagedRule, len(rules))
+	for _, rule := range rules {
+		if prefix, err := parseIPOrPrefix(rule.IP); err == nil {
+			managed[prefix] = rule
+		}
+	}
+	return managed, nil
+}
+
+// reconcileStaleStore reconciles a JSON store that was not loaded from the
+// current file, before the expiry daemon starts. A backup misses the
+// entries added since it was written; their rules still carry the
+// service's note or comment, so the reconciler adopts them instead of
+// leaving them in Cloudflare for good.
+func reconcileStaleStore() {
+	js, ok := store.(*WhitelistStore)
+	if !ok || !js.Stale() {
+		return
+	}
+	log.Println("Store was not loaded from the current file, reconciling with Cloudflare")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	report, err := reconcile(ctx)
+	if err != nil {
+		log.Printf("Reconciler: error: %v", err)
+		return
+	}
+	if len(report.Adopted) > 0 {
+		log.Printf("Reconciler: recovered %d entries missing from the store: %v", len(report.Adopted), report.Adopted)
+	}
+}
+
+func startReconciler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	log.Printf("Reconciler started (every %s)", interval)
+	for range ticker.C {
+		if !isLeader() {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if _, err := reconcile(ctx); err != nil {
+			log.Printf("Reconciler: error: %v", err)
+		}
+		cancel()
+	}
+}
+
+// handleDrift returns the report of the last reconciliation run.
+func handleDrift(w http.ResponseWriter, r *http.Request) {
+	lastDriftMu.RLock()
+	report := lastDrift
+	lastDriftMu.RUnlock()
+
+	if report == nil {
+		http.Error(w, "No reconciliation has run yet", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// withTestStore swaps in an empty store backed by a temp file and the given
+// provider for the duration of the test.
+func withTestStore(t *testing.T, p Provider) {
+	t.Helper()
+	tmpfile, err := os.CreateTemp("", "whitelist_store_test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpfile.Close()
+
+	origStore, origStoreFile, origProvider := store, storeFile, provider
+	storeFile = tmpfile.Name()
+	store = &WhitelistStore{Entries: make(map[string]time.Time)}
+	provider = p
+	t.Cleanup(func() {
+		os.Remove(tmpfile.Name())
+		store, storeFile, provider = origStore, origStoreFile, origProvider
+	})
+}
+
+func TestReconcile(t *testing.T) {
+	fake := newFakeProvider("198.51.100.2", "198.51.100.4", "198.51.100.5")
+	withTestStore(t, fake)
+
+	failed := errors.New("cloudflare is down")
+	store.Add("198.51.100.1", time.Now().Add(time.Hour), EntryMeta{})    // active, missing in provider
+	store.EnqueueRemoval("198.51.100.2", failed)                         // should be gone, still present
+	store.EnqueueRemoval("198.51.100.3", failed)                         // should be gone, already gone
+	store.Add("198.51.100.5", time.Now().Add(-time.Minute), EntryMeta{}) // expired, left to the daemon
+
+	report, err := reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("reconcile() error: %v", err)
+	}
+
+	if want := []string{"198.51.100.1"}; !reflect.DeepEqual(report.Missing, want) {
+		t.Errorf("Missing = %v, want %v", report.Missing, want)
+	}
+	if want := []string{"198.51.100.2"}; !reflect.DeepEqual(report.Orphaned, want) {
+		t.Errorf("Orphaned = %v, want %v", report.Orphaned, want)
+	}
+	if want := []string{"198.51.100.4"}; !reflect.DeepEqual(report.Unmanaged, want) {
+		t.Errorf("Unmanaged = %v, want %v", report.Unmanaged, want)
+	}
+	if ownsIP(t, store, "198.51.100.3") {
+		t.Error("removal of an already absent IP is still queued")
+	}
+
+	// The repairs are applied by the outbox
+	processOutbox(context.Background(), time.Now().Add(outboxBaseBackoff))
+
+	if !fake.ips["198.51.100.1"] || fake.ips["198.51.100.2"] || !fake.ips["198.51.100.4"] {
+		t.Errorf("provider after reconcile = %v", fake.ips)
+	}
+	if pending, _, _ := store.QueuedOps(); len(pending) != 0 {
+		t.Errorf("Outbox = %v, want empty", pending)
+	}
+	if ruleIDOf(t, store, "198.51.100.1") == "" {
+		t.Error("re-applied entry has no rule ID")
+	}
+}
+
+func TestReconcileAdoptsTaggedRules(t *testing.T) {
+	until := time.Now().Add(2 * time.Hour).UTC().Truncate(time.Second)
+	tagged := func(id, ip, comment string) CFAccessRule {
+		notes := accessRuleNote
+		if comment != "" {
+			notes += ": " + comment
+		}
+		return CFAccessRule{ID: id, Mode: "whitelist", Notes: notes, Configuration: CFAccessRuleTarget{Target: "ip", Value: ip}}
+	}
+	fake := &fakeAccessRules{rules: map[string]CFAccessRule{
+		"r1":     tagged("r1", "198.51.100.1", RuleRequest{ExpiresAt: until, By: "alice@example.com"}.Comment()),
+		"r2":     tagged("r2", "198.51.100.2", RuleRequest{ExpiresAt: time.Now().Add(-time.Hour)}.Comment()),
+		"r3":     tagged("r3", "198.51.100.3", ""),
+		"manual": {ID: "manual", Mode: "whitelist", Notes: "office", Configuration: CFAccessRuleTarget{Target: "ip", Value: "198.51.100.9"}},
+	}}
+	withFakeCloudflare(t, fake)
+	withTestStore(t, &accessRulesProvider{})
+
+	report, err := reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"}; !reflect.DeepEqual(report.Adopted, want) {
+		t.Errorf("Adopted = %v, want %v", report.Adopted, want)
+	}
+	if len(report.Missing) != 0 || ownsIP(t, store, "198.51.100.9") {
+		t.Errorf("report = %+v; the manual rule must stay unmanaged", report)
+	}
+
+	e, ok, _ := store.Entry("198.51.100.1")
+	if !ok || !e.ExpiresAt.Equal(until) || e.RuleID != "r1" || e.CreatedBy != "alice@example.com" {
+		t.Errorf("entry with a comment = %+v, %v", e, ok)
+	}
+	e, ok, _ = store.Entry("198.51.100.3")
+	if wantMin := time.Now().Add(parseWhitelistDuration("") - time.Minute); !ok || e.ExpiresAt.Before(wantMin) || e.RuleID != "r3" {
+		t.Errorf("entry without a comment = %+v, %v; want the default duration", e, ok)
+	}
+
+	// The expiry daemon deletes the rule that has already expired
+	removeExpired(time.Now())
+	if _, ok := fake.rules["r2"]; ok || len(fake.deletes) != 1 {
+		t.Errorf("deletes = %v, want the expired rule r2", fake.deletes)
+	}
+	if report, _ := reconcile(context.Background()); len(report.Adopted) != 0 {
+		t.Errorf("second run adopted %v again", report.Adopted)
+	}
+}
+
+func TestReconcileStaleStoreAdoptsLostEntries(t *testing.T) {
+	until := time.Now().Add(3 * time.Hour).UTC().Truncate(time.Second)
+	rule := func(id, ip, notes string) CFAccessRule {
+		return CFAccessRule{ID: id, Mode: "whitelist", Notes: notes, Configuration: CFAccessRuleTarget{Target: "ip", Value: ip}}
+	}
+	fake := &fakeAccessRules{rules: map[string]CFAccessRule{
+		"r1": rule("r1", "198.51.100.1", accessRuleNote+": "+RuleRequest{ExpiresAt: until}.Comment()),
+		"r2": rule("r2", "198.51.100.2", accessRuleNote+": "+RuleRequest{ExpiresAt: until, By: "bob@example.com"}.Comment()),
+		"r3": rule("r3", "198.51.100.3", accessRuleNote),
+	}}
+	withFakeCloudflare(t, fake)
+	withTestStore(t, &accessRulesProvider{})
+
+	// The current file is corrupt and the backup predates 198.51.100.2
+	// and 198.51.100.3
+	dir := t.TempDir()
+	withStoreFile(t, filepath.Join(dir, "whitelist_store.json"))
+	os.WriteFile(storeFile, []byte(`{"entries":{"198.51.100.1":"20`), 0644)
+	backup := fmt.Sprintf(`{"entries":{"198.51.100.1":%q},"ruleIds":{"198.51.100.1":"r1"}}`, until.Format(time.RFC3339))
+	os.WriteFile(backupPath(storeFile, 1), []byte(backup), 0644)
+	js := newJSONStore()
+	if err := js.Load(); err != nil || !js.Stale() {
+		t.Fatalf("Load() = %v, stale %v", err, js.Stale())
+	}
+	store = js
+
+	reconcileStaleStore()
+
+	reloaded := newJSONStore()
+	if err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok, _ := reloaded.Entry("198.51.100.2"); !ok || !e.ExpiresAt.Equal(until) || e.RuleID != "r2" || e.CreatedBy != "bob@example.com" {
+		t.Errorf("entry of the tagged rule = %+v, %v", e, ok)
+	}
+	if e, ok, _ := reloaded.Entry("198.51.100.3"); !ok || e.RuleID != "r3" || time.Until(e.ExpiresAt) < parseWhitelistDuration("")-time.Minute {
+		t.Errorf("entry of the rule without a comment = %+v, %v; want the default duration", e, ok)
+	}
+	if e, _, _ := reloaded.Entry("198.51.100.1"); e.Reason != "" {
+		t.Errorf("entry from the backup was adopted again: %+v", e)
+	}
+}
+
+func TestReconcileListsWithoutBlockingMutations(t *testing.T) {
+	slow := &slowListProvider{fakeProvider: newFakeProvider(), release: make(chan struct{}), listing: make(chan struct{}, 1)}
+	withTestStore(t, slow)
+
+	done := make(chan DriftReport, 1)
+	go func() {
+		report, _ := reconcile(context.Background())
+		done <- report
+	}()
+	<-slow.listing
+
+	// Handlers go ahead while the provider is being listed
+	added := make(chan struct{})
+	go func() {
+		mutationMu.RLock()
+		defer mutationMu.RUnlock()
+		store.Add("198.51.100.1", time.Now().Add(time.Hour), EntryMeta{})
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("whitelisting blocked behind the reconciler's List")
+	}
+	close(slow.release)
+
+	// The listing predates the entry, so it is not reported missing
+	report := <-done
+	if len(report.Missing) != 0 {
+		t.Errorf("Missing = %v, want none", report.Missing)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Store persists whitelist entries, the provider rule IDs that belong to
+// them, the outbox of provider changes still to be applied, API keys and
+// TOTP enrollments. Methods that change the store return an error if the
+// change could not be persisted, readers one if the store could not be
+// read, so callers refuse rather than decide on missing data.
+// WhitelistStore keeps everything in a JSON file, sqliteStore in a SQLite
+// database and redisStore in Redis, shared between replicas. STORE_BACKEND
+// selects one.
+type Store interface {
+	// Expiry returns the expiry of the entry for ip, if there is one.
+	Expiry(ip string) (time.Time, bool, error)
+	// Expiries returns the expiry of every entry.
+	Expiries() (map[string]time.Time, error)
+	// Entry returns the entry for ip with its metadata, if there is one.
+	Entry(ip string) (Entry, bool, error)
+	// ListEntries returns every entry with its metadata, ordered by IP.
+	ListEntries() ([]Entry, error)
+	// Add whitelists ip until expiry with meta (CreatedAt defaulting to
+	// now). For an existing entry it moves the expiry and counts an
+	// extension instead, keeping the original metadata. Any queued
+	// operation for ip is dropped.
+	Add(ip string, expiry time.Time, meta EntryMeta) error
+	// AddWithRule is Add, also recording the provider rule ID returned by
+	// Provider.Add. An empty ruleID leaves any existing rule ID untouched.
+	AddWithRule(ip string, expiry time.Time, ruleID string, meta EntryMeta) error
+	// SetRuleID records the provider rule ID of an entry re-applied by the
+	// outbox, without counting an extension.
+	SetRuleID(ip, ruleID string) error
+	// RuleID returns the provider rule ID stored for ip, if any.
+	RuleID(ip string) (string, error)
+	// Remove forgets ip entirely: entry, rule ID and queued operations.
+	Remove(ip string) error
+	// Expire is Remove for an entry the expiry daemon dropped: its
+	// history records an expired rather than a removed event.
+	Expire(ip string) error
+	// Owns reports whether ip is managed by this service.
+	Owns(ip string) (bool, error)
+	// History returns the history events of ip (of every IP if ip is
+	// empty) between from and to, oldest first. Zero bounds are open.
+	History(ip string, from, to time.Time) ([]HistoryEvent, error)
+
+	// EnqueueRemoval drops the expired entry for ip and queues its
+	// removal from the provider, lastErr being why the first attempt
+	// failed. The expired event is recorded when the removal completes.
+	EnqueueRemoval(ip string, lastErr error) error
+	// EnqueueAdd queues (re-)applying the entry for ip, unless an
+	// operation for ip is already queued or dead-lettered.
+	EnqueueAdd(ip string, expiry time.Time) error
+	// QueuedRemovals returns the IPs with a queued or dead-lettered removal.
+	QueuedRemovals() ([]string, error)
+	// DueOps returns the queued operations due at now.
+	DueOps(now time.Time) ([]OutboxOp, error)
+	// CompleteOp removes a finished (or obsolete) operation, queued or
+	// dead-lettered. Completing the removal of an IP that is not active
+	// again records its expired event. An ID that is no longer stored is
+	// ignored.
+	CompleteOp(id string) error
+	// FailOp records a failed attempt, dead-lettering the operation once
+	// it has used up its attempts.
+	FailOp(id string, err error, now time.Time) error
+	// RetryDeadLetter requeues a dead-lettered operation. It reports
+	// whether there was one with that ID.
+	RetryDeadLetter(id string) (bool, error)
+	// QueuedOps returns the outbox and the dead-letter list.
+	QueuedOps() (pending, dead []OutboxOp, err error)
+
+	// SaveAPIKey stores a new API key.
+	SaveAPIKey(key APIKey) error
+	// APIKey returns the API key with ID id, if there is one.
+	APIKey(id string) (APIKey, bool, error)
+	// ListAPIKeys returns every API key, oldest first.
+	ListAPIKeys() ([]APIKey, error)
+	// RevokeAPIKey deletes an API key. It reports whether there was one
+	// with that ID.
+	RevokeAPIKey(id string) (bool, error)
+
+	// TOTP returns the TOTP enrollment of user, if there is one.
+	TOTP(user string) (TOTPEnrollment, bool, error)
+	// SaveTOTP stores an enrollment, replacing the user's previous one.
+	SaveTOTP(e TOTPEnrollment) error
+	// DeleteTOTP removes the enrollment of user. It reports whether there
+	// was one.
+	DeleteTOTP(user string) (bool, error)
+	// UseTOTPStep records that user used the code of step. It reports
+	// false if that or a later step was used already, so each code works
+	// once, even across replicas.
+	UseTOTPStep(user string, step int64) (bool, error)
+	// UseRecoveryCode consumes the unused recovery code of user with hash.
+	// It reports whether there was one.
+	UseRecoveryCode(user, hash string) (bool, error)
+}
+
+// openStore opens the store selected with STORE_BACKEND.
+func openStore(backend string) (Store, error) {
+	switch backend {
+	case "json":
+		s := &WhitelistStore{Entries: make(map[string]time.Time)}
+		if err := s.Load(); err != nil {
+			log.Printf("Error loading store: %v", err)
+		}
+		return s, nil
+	case "sqlite":
+		s, err := openSQLiteStore(sqlitePath)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.ImportJSON(storeFile); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to import %s: %w", storeFile, err)
+		}
+		return s, nil
+	case "redis":
+		s, err := openRedisStore(redisURL, redisPrefix)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.ImportJSON(storeFile); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to import %s: %w", storeFile, err)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown store backend %q (available: json, sqlite, redis)", backend)
+}
+
+// storeUnavailable logs a failed store read and turns it into a 503, so
+// the request is refused rather than decided on missing data.
+func storeUnavailable(err error) error {
+	log.Printf("Refusing request: %v", err)
+	return &opError{http.StatusServiceUnavailable, "Store unavailable, try again later"}
+}
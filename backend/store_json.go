@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WhitelistStore is the Store kept in a JSON file (WHITELIST_STORE)
+type WhitelistStore struct {
+	sync.RWMutex
+	Entries map[string]time.Time `json:"entries"`
+	// RuleIDs holds the provider rule identifier for each IP, when the
+	// provider returns one (e.g. the ID of an IP Access Rule).
+	RuleIDs map[string]string `json:"ruleIds,omitempty"`
+	// Meta holds who created each entry and why. Entries from before
+	// metadata was recorded have none.
+	Meta map[string]*EntryMeta `json:"meta,omitempty"`
+	// Events is the history of whitelist changes, oldest first
+	Events []HistoryEvent `json:"history,omitempty"`
+	// Outbox holds provider changes still to be applied, e.g. removals of
+	// expired IPs that failed. DeadLetters holds the ones that kept failing.
+	Outbox      []*OutboxOp `json:"outbox,omitempty"`
+	DeadLetters []*OutboxOp `json:"deadLetters,omitempty"`
+	// APIKeys holds the API keys by ID
+	APIKeys map[string]*APIKey `json:"apiKeys,omitempty"`
+	// TOTPEnrollments holds the TOTP enrollments by user
+	TOTPEnrollments map[string]*TOTPEnrollment `json:"totp,omitempty"`
+
+	// saveMu orders writes, so an older snapshot never replaces a newer one
+	saveMu sync.Mutex
+	// stale is set when Load could not use the current file, so what was
+	// loaded may be missing recent changes
+	stale bool
+}
+
+// storeData is the on-disk layout of WhitelistStore.
+type storeData struct {
+	Entries     map[string]time.Time       `json:"entries"`
+	RuleIDs     map[string]string          `json:"ruleIds,omitempty"`
+	Meta        map[string]*EntryMeta      `json:"meta,omitempty"`
+	Events      []HistoryEvent             `json:"history,omitempty"`
+	Outbox      []*OutboxOp                `json:"outbox,omitempty"`
+	DeadLetters []*OutboxOp                `json:"deadLetters,omitempty"`
+	APIKeys     map[string]*APIKey         `json:"apiKeys,omitempty"`
+	TOTP        map[string]*TOTPEnrollment `json:"totp,omitempty"`
+	// PendingRemovals is the pre-outbox list of failed removals, only read
+	PendingRemovals map[string]time.Time `json:"pendingRemovals,omitempty"`
+}
+
+// backupPath returns the path of the n-th most recent backup of path.
+func backupPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// Load reads the store file. If it is unreadable or corrupt, it is moved
+// aside and the most recent valid backup is loaded instead; failing that
+// the store starts empty. Either way the store is marked stale so it gets
+// reconciled against the provider.
+func (s *WhitelistStore) Load() error {
+	err := s.loadFrom(storeFile)
+	if err == nil {
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		corrupt := fmt.Sprintf("%s.corrupt-%s", storeFile, time.Now().UTC().Format("20060102T150405Z"))
+		log.Printf("Store: %s is unusable (%v), moving it to %s", storeFile, err, corrupt)
+		if renameErr := os.Rename(storeFile, corrupt); renameErr != nil {
+			return fmt.Errorf("%v; moving it aside failed: %w", err, renameErr)
+		}
+	}
+
+	s.stale = true
+	for n := 1; n <= storeBackups; n++ {
+		backup := backupPath(storeFile, n)
+		if err := s.loadFrom(backup); err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Store: backup %s is unusable: %v", backup, err)
+			}
+			continue
+		}
+		log.Printf("Store: recovered %d entries from backup %s", len(s.Entries), backup)
+		return nil
+	}
+
+	if os.IsNotExist(err) {
+		// A fresh install, not a lost store
+		s.stale = false
+		return nil
+	}
+	return fmt.Errorf("no valid backup of %s: %w", storeFile, err)
+}
+
+// Stale reports whether Load fell back to a backup or to an empty store
+// because the store file was unusable.
+func (s *WhitelistStore) Stale() bool {
+	return s.stale
+}
+
+func (s *WhitelistStore) loadFrom(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bytes, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	data, err := parseStoreData(bytes)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if data.Entries != nil {
+		s.Entries = data.Entries
+	}
+	s.RuleIDs = data.RuleIDs
+	s.Meta = data.Meta
+	s.Events = data.Events
+	s.Outbox = data.Outbox
+	s.DeadLetters = data.DeadLetters
+	s.APIKeys = data.APIKeys
+	s.TOTPEnrollments = data.TOTP
+	for ip, since := range data.PendingRemovals {
+		if !s.hasQueuedRemovalLocked(ip) {
+			s.Outbox = append(s.Outbox, &OutboxOp{
+				ID:          newID(),
+				Kind:        OutboxRemove,
+				IP:          ip,
+				RuleID:      s.RuleIDs[ip],
+				CreatedAt:   since,
+				NextAttempt: time.Now(),
+			})
+		}
+	}
+	return nil
+}
+
+func parseStoreData(bytes []byte) (storeData, error) {
+	var data storeData
+
+	// Older versions stored the entries map directly at the top level.
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(bytes, &raw); err != nil {
+		return data, err
+	}
+	if _, ok := raw["entries"]; !ok {
+		err := json.Unmarshal(bytes, &data.Entries)
+		return data, err
+	}
+
+	err := json.Unmarshal(bytes, &data)
+	return data, err
+}
+
+// Save writes the store crash-safely: to a temporary file that is synced
+// and then renamed over the store file, so a crash leaves either the old
+// or the new version. The previous version is kept as the first of
+// STORE_BACKUPS rotating backups.
+func (s *WhitelistStore) Save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.RLock()
+	bytes, err := json.MarshalIndent(storeData{
+		Entries:     s.Entries,
+		RuleIDs:     s.RuleIDs,
+		Meta:        s.Meta,
+		Events:      s.Events,
+		Outbox:      s.Outbox,
+		DeadLetters: s.DeadLetters,
+		APIKeys:     s.APIKeys,
+		TOTP:        s.TOTPEnrollments,
+	}, "", "  ")
+	s.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := rotateBackups(storeFile, storeBackups); err != nil {
+		log.Printf("Store: rotating backups failed: %v", err)
+	}
+	if err := writeFileAtomic(storeFile, bytes, 0644); err != nil {
+		return fmt.Errorf("failed to save store: %w", err)
+	}
+	return nil
+}
+
+// rotateBackups shifts path.1 … path.(n-1) up by one and makes path.1 a
+// copy of the current path. The current file stays in place throughout.
+func rotateBackups(path string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	for i := n - 1; i >= 1; i-- {
+		if err := os.Rename(backupPath(path, i), backupPath(path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// A hard link costs nothing and stays valid once path is replaced
+	newest := backupPath(path, 1)
+	if err := os.Link(path, newest); err == nil {
+		return nil
+	}
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(newest, bytes, 0644)
+}
+
+// writeFileAtomic replaces path with data via a synced temporary file in
+// the same directory.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Persist the rename itself
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func (s *WhitelistStore) Add(ip string, expiry time.Time, meta EntryMeta) error {
+	return s.AddWithRule(ip, expiry, "", meta)
+}
+
+func (s *WhitelistStore) AddWithRule(ip string, expiry time.Time, ruleID string, meta EntryMeta) error {
+	s.Lock()
+	if s.Meta == nil {
+		s.Meta = make(map[string]*EntryMeta)
+	}
+	if _, exists := s.Entries[ip]; exists {
+		if s.Meta[ip] == nil {
+			s.Meta[ip] = &EntryMeta{}
+		}
+		s.Meta[ip].Extensions++
+		s.recordLocked(ip, HistoryExtended, expiry)
+	} else {
+		if meta.CreatedAt.IsZero() {
+			meta.CreatedAt = time.Now()
+		}
+		s.Meta[ip] = &meta
+		s.recordLocked(ip, HistoryWhitelisted, expiry)
+	}
+	s.Entries[ip] = expiry
+	s.dropQueuedLocked(ip)
+	if ruleID != "" {
+		s.setRuleIDLocked(ip, ruleID)
+	}
+	s.Unlock()
+	return s.Save()
+}
+
+func (s *WhitelistStore) SetRuleID(ip, ruleID string) error {
+	s.Lock()
+	s.setRuleIDLocked(ip, ruleID)
+	s.Unlock()
+	return s.Save()
+}
+
+func (s *WhitelistStore) setRuleIDLocked(ip, ruleID string) {
+	if s.RuleIDs == nil {
+		s.RuleIDs = make(map[string]string)
+	}
+	s.RuleIDs[ip] = ruleID
+}
+
+func (s *WhitelistStore) Entry(ip string) (Entry, bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+	expiry, ok := s.Entries[ip]
+	if !ok {
+		return Entry{}, false, nil
+	}
+	return s.entryLocked(ip, expiry), true, nil
+}
+
+func (s *WhitelistStore) ListEntries() ([]Entry, error) {
+	s.RLock()
+	defer s.RUnlock()
+	entries := make([]Entry, 0, len(s.Entries))
+	for ip, expiry := range s.Entries {
+		entries = append(entries, s.entryLocked(ip, expiry))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].IP < entries[j].IP })
+	return entries, nil
+}
+
+// importedHistory returns the history to import from the file into another
+// backend: only the file's own events, plus a whitelisted event for each
+// entry from before history was recorded whose metadata says when it was
+// created.
+func (s *WhitelistStore) importedHistory() []HistoryEvent {
+	s.RLock()
+	defer s.RUnlock()
+	events := append([]HistoryEvent(nil), s.Events...)
+	hasHistory := map[string]bool{}
+	for _, e := range events {
+		hasHistory[e.IP] = true
+	}
+	for ip, expiry := range s.Entries {
+		if e := s.entryLocked(ip, expiry); !hasHistory[ip] && !e.CreatedAt.IsZero() {
+			events = append(events, newHistoryEvent(ip, HistoryWhitelisted, e.CreatedAt, expiry))
+		}
+	}
+	return events
+}
+
+func (s *WhitelistStore) entryLocked(ip string, expiry time.Time) Entry {
+	e := Entry{IP: ip, ExpiresAt: expiry, RuleID: s.RuleIDs[ip]}
+	if meta := s.Meta[ip]; meta != nil {
+		e.EntryMeta = *meta
+	}
+	return e
+}
+
+func (s *WhitelistStore) RuleID(ip string) (string, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.RuleIDs[ip], nil
+}
+
+func (s *WhitelistStore) Expiry(ip string) (time.Time, bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+	expiry, ok := s.Entries[ip]
+	return expiry, ok, nil
+}
+
+func (s *WhitelistStore) Expiries() (map[string]time.Time, error) {
+	s.RLock()
+	defer s.RUnlock()
+	entries := make(map[string]time.Time, len(s.Entries))
+	for ip, expiry := range s.Entries {
+		entries[ip] = expiry
+	}
+	return entries, nil
+}
+
+func (s *WhitelistStore) Remove(ip string) error {
+	return s.remove(ip, HistoryRemoved)
+}
+
+func (s *WhitelistStore) Expire(ip string) error {
+	return s.remove(ip, HistoryExpired)
+}
+
+func (s *WhitelistStore) remove(ip, event string) error {
+	s.Lock()
+	if _, exists := s.Entries[ip]; exists {
+		s.recordLocked(ip, event, time.Time{})
+	}
+	delete(s.Entries, ip)
+	delete(s.RuleIDs, ip)
+	delete(s.Meta, ip)
+	s.dropQueuedLocked(ip)
+	s.Unlock()
+	return s.Save()
+}
+
+// recordLocked adds an event to the history, dropping what has outlived
+// HISTORY_RETENTION. s must be locked.
+func (s *WhitelistStore) recordLocked(ip, event string, expiry time.Time) {
+	now := time.Now()
+	cutoff := historyCutoff(now)
+	kept := s.Events[:0]
+	for _, e := range s.Events {
+		if !e.At.Before(cutoff) {
+			kept = append(kept, e)
+		}
+	}
+	s.Events = append(kept, newHistoryEvent(ip, event, now, expiry))
+}
+
+func (s *WhitelistStore) History(ip string, from, to time.Time) ([]HistoryEvent, error) {
+	s.RLock()
+	defer s.RUnlock()
+	var events []HistoryEvent
+	for _, e := range s.Events {
+		if (ip == "" || e.IP == ip) && inRange(e.At, from, to) {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withStoreFile points storeFile at path for the duration of the test.
+func withStoreFile(t *testing.T, path string) {
+	t.Helper()
+	orig := storeFile
+	storeFile = path
+	t.Cleanup(func() { storeFile = orig })
+}
+
+func newJSONStore() *WhitelistStore {
+	return &WhitelistStore{Entries: make(map[string]time.Time)}
+}
+
+func TestWhitelistStoreBackups(t *testing.T) {
+	dir := t.TempDir()
+	withStoreFile(t, filepath.Join(dir, "whitelist_store.json"))
+	origBackups := storeBackups
+	storeBackups = 3
+	defer func() { storeBackups = origBackups }()
+
+	s := newJSONStore()
+	for i := 1; i <= 5; i++ {
+		if err := s.Add("1.1.1.1", time.Now().Add(time.Duration(i)*time.Hour), EntryMeta{}); err != nil {
+			t.Fatalf("Add() error: %v", err)
+		}
+	}
+
+	files, _ := os.ReadDir(dir)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	want := "whitelist_store.json whitelist_store.json.1 whitelist_store.json.2 whitelist_store.json.3"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("files = %s, want %s", got, want)
+	}
+
+	// Each backup is the version before the next newer one
+	current, _ := os.ReadFile(storeFile)
+	newest, _ := os.ReadFile(backupPath(storeFile, 1))
+	if string(current) == string(newest) {
+		t.Error("backup 1 is the current version, want the previous one")
+	}
+}
+
+func TestWhitelistStoreRecovery(t *testing.T) {
+	valid := `{"entries":{"1.1.1.1":"2030-01-01T00:00:00Z"}}`
+	tests := []struct {
+		name      string
+		current   string // "" means missing
+		backups   []string
+		wantIP    bool
+		wantStale bool
+		wantErr   bool
+	}{
+		{"fresh install", "", nil, false, false, false},
+		{"valid", valid, nil, true, false, false},
+		{"truncated, valid backup", `{"entries":{"1.1.1.1":"20`, []string{valid}, true, true, false},
+		{"empty, second backup valid", ``, []string{`{`, valid}, true, true, false},
+		{"missing, valid backup", "", []string{valid}, true, true, false},
+		{"corrupt, no valid backup", `garbage`, []string{`{`}, false, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			withStoreFile(t, filepath.Join(dir, "whitelist_store.json"))
+			if tt.current != "" || strings.Contains(tt.name, "empty") {
+				os.WriteFile(storeFile, []byte(tt.current), 0644)
+			}
+			for i, b := range tt.backups {
+				os.WriteFile(backupPath(storeFile, i+1), []byte(b), 0644)
+			}
+
+			s := newJSONStore()
+			err := s.Load()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Load() error = %v, want error: %v", err, tt.wantErr)
+			}
+			if _, ok := s.Entries["1.1.1.1"]; ok != tt.wantIP {
+				t.Errorf("entry loaded = %v, want %v", ok, tt.wantIP)
+			}
+			if s.Stale() != tt.wantStale {
+				t.Errorf("Stale() = %v, want %v", s.Stale(), tt.wantStale)
+			}
+
+			// A corrupt file is kept for inspection, not overwritten later
+			corrupt, _ := filepath.Glob(storeFile + ".corrupt-*")
+			wantCorrupt := tt.current != valid && (tt.current != "" || strings.Contains(tt.name, "empty"))
+			if (len(corrupt) == 1) != wantCorrupt {
+				t.Errorf("corrupt copies = %v, want one: %v", corrupt, wantCorrupt)
+			}
+		})
+	}
+}
+
+func TestWhitelistStoreSaveError(t *testing.T) {
+	withStoreFile(t, filepath.Join(t.TempDir(), "missing", "whitelist_store.json"))
+
+	s := newJSONStore()
+	if err := s.Add("1.1.1.1", time.Now().Add(time.Hour), EntryMeta{}); err == nil {
+		t.Error("Add() into a missing directory succeeded")
+	}
+}
+
+func TestWriteFileAtomicLeavesNoTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f.json")
+	for i := 0; i < 3; i++ {
+		if err := writeFileAtomic(path, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("directory holds %d files, want only f.json", len(files))
+	}
+}
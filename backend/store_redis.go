@@ -0,0 +1,888 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisStore is the Store kept in Redis (REDIS_URL), so that replicas
+// behind a load balancer share one whitelist. All keys start with
+// REDIS_PREFIX:
+//
+//	entries      sorted set of whitelisted IPs, scored by expiry (Unix ms)
+//	rules        hash of IP to provider rule ID
+//	meta         hash of IP to EntryMeta (JSON)
+//	history      sorted set of HistoryEvents (JSON), scored by time
+//	outbox       hash of operation ID to queued OutboxOp (JSON)
+//	due          sorted set of queued operation IDs, scored by next attempt
+//	deadletters  hash of operation ID to dead-lettered OutboxOp (JSON)
+//	apikeys      hash of API key ID to APIKey (JSON)
+//	totp         hash of user to TOTPEnrollment (JSON)
+//	leader       the leader lease, see leader.go
+//
+// Expiry is driven by the entries sorted set rather than key TTLs: an
+// expired entry has to stay visible until its provider rule is removed.
+// Every change runs in a WATCH/MULTI transaction, retried when another
+// replica changed the store in between.
+type redisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+const (
+	// redisTimeout bounds a single store call.
+	redisTimeout = 5 * time.Second
+	// redisMaxRetries is how often a transaction that lost a race with
+	// another replica is retried.
+	redisMaxRetries = 10
+)
+
+func openRedisStore(url, prefix string) (*redisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	s := &redisStore{client: redis.NewClient(opts), prefix: prefix}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		s.client.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *redisStore) key(name string) string {
+	return s.prefix + name
+}
+
+// update runs fn in a transaction watching every key of the store,
+// describing what failed in the error.
+func (s *redisStore) update(what string, fn func(ctx context.Context, tx *redis.Tx) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	keys := []string{s.key("entries"), s.key("rules"), s.key("meta"), s.key("outbox"), s.key("due"), s.key("deadletters")}
+	var err error
+	for i := 0; i < redisMaxRetries; i++ {
+		err = s.client.Watch(ctx, func(tx *redis.Tx) error { return fn(ctx, tx) }, keys...)
+		if !errors.Is(err, redis.TxFailedErr) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("store: %s failed: %w", what, err)
+	}
+	return nil
+}
+
+func unixMilliScore(t time.Time) float64 {
+	return float64(t.UnixMilli())
+}
+
+// loadOps returns the operations in the hash name, oldest first.
+func (s *redisStore) loadOps(ctx context.Context, c redis.Cmdable, name string) ([]OutboxOp, error) {
+	values, err := c.HVals(ctx, s.key(name)).Result()
+	if err != nil {
+		return nil, err
+	}
+	ops := make([]OutboxOp, 0, len(values))
+	for _, v := range values {
+		var op OutboxOp
+		if err := json.Unmarshal([]byte(v), &op); err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if !ops[i].CreatedAt.Equal(ops[j].CreatedAt) {
+			return ops[i].CreatedAt.Before(ops[j].CreatedAt)
+		}
+		return ops[i].ID < ops[j].ID
+	})
+	return ops, nil
+}
+
+func (s *redisStore) getOp(ctx context.Context, c redis.Cmdable, name, id string) (*OutboxOp, error) {
+	v, err := c.HGet(ctx, s.key(name), id).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var op OutboxOp
+	if err := json.Unmarshal([]byte(v), &op); err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+// opsFor returns the queued and dead-lettered operations for ip.
+func (s *redisStore) opsFor(ctx context.Context, c redis.Cmdable, ip string) (pending, dead []OutboxOp, err error) {
+	for _, list := range []struct {
+		name string
+		ops  *[]OutboxOp
+	}{{"outbox", &pending}, {"deadletters", &dead}} {
+		all, err := s.loadOps(ctx, c, list.name)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, op := range all {
+			if op.IP == ip {
+				*list.ops = append(*list.ops, op)
+			}
+		}
+	}
+	return pending, dead, nil
+}
+
+// queueOp adds op to the outbox, due at op.NextAttempt.
+func (s *redisStore) queueOp(ctx context.Context, pipe redis.Pipeliner, op OutboxOp) error {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	pipe.HSet(ctx, s.key("outbox"), op.ID, data)
+	pipe.ZAdd(ctx, s.key("due"), redis.Z{Score: unixMilliScore(op.NextAttempt), Member: op.ID})
+	return nil
+}
+
+func (s *redisStore) unqueueOps(ctx context.Context, pipe redis.Pipeliner, ops []OutboxOp) {
+	for _, op := range ops {
+		pipe.HDel(ctx, s.key("outbox"), op.ID)
+		pipe.ZRem(ctx, s.key("due"), op.ID)
+	}
+}
+
+func (s *redisStore) deleteDead(ctx context.Context, pipe redis.Pipeliner, ops []OutboxOp) {
+	for _, op := range ops {
+		pipe.HDel(ctx, s.key("deadletters"), op.ID)
+	}
+}
+
+// active reports whether ip has an entry.
+func (s *redisStore) active(ctx context.Context, c redis.Cmdable, ip string) (bool, error) {
+	err := c.ZScore(ctx, s.key("entries"), ip).Err()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// record adds an event to the history, dropping what has outlived
+// HISTORY_RETENTION.
+func (s *redisStore) record(ctx context.Context, pipe redis.Pipeliner, ip, event string, expiry time.Time) error {
+	now := time.Now()
+	data, err := json.Marshal(newHistoryEvent(ip, event, now, expiry))
+	if err != nil {
+		return err
+	}
+	pipe.ZAdd(ctx, s.key("history"), redis.Z{Score: unixMilliScore(now), Member: data})
+	if cutoff := historyCutoff(now); !cutoff.IsZero() {
+		pipe.ZRemRangeByScore(ctx, s.key("history"), "-inf", fmt.Sprintf("(%d", cutoff.UnixMilli()))
+	}
+	return nil
+}
+
+func (s *redisStore) History(ip string, from, to time.Time) ([]HistoryEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	by := &redis.ZRangeBy{Min: "-inf", Max: "+inf"}
+	if !from.IsZero() {
+		by.Min = fmt.Sprint(from.UnixMilli())
+	}
+	if !to.IsZero() {
+		by.Max = fmt.Sprint(to.UnixMilli())
+	}
+	members, err := s.client.ZRangeByScore(ctx, s.key("history"), by).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var events []HistoryEvent
+	for _, m := range members {
+		var e HistoryEvent
+		if err := json.Unmarshal([]byte(m), &e); err != nil {
+			return nil, err
+		}
+		// The score has millisecond precision only
+		if (ip == "" || e.IP == ip) && inRange(e.At, from, to) {
+			events = append(events, e)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At.Before(events[j].At) })
+	return events, nil
+}
+
+func (s *redisStore) Expiry(ip string) (time.Time, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	score, err := s.client.ZScore(ctx, s.key("entries"), ip).Result()
+	if errors.Is(err, redis.Nil) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("store: looking up %s failed: %w", ip, err)
+	}
+	return time.UnixMilli(int64(score)), true, nil
+}
+
+func (s *redisStore) Expiries() (map[string]time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	members, err := s.client.ZRangeWithScores(ctx, s.key("entries"), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("store: listing entries failed: %w", err)
+	}
+	entries := make(map[string]time.Time, len(members))
+	for _, m := range members {
+		entries[m.Member.(string)] = time.UnixMilli(int64(m.Score))
+	}
+	return entries, nil
+}
+
+// entry builds the entry for ip from the entries, rules and meta keys.
+func (s *redisStore) entry(ctx context.Context, c redis.Cmdable, ip string, score float64) (Entry, error) {
+	e := Entry{IP: ip, ExpiresAt: time.UnixMilli(int64(score))}
+	ruleID, err := c.HGet(ctx, s.key("rules"), ip).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return e, err
+	}
+	e.RuleID = ruleID
+	meta, err := c.HGet(ctx, s.key("meta"), ip).Result()
+	if errors.Is(err, redis.Nil) {
+		return e, nil
+	}
+	if err != nil {
+		return e, err
+	}
+	return e, json.Unmarshal([]byte(meta), &e.EntryMeta)
+}
+
+func (s *redisStore) Entry(ip string) (Entry, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	score, err := s.client.ZScore(ctx, s.key("entries"), ip).Result()
+	if errors.Is(err, redis.Nil) {
+		return Entry{}, false, nil
+	}
+	var e Entry
+	if err == nil {
+		e, err = s.entry(ctx, s.client, ip, score)
+	}
+	if err != nil {
+		return Entry{}, false, fmt.Errorf("store: looking up %s failed: %w", ip, err)
+	}
+	return e, true, nil
+}
+
+func (s *redisStore) ListEntries() ([]Entry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	members, err := s.client.ZRangeWithScores(ctx, s.key("entries"), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("store: listing entries failed: %w", err)
+	}
+	entries := make([]Entry, 0, len(members))
+	for _, m := range members {
+		e, err := s.entry(ctx, s.client, m.Member.(string), m.Score)
+		if err != nil {
+			return nil, fmt.Errorf("store: listing entries failed: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].IP < entries[j].IP })
+	return entries, nil
+}
+
+func (s *redisStore) Add(ip string, expiry time.Time, meta EntryMeta) error {
+	return s.AddWithRule(ip, expiry, "", meta)
+}
+
+func (s *redisStore) AddWithRule(ip string, expiry time.Time, ruleID string, meta EntryMeta) error {
+	return s.update("adding "+ip, func(ctx context.Context, tx *redis.Tx) error {
+		pending, dead, err := s.opsFor(ctx, tx, ip)
+		if err != nil {
+			return err
+		}
+		event := HistoryWhitelisted
+		if score, err := tx.ZScore(ctx, s.key("entries"), ip).Result(); err == nil {
+			event = HistoryExtended
+			existing, err := s.entry(ctx, tx, ip, score)
+			if err != nil {
+				return err
+			}
+			meta = existing.EntryMeta
+			meta.Extensions++
+		} else if !errors.Is(err, redis.Nil) {
+			return err
+		} else if meta.CreatedAt.IsZero() {
+			meta.CreatedAt = time.Now()
+		}
+		metaJSON, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZAdd(ctx, s.key("entries"), redis.Z{Score: unixMilliScore(expiry), Member: ip})
+			pipe.HSet(ctx, s.key("meta"), ip, metaJSON)
+			if err := s.record(ctx, pipe, ip, event, expiry); err != nil {
+				return err
+			}
+			if ruleID != "" {
+				pipe.HSet(ctx, s.key("rules"), ip, ruleID)
+			}
+			s.unqueueOps(ctx, pipe, pending)
+			s.deleteDead(ctx, pipe, dead)
+			return nil
+		})
+		return err
+	})
+}
+
+func (s *redisStore) SetRuleID(ip, ruleID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := s.client.HSet(ctx, s.key("rules"), ip, ruleID).Err(); err != nil {
+		return fmt.Errorf("store: recording rule ID of %s failed: %w", ip, err)
+	}
+	return nil
+}
+
+func (s *redisStore) RuleID(ip string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	ruleID, err := s.client.HGet(ctx, s.key("rules"), ip).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return "", fmt.Errorf("store: looking up rule ID of %s failed: %w", ip, err)
+	}
+	return ruleID, nil
+}
+
+func (s *redisStore) Remove(ip string) error {
+	return s.remove(ip, HistoryRemoved)
+}
+
+func (s *redisStore) Expire(ip string) error {
+	return s.remove(ip, HistoryExpired)
+}
+
+func (s *redisStore) remove(ip, event string) error {
+	return s.update("removing "+ip, func(ctx context.Context, tx *redis.Tx) error {
+		pending, dead, err := s.opsFor(ctx, tx, ip)
+		if err != nil {
+			return err
+		}
+		active, err := s.active(ctx, tx, ip)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZRem(ctx, s.key("entries"), ip)
+			pipe.HDel(ctx, s.key("rules"), ip)
+			pipe.HDel(ctx, s.key("meta"), ip)
+			s.unqueueOps(ctx, pipe, pending)
+			s.deleteDead(ctx, pipe, dead)
+			if active {
+				return s.record(ctx, pipe, ip, event, time.Time{})
+			}
+			return nil
+		})
+		return err
+	})
+}
+
+func (s *redisStore) Owns(ip string) (bool, error) {
+	if _, ok, err := s.Expiry(ip); ok || err != nil {
+		return ok, err
+	}
+	queued, err := s.QueuedRemovals()
+	if err != nil {
+		return false, err
+	}
+	for _, q := range queued {
+		if q == ip {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *redisStore) EnqueueRemoval(ip string, lastErr error) error {
+	now := time.Now()
+	return s.update("queueing removal of "+ip, func(ctx context.Context, tx *redis.Tx) error {
+		op := OutboxOp{
+			ID:          newID(),
+			Kind:        OutboxRemove,
+			IP:          ip,
+			CreatedAt:   now,
+			Attempts:    1,
+			NextAttempt: now.Add(outboxBackoff(1)),
+		}
+		if lastErr != nil {
+			op.LastError = lastErr.Error()
+		}
+		ruleID, err := tx.HGet(ctx, s.key("rules"), ip).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+		op.RuleID = ruleID
+		pending, _, err := s.opsFor(ctx, tx, ip)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZRem(ctx, s.key("entries"), ip)
+			pipe.HDel(ctx, s.key("meta"), ip)
+			s.unqueueOps(ctx, pipe, pending)
+			return s.queueOp(ctx, pipe, op)
+		})
+		return err
+	})
+}
+
+func (s *redisStore) EnqueueAdd(ip string, expiry time.Time) error {
+	now := time.Now()
+	return s.update("queueing add of "+ip, func(ctx context.Context, tx *redis.Tx) error {
+		pending, dead, err := s.opsFor(ctx, tx, ip)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 || len(dead) > 0 {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return s.queueOp(ctx, pipe, OutboxOp{
+				ID:          newID(),
+				Kind:        OutboxAdd,
+				IP:          ip,
+				ExpiresAt:   expiry,
+				CreatedAt:   now,
+				NextAttempt: now,
+			})
+		})
+		return err
+	})
+}
+
+func (s *redisStore) QueuedRemovals() ([]string, error) {
+	pending, dead, err := s.QueuedOps()
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, op := range append(pending, dead...) {
+		if op.Kind == OutboxRemove {
+			ips = append(ips, op.IP)
+		}
+	}
+	return ips, nil
+}
+
+func (s *redisStore) DueOps(now time.Time) ([]OutboxOp, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	ids, err := s.client.ZRangeByScore(ctx, s.key("due"), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: fmt.Sprint(now.UnixMilli()),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("store: listing due operations failed: %w", err)
+	}
+
+	var due []OutboxOp
+	for _, id := range ids {
+		op, err := s.getOp(ctx, s.client, "outbox", id)
+		if err != nil {
+			return nil, fmt.Errorf("store: loading operation %s failed: %w", id, err)
+		}
+		// The score has millisecond precision only
+		if op != nil && !now.Before(op.NextAttempt) {
+			due = append(due, *op)
+		}
+	}
+	return due, nil
+}
+
+func (s *redisStore) QueuedOps() (pending, dead []OutboxOp, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if pending, err = s.loadOps(ctx, s.client, "outbox"); err != nil {
+		return nil, nil, fmt.Errorf("store: listing the outbox failed: %w", err)
+	}
+	if dead, err = s.loadOps(ctx, s.client, "deadletters"); err != nil {
+		return nil, nil, fmt.Errorf("store: listing dead letters failed: %w", err)
+	}
+	return pending, dead, nil
+}
+
+// CompleteOp removes a finished operation, queued or dead-lettered.
+// Completing a removal also forgets the rule ID and records the expired
+// event, unless ip was whitelisted again in the meantime.
+func (s *redisStore) CompleteOp(id string) error {
+	return s.update("completing operation "+id, func(ctx context.Context, tx *redis.Tx) error {
+		op, err := s.getOp(ctx, tx, "outbox", id)
+		if err != nil {
+			return err
+		}
+		dead := false
+		if op == nil {
+			if op, err = s.getOp(ctx, tx, "deadletters", id); err != nil || op == nil {
+				return err
+			}
+			dead = true
+		}
+		active, err := s.active(ctx, tx, op.IP)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if dead {
+				s.deleteDead(ctx, pipe, []OutboxOp{*op})
+			} else {
+				s.unqueueOps(ctx, pipe, []OutboxOp{*op})
+			}
+			if op.Kind == OutboxRemove && !active {
+				pipe.HDel(ctx, s.key("rules"), op.IP)
+				return s.record(ctx, pipe, op.IP, HistoryExpired, time.Time{})
+			}
+			return nil
+		})
+		return err
+	})
+}
+
+func (s *redisStore) FailOp(id string, opErr error, now time.Time) error {
+	return s.update("recording failure of operation "+id, func(ctx context.Context, tx *redis.Tx) error {
+		op, err := s.getOp(ctx, tx, "outbox", id)
+		if err != nil || op == nil {
+			return err
+		}
+		op.Attempts++
+		op.LastError = opErr.Error()
+		op.NextAttempt = now.Add(outboxBackoff(op.Attempts))
+		dead := op.Attempts >= outboxMaxAttempts
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if !dead {
+				return s.queueOp(ctx, pipe, *op)
+			}
+			data, err := json.Marshal(op)
+			if err != nil {
+				return err
+			}
+			s.unqueueOps(ctx, pipe, []OutboxOp{*op})
+			pipe.HSet(ctx, s.key("deadletters"), op.ID, data)
+			return nil
+		})
+		return err
+	})
+}
+
+func (s *redisStore) RetryDeadLetter(id string) (bool, error) {
+	found := false
+	err := s.update("requeueing operation "+id, func(ctx context.Context, tx *redis.Tx) error {
+		op, err := s.getOp(ctx, tx, "deadletters", id)
+		if err != nil || op == nil {
+			return err
+		}
+		pending, _, err := s.opsFor(ctx, tx, op.IP)
+		if err != nil {
+			return err
+		}
+		op.Attempts = 0
+		op.NextAttempt = time.Now()
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			s.unqueueOps(ctx, pipe, pending)
+			s.deleteDead(ctx, pipe, []OutboxOp{*op})
+			return s.queueOp(ctx, pipe, *op)
+		})
+		found = err == nil
+		return err
+	})
+	return found && err == nil, err
+}
+
+// API keys and TOTP enrollments are independent of each other and of the
+// entries, so they are written without a transaction, except where a
+// TOTP code or recovery code is used up.
+
+func (s *redisStore) SaveAPIKey(key APIKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	if err := s.client.HSet(ctx, s.key("apikeys"), key.ID, data).Err(); err != nil {
+		return fmt.Errorf("store: saving API key %s failed: %w", key.ID, err)
+	}
+	return nil
+}
+
+func (s *redisStore) APIKey(id string) (APIKey, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	data, err := s.client.HGet(ctx, s.key("apikeys"), id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return APIKey{}, false, nil
+	}
+	var key APIKey
+	if err == nil {
+		err = json.Unmarshal(data, &key)
+	}
+	if err != nil {
+		return APIKey{}, false, fmt.Errorf("store: looking up API key %s failed: %w", id, err)
+	}
+	return key, true, nil
+}
+
+func (s *redisStore) ListAPIKeys() ([]APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	all, err := s.client.HGetAll(ctx, s.key("apikeys")).Result()
+	if err != nil {
+		return nil, fmt.Errorf("store: listing API keys failed: %w", err)
+	}
+	keys := []APIKey{}
+	for id, data := range all {
+		var key APIKey
+		if err := json.Unmarshal([]byte(data), &key); err != nil {
+			log.Printf("Store: skipping unreadable API key %s: %v", id, err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sortAPIKeys(keys)
+	return keys, nil
+}
+
+func (s *redisStore) RevokeAPIKey(id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	n, err := s.client.HDel(ctx, s.key("apikeys"), id).Result()
+	if err != nil {
+		return false, fmt.Errorf("store: revoking API key %s failed: %w", id, err)
+	}
+	return n > 0, nil
+}
+
+func (s *redisStore) SaveTOTP(e TOTPEnrollment) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := s.client.HSet(ctx, s.key("totp"), e.User, data).Err(); err != nil {
+		return fmt.Errorf("store: saving TOTP enrollment of %s failed: %w", e.User, err)
+	}
+	return nil
+}
+
+func (s *redisStore) TOTP(user string) (TOTPEnrollment, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	e, ok, err := s.loadTOTP(ctx, s.client, user)
+	if err != nil {
+		return TOTPEnrollment{}, false, fmt.Errorf("store: looking up TOTP enrollment of %s failed: %w", user, err)
+	}
+	return e, ok, nil
+}
+
+func (s *redisStore) loadTOTP(ctx context.Context, c redis.Cmdable, user string) (TOTPEnrollment, bool, error) {
+	data, err := c.HGet(ctx, s.key("totp"), user).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return TOTPEnrollment{}, false, nil
+	}
+	if err != nil {
+		return TOTPEnrollment{}, false, err
+	}
+	var e TOTPEnrollment
+	if err := json.Unmarshal(data, &e); err != nil {
+		return TOTPEnrollment{}, false, err
+	}
+	return e, true, nil
+}
+
+func (s *redisStore) DeleteTOTP(user string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	n, err := s.client.HDel(ctx, s.key("totp"), user).Result()
+	if err != nil {
+		return false, fmt.Errorf("store: deleting TOTP enrollment of %s failed: %w", user, err)
+	}
+	return n > 0, nil
+}
+
+// updateTOTP applies fn to the enrollment of user in a transaction
+// watching the totp hash, so two replicas cannot both accept one code.
+// It reports whether fn changed the enrollment.
+func (s *redisStore) updateTOTP(what, user string, fn func(e *TOTPEnrollment) bool) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	var changed bool
+	var err error
+	for i := 0; i < redisMaxRetries; i++ {
+		err = s.client.Watch(ctx, func(tx *redis.Tx) error {
+			e, ok, err := s.loadTOTP(ctx, tx, user)
+			if err != nil || !ok {
+				changed = false
+				return err
+			}
+			if changed = fn(&e); !changed {
+				return nil
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.HSet(ctx, s.key("totp"), user, data)
+				return nil
+			})
+			return err
+		}, s.key("totp"))
+		if !errors.Is(err, redis.TxFailedErr) {
+			break
+		}
+	}
+	if err != nil {
+		return false, fmt.Errorf("store: %s failed: %w", what, err)
+	}
+	return changed, nil
+}
+
+func (s *redisStore) UseTOTPStep(user string, step int64) (bool, error) {
+	return s.updateTOTP("recording TOTP use of "+user, user, func(e *TOTPEnrollment) bool {
+		if step <= e.LastStep {
+			return false
+		}
+		e.LastStep = step
+		return true
+	})
+}
+
+func (s *redisStore) UseRecoveryCode(user, hash string) (bool, error) {
+	return s.updateTOTP("using a recovery code of "+user, user, func(e *TOTPEnrollment) bool {
+		var used bool
+		e.RecoveryCodes, used = removeRecoveryCode(e.RecoveryCodes, hash)
+		return used
+	})
+}
+
+// acquireLease sets KEYS[1] to ARGV[1] for ARGV[2] ms unless another holder
+// has it, and renews it for the current holder.
+var acquireLease = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return 1
+end
+return 0`)
+
+// Acquire takes or renews the "leader" lease key.
+func (s *redisStore) Acquire(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	held, err := acquireLease.Run(ctx, s.client, []string{s.key("leader")}, id, ttl.Milliseconds()).Int()
+	return held == 1, err
+}
+
+// ImportJSON copies a whitelist_store.json into Redis, once: the import is
+// recorded under the "json_imported" key and later calls (from any replica)
+// do nothing. A missing file is not an error. The file is left in place.
+func (s *redisStore) ImportJSON(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	claimed, err := s.client.SetNX(ctx, s.key("json_imported"), time.Now().UTC().Format(time.RFC3339), 0).Result()
+	if err != nil || !claimed {
+		return err
+	}
+
+	src := &WhitelistStore{Entries: make(map[string]time.Time)}
+	if err := src.loadFrom(path); err != nil {
+		s.client.Del(ctx, s.key("json_imported"))
+		return err
+	}
+	entries, err := src.ListEntries()
+	if err != nil {
+		s.client.Del(ctx, s.key("json_imported"))
+		return err
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, e := range entries {
+			meta, err := json.Marshal(e.EntryMeta)
+			if err != nil {
+				return err
+			}
+			pipe.ZAdd(ctx, s.key("entries"), redis.Z{Score: unixMilliScore(e.ExpiresAt), Member: e.IP})
+			pipe.HSet(ctx, s.key("meta"), e.IP, meta)
+		}
+		for _, e := range src.importedHistory() {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			pipe.ZAdd(ctx, s.key("history"), redis.Z{Score: unixMilliScore(e.At), Member: data})
+		}
+		for ip, ruleID := range src.RuleIDs {
+			pipe.HSet(ctx, s.key("rules"), ip, ruleID)
+		}
+		for _, op := range src.Outbox {
+			if err := s.queueOp(ctx, pipe, *op); err != nil {
+				return err
+			}
+		}
+		for _, op := range src.DeadLetters {
+			data, err := json.Marshal(op)
+			if err != nil {
+				return err
+			}
+			pipe.HSet(ctx, s.key("deadletters"), op.ID, data)
+		}
+		for _, key := range src.APIKeys {
+			data, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			pipe.HSet(ctx, s.key("apikeys"), key.ID, data)
+		}
+		for _, e := range src.TOTPEnrollments {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			pipe.HSet(ctx, s.key("totp"), e.User, data)
+		}
+		return nil
+	})
+	if err != nil {
+		s.client.Del(ctx, s.key("json_imported"))
+		return err
+	}
+	log.Printf("Store: imported %d entries from %s", len(src.Entries), path)
+	return nil
+}
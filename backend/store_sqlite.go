@@ -0,0 +1,879 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are applied in order; the schema version is the number
+// of migrations applied. Never edit a released migration, append a new one.
+var sqliteMigrations = []string{
+	// 1: initial schema
+	`CREATE TABLE entries (
+		ip         TEXT PRIMARY KEY,
+		expires_at INTEGER NOT NULL,
+		rule_id    TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE outbox (
+		id           TEXT PRIMARY KEY,
+		kind         TEXT NOT NULL,
+		ip           TEXT NOT NULL,
+		rule_id      TEXT NOT NULL DEFAULT '',
+		expires_at   INTEGER NOT NULL DEFAULT 0,
+		created_at   INTEGER NOT NULL,
+		attempts     INTEGER NOT NULL DEFAULT 0,
+		next_attempt INTEGER NOT NULL,
+		last_error   TEXT NOT NULL DEFAULT '',
+		dead         INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX outbox_ip ON outbox (ip);
+	CREATE TABLE history (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		ip         TEXT NOT NULL,
+		event      TEXT NOT NULL,
+		at         INTEGER NOT NULL,
+		expires_at INTEGER
+	);
+	CREATE INDEX history_ip_at ON history (ip, at);
+	CREATE TABLE audit (
+		id     INTEGER PRIMARY KEY AUTOINCREMENT,
+		at     INTEGER NOT NULL,
+		action TEXT NOT NULL,
+		ip     TEXT NOT NULL DEFAULT '',
+		detail TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE meta (
+		key   TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`,
+	// 2: leader election
+	`CREATE TABLE leases (
+		name       TEXT PRIMARY KEY,
+		holder     TEXT NOT NULL,
+		expires_at INTEGER NOT NULL
+	);`,
+	// 3: entry metadata; created_at 0 means unknown
+	`ALTER TABLE entries ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE entries ADD COLUMN created_by TEXT NOT NULL DEFAULT '';
+	ALTER TABLE entries ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+	ALTER TABLE entries ADD COLUMN reason TEXT NOT NULL DEFAULT '';
+	ALTER TABLE entries ADD COLUMN ticket TEXT NOT NULL DEFAULT '';
+	ALTER TABLE entries ADD COLUMN extensions INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE entries ADD COLUMN backend TEXT NOT NULL DEFAULT '';`,
+	// 4: the audit log (AUDIT_LOG) records mutations instead
+	`DROP TABLE audit;`,
+	// 5: API keys; scopes are space-separated, expires_at 0 means never
+	`CREATE TABLE api_keys (
+		id           TEXT PRIMARY KEY,
+		name         TEXT NOT NULL,
+		hash         TEXT NOT NULL,
+		scopes       TEXT NOT NULL,
+		max_duration TEXT NOT NULL DEFAULT '',
+		expires_at   INTEGER NOT NULL DEFAULT 0,
+		created_at   INTEGER NOT NULL,
+		created_by   TEXT NOT NULL DEFAULT ''
+	);`,
+	// 6: TOTP enrollments; recovery_codes are space-separated hashes
+	`CREATE TABLE totp (
+		owner          TEXT PRIMARY KEY,
+		secret         TEXT NOT NULL,
+		confirmed      INTEGER NOT NULL DEFAULT 0,
+		last_step      INTEGER NOT NULL DEFAULT 0,
+		recovery_codes TEXT NOT NULL DEFAULT '',
+		created_at     INTEGER NOT NULL
+	);`,
+}
+
+// sqliteStore is the Store kept in a SQLite database (SQLITE_PATH). Besides
+// entries and the outbox it records a per-IP history of whitelist changes.
+//
+// Timestamps are stored as Unix nanoseconds.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; one connection avoids SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	s := &sqliteStore{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+// migrate brings the schema up to date, one transaction per migration.
+func (s *sqliteStore) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`); err != nil {
+		return err
+	}
+
+	var current int
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	if current > len(sqliteMigrations) {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d)", current, len(sqliteMigrations))
+	}
+
+	for version := current + 1; version <= len(sqliteMigrations); version++ {
+		err := s.tx(func(tx *sql.Tx) error {
+			if _, err := tx.Exec(sqliteMigrations[version-1]); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, time.Now().UnixNano())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d failed: %w", version, err)
+		}
+		log.Printf("Store: applied schema migration %d", version)
+	}
+	return nil
+}
+
+// SchemaVersion returns the number of migrations applied.
+func (s *sqliteStore) SchemaVersion() (int, error) {
+	var version int
+	err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+func (s *sqliteStore) tx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// update runs fn in a transaction, describing what failed in the error.
+func (s *sqliteStore) update(what string, fn func(tx *sql.Tx) error) error {
+	if err := s.tx(fn); err != nil {
+		return fmt.Errorf("store: %s failed: %w", what, err)
+	}
+	return nil
+}
+
+// recordHistory adds an event to the history, dropping what has outlived
+// HISTORY_RETENTION.
+func recordHistory(tx *sql.Tx, ip, event string, expiry time.Time) error {
+	now := time.Now()
+	var expiresAt interface{}
+	if !expiry.IsZero() {
+		expiresAt = expiry.UnixNano()
+	}
+	if _, err := tx.Exec(`INSERT INTO history (ip, event, at, expires_at) VALUES (?, ?, ?, ?)`,
+		ip, event, now.UnixNano(), expiresAt); err != nil {
+		return err
+	}
+	if cutoff := historyCutoff(now); !cutoff.IsZero() {
+		if _, err := tx.Exec(`DELETE FROM history WHERE at < ?`, cutoff.UnixNano()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) History(ip string, from, to time.Time) ([]HistoryEvent, error) {
+	query := `SELECT ip, event, at, expires_at FROM history WHERE at >= ? AND at <= ?`
+	args := []interface{}{unixNano(from), int64(math.MaxInt64)}
+	if !to.IsZero() {
+		args[1] = to.UnixNano()
+	}
+	if ip != "" {
+		query += ` AND ip = ?`
+		args = append(args, ip)
+	}
+	rows, err := s.db.Query(query+` ORDER BY at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []HistoryEvent
+	for rows.Next() {
+		var e HistoryEvent
+		var at int64
+		var expiresAt sql.NullInt64
+		if err := rows.Scan(&e.IP, &e.Event, &at, &expiresAt); err != nil {
+			return nil, err
+		}
+		e.At = fromUnixNano(at)
+		if expiresAt.Valid {
+			t := fromUnixNano(expiresAt.Int64)
+			e.ExpiresAt = &t
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func (s *sqliteStore) Expiry(ip string) (time.Time, bool, error) {
+	var expiresAt int64
+	err := s.db.QueryRow(`SELECT expires_at FROM entries WHERE ip = ?`, ip).Scan(&expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("store: looking up %s failed: %w", ip, err)
+	}
+	return fromUnixNano(expiresAt), true, nil
+}
+
+func (s *sqliteStore) Expiries() (map[string]time.Time, error) {
+	rows, err := s.db.Query(`SELECT ip, expires_at FROM entries`)
+	if err != nil {
+		return nil, fmt.Errorf("store: listing entries failed: %w", err)
+	}
+	defer rows.Close()
+	entries := map[string]time.Time{}
+	for rows.Next() {
+		var ip string
+		var expiresAt int64
+		if err := rows.Scan(&ip, &expiresAt); err != nil {
+			return nil, fmt.Errorf("store: listing entries failed: %w", err)
+		}
+		entries[ip] = fromUnixNano(expiresAt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("store: listing entries failed: %w", err)
+	}
+	return entries, nil
+}
+
+const entryColumns = `ip, expires_at, rule_id, created_at, created_by, user_agent, reason, ticket, extensions, backend`
+
+func scanEntry(row interface{ Scan(...interface{}) error }) (Entry, error) {
+	var e Entry
+	var expiresAt, createdAt int64
+	err := row.Scan(&e.IP, &expiresAt, &e.RuleID, &createdAt, &e.CreatedBy, &e.UserAgent,
+		&e.Reason, &e.Ticket, &e.Extensions, &e.Backend)
+	e.ExpiresAt = fromUnixNano(expiresAt)
+	e.CreatedAt = fromUnixNano(createdAt)
+	return e, err
+}
+
+func (s *sqliteStore) Entry(ip string) (Entry, bool, error) {
+	e, err := scanEntry(s.db.QueryRow(`SELECT `+entryColumns+` FROM entries WHERE ip = ?`, ip))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, fmt.Errorf("store: looking up %s failed: %w", ip, err)
+	}
+	return e, true, nil
+}
+
+func (s *sqliteStore) ListEntries() ([]Entry, error) {
+	rows, err := s.db.Query(`SELECT ` + entryColumns + ` FROM entries ORDER BY ip`)
+	if err != nil {
+		return nil, fmt.Errorf("store: listing entries failed: %w", err)
+	}
+	defer rows.Close()
+	entries := []Entry{}
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("store: listing entries failed: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("store: listing entries failed: %w", err)
+	}
+	return entries, nil
+}
+
+func insertEntry(tx *sql.Tx, e Entry) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO entries (`+entryColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.IP, e.ExpiresAt.UnixNano(), e.RuleID, unixNano(e.CreatedAt), e.CreatedBy, e.UserAgent,
+		e.Reason, e.Ticket, e.Extensions, e.Backend)
+	return err
+}
+
+func (s *sqliteStore) Add(ip string, expiry time.Time, meta EntryMeta) error {
+	return s.AddWithRule(ip, expiry, "", meta)
+}
+
+func (s *sqliteStore) AddWithRule(ip string, expiry time.Time, ruleID string, meta EntryMeta) error {
+	return s.update("adding "+ip, func(tx *sql.Tx) error {
+		var existing string
+		err := tx.QueryRow(`SELECT rule_id FROM entries WHERE ip = ?`, ip).Scan(&existing)
+		exists := err == nil
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		if ruleID == "" {
+			ruleID = existing
+		}
+		if ruleID == "" {
+			// Re-whitelisted while its removal was queued: the rule is still ours
+			err := tx.QueryRow(`SELECT rule_id FROM outbox WHERE ip = ? AND kind = ? ORDER BY rowid DESC LIMIT 1`, ip, OutboxRemove).Scan(&ruleID)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
+
+		if exists {
+			_, err = tx.Exec(`UPDATE entries SET expires_at = ?, rule_id = ?, extensions = extensions + 1 WHERE ip = ?`,
+				expiry.UnixNano(), ruleID, ip)
+		} else {
+			if meta.CreatedAt.IsZero() {
+				meta.CreatedAt = time.Now()
+			}
+			err = insertEntry(tx, Entry{IP: ip, ExpiresAt: expiry, RuleID: ruleID, EntryMeta: meta})
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM outbox WHERE ip = ?`, ip); err != nil {
+			return err
+		}
+
+		event := HistoryWhitelisted
+		if exists {
+			event = HistoryExtended
+		}
+		if err := recordHistory(tx, ip, event, expiry); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStore) SetRuleID(ip, ruleID string) error {
+	return s.update("recording rule ID of "+ip, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE entries SET rule_id = ? WHERE ip = ?`, ruleID, ip)
+		return err
+	})
+}
+
+func (s *sqliteStore) RuleID(ip string) (string, error) {
+	var ruleID string
+	err := s.db.QueryRow(`SELECT rule_id FROM entries WHERE ip = ?
+		UNION ALL SELECT rule_id FROM outbox WHERE ip = ? AND kind = ?
+		LIMIT 1`, ip, ip, OutboxRemove).Scan(&ruleID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("store: looking up rule ID of %s failed: %w", ip, err)
+	}
+	return ruleID, nil
+}
+
+func (s *sqliteStore) Remove(ip string) error {
+	return s.remove(ip, HistoryRemoved)
+}
+
+func (s *sqliteStore) Expire(ip string) error {
+	return s.remove(ip, HistoryExpired)
+}
+
+func (s *sqliteStore) remove(ip, event string) error {
+	return s.update("removing "+ip, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM entries WHERE ip = ?`, ip)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM outbox WHERE ip = ?`, ip); err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			if err := recordHistory(tx, ip, event, time.Time{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStore) Owns(ip string) (bool, error) {
+	var owned bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM entries WHERE ip = ?)
+		OR EXISTS (SELECT 1 FROM outbox WHERE ip = ? AND kind = ?)`, ip, ip, OutboxRemove).Scan(&owned)
+	if err != nil {
+		return false, fmt.Errorf("store: ownership check of %s failed: %w", ip, err)
+	}
+	return owned, nil
+}
+
+// enqueue queues op, replacing anything still queued (not dead) for its IP.
+func enqueue(tx *sql.Tx, op OutboxOp) error {
+	if _, err := tx.Exec(`DELETE FROM outbox WHERE ip = ? AND dead = 0`, op.IP); err != nil {
+		return err
+	}
+	return insertOp(tx, op, false)
+}
+
+func insertOp(tx *sql.Tx, op OutboxOp, dead bool) error {
+	_, err := tx.Exec(`INSERT INTO outbox (id, kind, ip, rule_id, expires_at, created_at, attempts, next_attempt, last_error, dead)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		op.ID, op.Kind, op.IP, op.RuleID, unixNano(op.ExpiresAt), unixNano(op.CreatedAt),
+		op.Attempts, unixNano(op.NextAttempt), op.LastError, dead)
+	return err
+}
+
+func (s *sqliteStore) EnqueueRemoval(ip string, lastErr error) error {
+	now := time.Now()
+	return s.update("queueing removal of "+ip, func(tx *sql.Tx) error {
+		op := OutboxOp{
+			ID:          newID(),
+			Kind:        OutboxRemove,
+			IP:          ip,
+			CreatedAt:   now,
+			Attempts:    1,
+			NextAttempt: now.Add(outboxBackoff(1)),
+		}
+		if lastErr != nil {
+			op.LastError = lastErr.Error()
+		}
+		err := tx.QueryRow(`SELECT rule_id FROM entries WHERE ip = ?`, ip).Scan(&op.RuleID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM entries WHERE ip = ?`, ip); err != nil {
+			return err
+		}
+		return enqueue(tx, op)
+	})
+}
+
+func (s *sqliteStore) EnqueueAdd(ip string, expiry time.Time) error {
+	now := time.Now()
+	return s.update("queueing add of "+ip, func(tx *sql.Tx) error {
+		var queued bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM outbox WHERE ip = ?)`, ip).Scan(&queued); err != nil {
+			return err
+		}
+		if queued {
+			return nil
+		}
+		if err := enqueue(tx, OutboxOp{
+			ID:          newID(),
+			Kind:        OutboxAdd,
+			IP:          ip,
+			ExpiresAt:   expiry,
+			CreatedAt:   now,
+			NextAttempt: now,
+		}); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStore) QueuedRemovals() ([]string, error) {
+	rows, err := s.db.Query(`SELECT ip FROM outbox WHERE kind = ? ORDER BY rowid`, OutboxRemove)
+	if err != nil {
+		return nil, fmt.Errorf("store: listing queued removals failed: %w", err)
+	}
+	defer rows.Close()
+	var ips []string
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			return nil, fmt.Errorf("store: listing queued removals failed: %w", err)
+		}
+		ips = append(ips, ip)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("store: listing queued removals failed: %w", err)
+	}
+	return ips, nil
+}
+
+const outboxColumns = `id, kind, ip, rule_id, expires_at, created_at, attempts, next_attempt, last_error`
+
+func (s *sqliteStore) queryOps(query string, args ...interface{}) ([]OutboxOp, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ops := []OutboxOp{}
+	for rows.Next() {
+		var op OutboxOp
+		var expiresAt, createdAt, nextAttempt int64
+		if err := rows.Scan(&op.ID, &op.Kind, &op.IP, &op.RuleID, &expiresAt, &createdAt,
+			&op.Attempts, &nextAttempt, &op.LastError); err != nil {
+			return nil, err
+		}
+		op.ExpiresAt = fromUnixNano(expiresAt)
+		op.CreatedAt = fromUnixNano(createdAt)
+		op.NextAttempt = fromUnixNano(nextAttempt)
+		ops = append(ops, op)
+	}
+	return ops, rows.Err()
+}
+
+func (s *sqliteStore) DueOps(now time.Time) ([]OutboxOp, error) {
+	ops, err := s.queryOps(`SELECT `+outboxColumns+` FROM outbox WHERE dead = 0 AND next_attempt <= ? ORDER BY rowid`, now.UnixNano())
+	if err != nil {
+		return nil, fmt.Errorf("store: listing due operations failed: %w", err)
+	}
+	return ops, nil
+}
+
+func (s *sqliteStore) QueuedOps() (pending, dead []OutboxOp, err error) {
+	if pending, err = s.queryOps(`SELECT ` + outboxColumns + ` FROM outbox WHERE dead = 0 ORDER BY rowid`); err != nil {
+		return nil, nil, fmt.Errorf("store: listing the outbox failed: %w", err)
+	}
+	if dead, err = s.queryOps(`SELECT ` + outboxColumns + ` FROM outbox WHERE dead = 1 ORDER BY rowid`); err != nil {
+		return nil, nil, fmt.Errorf("store: listing dead letters failed: %w", err)
+	}
+	return pending, dead, nil
+}
+
+func (s *sqliteStore) CompleteOp(id string) error {
+	return s.update("completing operation "+id, func(tx *sql.Tx) error {
+		var kind, ip string
+		err := tx.QueryRow(`SELECT kind, ip FROM outbox WHERE id = ?`, id).Scan(&kind, &ip)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM outbox WHERE id = ?`, id); err != nil {
+			return err
+		}
+		if kind != OutboxRemove {
+			return nil
+		}
+		var active bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM entries WHERE ip = ?)`, ip).Scan(&active); err != nil || active {
+			return err
+		}
+		return recordHistory(tx, ip, HistoryExpired, time.Time{})
+	})
+}
+
+func (s *sqliteStore) FailOp(id string, opErr error, now time.Time) error {
+	return s.update("recording failure of operation "+id, func(tx *sql.Tx) error {
+		var attempts int
+		err := tx.QueryRow(`SELECT attempts FROM outbox WHERE id = ? AND dead = 0`, id).Scan(&attempts)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		attempts++
+		_, err = tx.Exec(`UPDATE outbox SET attempts = ?, last_error = ?, next_attempt = ?, dead = ? WHERE id = ?`,
+			attempts, opErr.Error(), now.Add(outboxBackoff(attempts)).UnixNano(), attempts >= outboxMaxAttempts, id)
+		return err
+	})
+}
+
+func (s *sqliteStore) RetryDeadLetter(id string) (bool, error) {
+	found := false
+	err := s.update("requeueing operation "+id, func(tx *sql.Tx) error {
+		var ip string
+		err := tx.QueryRow(`SELECT ip FROM outbox WHERE id = ? AND dead = 1`, id).Scan(&ip)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM outbox WHERE ip = ? AND dead = 0`, ip); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE outbox SET dead = 0, attempts = 0, next_attempt = ? WHERE id = ?`, time.Now().UnixNano(), id); err != nil {
+			return err
+		}
+		found = true
+		return nil
+	})
+	return found && err == nil, err
+}
+
+func insertAPIKey(tx *sql.Tx, key APIKey) error {
+	var expiresAt int64
+	if key.ExpiresAt != nil {
+		expiresAt = key.ExpiresAt.UnixNano()
+	}
+	_, err := tx.Exec(`INSERT INTO api_keys (id, name, hash, scopes, max_duration, expires_at, created_at, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		key.ID, key.Name, key.Hash, strings.Join(key.Scopes, " "), key.MaxDuration, expiresAt, unixNano(key.CreatedAt), key.CreatedBy)
+	return err
+}
+
+func (s *sqliteStore) SaveAPIKey(key APIKey) error {
+	return s.update("saving API key "+key.ID, func(tx *sql.Tx) error {
+		return insertAPIKey(tx, key)
+	})
+}
+
+const apiKeyColumns = `id, name, hash, scopes, max_duration, expires_at, created_at, created_by`
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (APIKey, error) {
+	var key APIKey
+	var scopes string
+	var expiresAt, createdAt int64
+	if err := row.Scan(&key.ID, &key.Name, &key.Hash, &scopes, &key.MaxDuration, &expiresAt, &createdAt, &key.CreatedBy); err != nil {
+		return APIKey{}, err
+	}
+	key.Scopes = strings.Fields(scopes)
+	if expiresAt != 0 {
+		t := time.Unix(0, expiresAt)
+		key.ExpiresAt = &t
+	}
+	key.CreatedAt = fromUnixNano(createdAt)
+	return key, nil
+}
+
+func (s *sqliteStore) APIKey(id string) (APIKey, bool, error) {
+	key, err := scanAPIKey(s.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, false, nil
+	}
+	if err != nil {
+		return APIKey{}, false, fmt.Errorf("store: looking up API key %s failed: %w", id, err)
+	}
+	return key, true, nil
+}
+
+func (s *sqliteStore) ListAPIKeys() ([]APIKey, error) {
+	rows, err := s.db.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY created_at, id`)
+	if err != nil {
+		return nil, fmt.Errorf("store: listing API keys failed: %w", err)
+	}
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("store: listing API keys failed: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("store: listing API keys failed: %w", err)
+	}
+	return keys, nil
+}
+
+func (s *sqliteStore) RevokeAPIKey(id string) (bool, error) {
+	found := false
+	err := s.update("revoking API key "+id, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM api_keys WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		found = n > 0
+		return err
+	})
+	return found && err == nil, err
+}
+
+func insertTOTP(tx *sql.Tx, e TOTPEnrollment) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO totp (owner, secret, confirmed, last_step, recovery_codes, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		e.User, e.Secret, e.Confirmed, e.LastStep, strings.Join(e.RecoveryCodes, " "), unixNano(e.CreatedAt))
+	return err
+}
+
+func (s *sqliteStore) SaveTOTP(e TOTPEnrollment) error {
+	return s.update("saving TOTP enrollment of "+e.User, func(tx *sql.Tx) error {
+		return insertTOTP(tx, e)
+	})
+}
+
+func (s *sqliteStore) TOTP(user string) (TOTPEnrollment, bool, error) {
+	e := TOTPEnrollment{User: user}
+	var codes string
+	var createdAt int64
+	err := s.db.QueryRow(`SELECT secret, confirmed, last_step, recovery_codes, created_at FROM totp WHERE owner = ?`, user).
+		Scan(&e.Secret, &e.Confirmed, &e.LastStep, &codes, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TOTPEnrollment{}, false, nil
+	}
+	if err != nil {
+		return TOTPEnrollment{}, false, fmt.Errorf("store: looking up TOTP enrollment of %s failed: %w", user, err)
+	}
+	e.RecoveryCodes = strings.Fields(codes)
+	e.CreatedAt = fromUnixNano(createdAt)
+	return e, true, nil
+}
+
+func (s *sqliteStore) DeleteTOTP(user string) (bool, error) {
+	found := false
+	err := s.update("deleting TOTP enrollment of "+user, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM totp WHERE owner = ?`, user)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		found = n > 0
+		return err
+	})
+	return found && err == nil, err
+}
+
+func (s *sqliteStore) UseTOTPStep(user string, step int64) (bool, error) {
+	used := false
+	err := s.update("recording TOTP use of "+user, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`UPDATE totp SET last_step = ? WHERE owner = ? AND last_step < ?`, step, user, step)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		used = n > 0
+		return err
+	})
+	return used && err == nil, err
+}
+
+func (s *sqliteStore) UseRecoveryCode(user, hash string) (bool, error) {
+	used := false
+	err := s.update("using a recovery code of "+user, func(tx *sql.Tx) error {
+		var codes string
+		err := tx.QueryRow(`SELECT recovery_codes FROM totp WHERE owner = ?`, user).Scan(&codes)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		left, found := removeRecoveryCode(strings.Fields(codes), hash)
+		if !found {
+			return nil
+		}
+		if _, err := tx.Exec(`UPDATE totp SET recovery_codes = ? WHERE owner = ?`, strings.Join(left, " "), user); err != nil {
+			return err
+		}
+		used = true
+		return nil
+	})
+	return used && err == nil, err
+}
+
+// Acquire takes or renews the "leader" lease row. SQLite has no advisory
+// locks; the upsert only replaces the holder once its lease has expired.
+func (s *sqliteStore) Acquire(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	res, err := s.db.ExecContext(ctx, `INSERT INTO leases (name, holder, expires_at) VALUES ('leader', ?, ?)
+		ON CONFLICT (name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+		WHERE leases.holder = excluded.holder OR leases.expires_at < ?`,
+		id, now.Add(ttl).UnixNano(), now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ImportJSON copies a whitelist_store.json into the database, once: the
+// import is recorded and later calls do nothing. A missing file is not an
+// error. The file itself is left in place.
+func (s *sqliteStore) ImportJSON(path string) error {
+	var imported string
+	err := s.db.QueryRow(`SELECT value FROM meta WHERE key = 'json_imported'`).Scan(&imported)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	src := &WhitelistStore{Entries: make(map[string]time.Time)}
+	if err := src.loadFrom(path); err != nil {
+		return err
+	}
+
+	entries, err := src.ListEntries()
+	if err != nil {
+		return err
+	}
+	err = s.tx(func(tx *sql.Tx) error {
+		for _, e := range entries {
+			if err := insertEntry(tx, e); err != nil {
+				return err
+			}
+		}
+		for _, e := range src.importedHistory() {
+			var expiresAt interface{}
+			if e.ExpiresAt != nil {
+				expiresAt = e.ExpiresAt.UnixNano()
+			}
+			if _, err := tx.Exec(`INSERT INTO history (ip, event, at, expires_at) VALUES (?, ?, ?, ?)`,
+				e.IP, e.Event, e.At.UnixNano(), expiresAt); err != nil {
+				return err
+			}
+		}
+		for _, op := range src.Outbox {
+			if err := insertOp(tx, *op, false); err != nil {
+				return err
+			}
+		}
+		for _, op := range src.DeadLetters {
+			if err := insertOp(tx, *op, true); err != nil {
+				return err
+			}
+		}
+		for _, key := range src.APIKeys {
+			if err := insertAPIKey(tx, *key); err != nil {
+				return err
+			}
+		}
+		for _, e := range src.TOTPEnrollments {
+			if err := insertTOTP(tx, *e); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`INSERT INTO meta (key, value) VALUES ('json_imported', ?)`, time.Now().UTC().Format(time.RFC3339))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Store: imported %d entries and %d operations from %s", len(src.Entries), len(src.Outbox)+len(src.DeadLetters), path)
+	return nil
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// testStoreBackends open a store of each backend in dir. Opening the same
+// dir again loads the same data, as after a restart.
+var testStoreBackends = []struct {
+	name string
+	open func(t *testing.T, dir string) Store
+}{
+	{"json", func(t *testing.T, dir string) Store {
+		storeFile = filepath.Join(dir, "whitelist_store.json")
+		s := &WhitelistStore{Entries: make(map[string]time.Time)}
+		if err := s.Load(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}},
+	{"sqlite", func(t *testing.T, dir string) Store {
+		s, err := openSQLiteStore(filepath.Join(dir, "whitelist.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}},
+	{"redis", func(t *testing.T, dir string) Store {
+		return openTestRedisStore(t, redisServerFor(t, dir).Addr())
+	}},
+}
+
+// redisServers holds one in-process Redis per test dir, so reopening a
+// redis store finds the same data.
+var redisServers = map[string]*miniredis.Miniredis{}
+
+func redisServerFor(t *testing.T, dir string) *miniredis.Miniredis {
+	if mr, ok := redisServers[dir]; ok {
+		return mr
+	}
+	mr := miniredis.RunT(t)
+	redisServers[dir] = mr
+	t.Cleanup(func() { delete(redisServers, dir) })
+	return mr
+}
+
+func openTestRedisStore(t *testing.T, addr string) *redisStore {
+	s, err := openRedisStore("redis://"+addr, "whitelist:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// ownsIP, ruleIDOf and expiriesOf read s for assertions, failing the test
+// if it cannot be read.
+func ownsIP(t *testing.T, s Store, ip string) bool {
+	t.Helper()
+	owned, err := s.Owns(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return owned
+}
+
+func ruleIDOf(t *testing.T, s Store, ip string) string {
+	t.Helper()
+	ruleID, err := s.RuleID(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ruleID
+}
+
+func expiriesOf(t *testing.T, s Store) map[string]time.Time {
+	t.Helper()
+	expiries, err := s.Expiries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expiries
+}
+
+// forEachStore runs fn against an empty store of every backend. fn may
+// swap the provider; both globals are restored afterwards.
+func forEachStore(t *testing.T, fn func(t *testing.T, reopen func() Store)) {
+	for _, backend := range testStoreBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			origStore, origStoreFile, origProvider := store, storeFile, provider
+			t.Cleanup(func() { store, storeFile, provider = origStore, origStoreFile, origProvider })
+
+			dir := t.TempDir()
+			store = backend.open(t, dir)
+			fn(t, func() Store { return backend.open(t, dir) })
+		})
+	}
+}
+
+func TestStoreEntries(t *testing.T) {
+	forEachStore(t, func(t *testing.T, reopen func() Store) {
+		expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+		store.AddWithRule("1.1.1.1", expiry, "rule-1", EntryMeta{})
+		store.Add("2.2.2.2", expiry, EntryMeta{})
+		// Extending keeps the rule ID
+		store.Add("1.1.1.1", expiry.Add(time.Hour), EntryMeta{})
+
+		store = reopen()
+		if got, ok, _ := store.Expiry("1.1.1.1"); !ok || !got.Equal(expiry.Add(time.Hour)) {
+			t.Errorf("Expiry(1.1.1.1) = %v, %v", got, ok)
+		}
+		if got := ruleIDOf(t, store, "1.1.1.1"); got != "rule-1" {
+			t.Errorf("RuleID(1.1.1.1) = %q, want rule-1", got)
+		}
+		var ips []string
+		for ip := range expiriesOf(t, store) {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+		if want := []string{"1.1.1.1", "2.2.2.2"}; !reflect.DeepEqual(ips, want) {
+			t.Errorf("Expiries() = %v, want %v", ips, want)
+		}
+
+		store.Remove("1.1.1.1")
+		store = reopen()
+		if _, ok, _ := store.Expiry("1.1.1.1"); ok || ruleIDOf(t, store, "1.1.1.1") != "" || ownsIP(t, store, "1.1.1.1") {
+			t.Error("removed entry still present")
+		}
+	})
+}
+
+func TestStoreQueuedRemovalKeepsOwnership(t *testing.T) {
+	forEachStore(t, func(t *testing.T, reopen func() Store) {
+		store.AddWithRule("1.1.1.1", time.Now().Add(time.Hour), "rule-1", EntryMeta{})
+		store.EnqueueRemoval("1.1.1.1", nil)
+
+		if _, ok, _ := store.Expiry("1.1.1.1"); ok {
+			t.Error("entry still active after EnqueueRemoval")
+		}
+		if !ownsIP(t, store, "1.1.1.1") || ruleIDOf(t, store, "1.1.1.1") != "rule-1" {
+			t.Error("queued removal lost ownership or rule ID")
+		}
+		if got, _ := store.QueuedRemovals(); !reflect.DeepEqual(got, []string{"1.1.1.1"}) {
+			t.Errorf("QueuedRemovals() = %v", got)
+		}
+
+		// Whitelisted again before the removal went through
+		store.Add("1.1.1.1", time.Now().Add(time.Hour), EntryMeta{})
+		if pending, _, _ := store.QueuedOps(); len(pending) != 0 {
+			t.Errorf("queued removal survived a new Add: %v", pending)
+		}
+		if ruleIDOf(t, store, "1.1.1.1") != "rule-1" {
+			t.Error("rule ID lost when whitelisted again")
+		}
+	})
+}
+
+func TestStoreCompleteOp(t *testing.T) {
+	forEachStore(t, func(t *testing.T, reopen func() Store) {
+		store.AddWithRule("1.1.1.1", time.Now().Add(time.Hour), "rule-1", EntryMeta{})
+		store.EnqueueRemoval("1.1.1.1", nil)
+		pending, _, _ := store.QueuedOps()
+
+		// Whitelisted again (e.g. on another replica) before the operation
+		// read earlier is completed: the new entry is left alone
+		store.Add("1.1.1.1", time.Now().Add(time.Hour), EntryMeta{})
+		if err := store.CompleteOp(pending[0].ID); err != nil {
+			t.Fatalf("CompleteOp() error: %v", err)
+		}
+		if _, ok, _ := store.Expiry("1.1.1.1"); !ok || ruleIDOf(t, store, "1.1.1.1") != "rule-1" {
+			t.Error("completing an obsolete removal touched the new entry")
+		}
+
+		// Dead letters can be completed too
+		store.EnqueueRemoval("2.2.2.2", nil)
+		pending, _, _ = store.QueuedOps()
+		for i := 0; i < outboxMaxAttempts; i++ {
+			store.FailOp(pending[0].ID, errors.New("boom"), time.Now())
+		}
+		if err := store.CompleteOp(pending[0].ID); err != nil {
+			t.Fatalf("CompleteOp() of a dead letter error: %v", err)
+		}
+		if _, dead, _ := store.QueuedOps(); len(dead) != 0 || ownsIP(t, store, "2.2.2.2") {
+			t.Errorf("dead letters after CompleteOp = %v, want none", dead)
+		}
+	})
+}
+
+func TestStoreEntryMetadata(t *testing.T) {
+	forEachStore(t, func(t *testing.T, reopen func() Store) {
+		created := time.Now().Add(-time.Hour).Truncate(time.Second)
+		meta := EntryMeta{CreatedAt: created, CreatedBy: "203.0.113.1", Reason: "deploy", Backend: "fake"}
+		expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+		store.Add("1.1.1.1", expiry, meta)
+		store.Add("1.1.1.1", expiry.Add(time.Hour), EntryMeta{Reason: "ignored"})
+		store.Add("1.1.1.1", expiry.Add(2*time.Hour), EntryMeta{})
+		store.SetRuleID("1.1.1.1", "rule-1")
+		store.Add("2.2.2.2", expiry, EntryMeta{})
+
+		store = reopen()
+		e, ok, _ := store.Entry("1.1.1.1")
+		if !ok || !e.ExpiresAt.Equal(expiry.Add(2*time.Hour)) || e.RuleID != "rule-1" {
+			t.Fatalf("Entry(1.1.1.1) = %+v, %v", e, ok)
+		}
+		if !e.CreatedAt.Equal(created) || e.CreatedBy != "203.0.113.1" || e.Reason != "deploy" || e.Backend != "fake" || e.Extensions != 2 {
+			t.Errorf("metadata = %+v, want the original with 2 extensions", e.EntryMeta)
+		}
+
+		entries, _ := store.ListEntries()
+		if len(entries) != 2 || entries[0].IP != "1.1.1.1" || entries[1].CreatedAt.IsZero() {
+			t.Errorf("ListEntries() = %+v", entries)
+		}
+
+		// Removal forgets the metadata
+		store.Remove("1.1.1.1")
+		store.Add("1.1.1.1", expiry, EntryMeta{})
+		if e, _, _ := store.Entry("1.1.1.1"); e.Reason != "" || e.Extensions != 0 {
+			t.Errorf("re-added entry kept old metadata: %+v", e.EntryMeta)
+		}
+	})
+}
+
+func TestStoreHistory(t *testing.T) {
+	forEachStore(t, func(t *testing.T, reopen func() Store) {
+		start := time.Now()
+		store.Add("1.1.1.1", start.Add(time.Hour), EntryMeta{})
+		store.Add("1.1.1.1", start.Add(2*time.Hour), EntryMeta{})
+		store.Add("2.2.2.2", start.Add(time.Hour), EntryMeta{})
+		store.Add("3.3.3.3", start.Add(time.Hour), EntryMeta{})
+		store.EnqueueRemoval("2.2.2.2", nil)
+		store.EnqueueRemoval("3.3.3.3", nil) // removal still queued
+		due, _ := store.DueOps(time.Now().Add(time.Hour))
+		for _, op := range due {
+			if op.IP == "2.2.2.2" {
+				store.CompleteOp(op.ID)
+			}
+		}
+		store.Remove("1.1.1.1")
+		store.Add("4.4.4.4", start.Add(time.Hour), EntryMeta{})
+		store.Expire("4.4.4.4")
+
+		store = reopen()
+		var got []string
+		events, err := store.History("", time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range events {
+			got = append(got, e.IP+" "+e.Event)
+		}
+		want := []string{"1.1.1.1 whitelisted", "1.1.1.1 extended", "2.2.2.2 whitelisted", "3.3.3.3 whitelisted", "2.2.2.2 expired", "1.1.1.1 removed", "4.4.4.4 whitelisted", "4.4.4.4 expired"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("History() = %v, want %v", got, want)
+		}
+		if events[1].ExpiresAt == nil || events[1].ExpiresAt.Before(start.Add(2*time.Hour).Add(-time.Millisecond)) {
+			t.Errorf("extended event expiry = %v", events[1].ExpiresAt)
+		}
+
+		if events, _ := store.History("2.2.2.2", time.Time{}, time.Time{}); len(events) != 2 {
+			t.Errorf("History(2.2.2.2) = %v", events)
+		}
+		if events, _ := store.History("", time.Now().Add(time.Minute), time.Time{}); len(events) != 0 {
+			t.Errorf("History from the future = %v", events)
+		}
+
+		// Old events are dropped on the next change
+		origRetention := historyRetention
+		historyRetention = time.Nanosecond
+		defer func() { historyRetention = origRetention }()
+		time.Sleep(2 * time.Millisecond)
+		store.Add("3.3.3.3", start.Add(time.Hour), EntryMeta{})
+		if events, _ := store.History("", time.Time{}, time.Time{}); len(events) != 1 {
+			t.Errorf("History() after retention = %v, want only the new event", events)
+		}
+	})
+}
+
+func TestStoreAPIKeys(t *testing.T) {
+	forEachStore(t, func(t *testing.T, reopen func() Store) {
+		created := time.Now().Truncate(time.Second)
+		expires := created.Add(24 * time.Hour)
+		ci := APIKey{ID: "k1", Name: "ci", Hash: "h1", Scopes: []string{permWhitelistAny, permAdminRead}, MaxDuration: "1h0m0s", ExpiresAt: &expires, CreatedAt: created}
+		bot := APIKey{ID: "k2", Name: "bot", Hash: "h2", Scopes: []string{permWhitelistSelf}, CreatedAt: created.Add(time.Second), CreatedBy: "admin"}
+		if err := store.SaveAPIKey(bot); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SaveAPIKey(ci); err != nil {
+			t.Fatal(err)
+		}
+
+		store = reopen()
+		got, ok, _ := store.APIKey("k1")
+		if !ok || got.Name != "ci" || got.Hash != "h1" || !reflect.DeepEqual(got.Scopes, ci.Scopes) ||
+			got.MaxDuration != "1h0m0s" || got.ExpiresAt == nil || !got.ExpiresAt.Equal(expires) || !got.CreatedAt.Equal(created) {
+			t.Errorf("APIKey(k1) = %+v, %v", got, ok)
+		}
+		if got, ok, _ := store.APIKey("k2"); !ok || got.ExpiresAt != nil || got.CreatedBy != "admin" {
+			t.Errorf("APIKey(k2) = %+v, %v", got, ok)
+		}
+		var ids []string
+		keys, _ := store.ListAPIKeys()
+		for _, key := range keys {
+			ids = append(ids, key.ID)
+		}
+		if want := []string{"k1", "k2"}; !reflect.DeepEqual(ids, want) {
+			t.Errorf("ListAPIKeys() = %v, want %v", ids, want)
+		}
+
+		if found, err := store.RevokeAPIKey("k1"); !found || err != nil {
+			t.Errorf("RevokeAPIKey(k1) = %v, %v", found, err)
+		}
+		if found, err := store.RevokeAPIKey("k1"); found || err != nil {
+			t.Errorf("RevokeAPIKey(k1) again = %v, %v", found, err)
+		}
+		store = reopen()
+		if _, ok, _ := store.APIKey("k1"); ok {
+			t.Error("revoked key still stored")
+		}
+		if keys, _ := store.ListAPIKeys(); len(keys) != 1 {
+			t.Errorf("ListAPIKeys() after revoking = %+v", keys)
+		}
+	})
+}
+
+func TestStoreTOTP(t *testing.T) {
+	forEachStore(t, func(t *testing.T, reopen func() Store) {
+		created := time.Now().Truncate(time.Second)
+		e := TOTPEnrollment{User: "alice@example.com", Secret: "SECRET", RecoveryCodes: []string{"r1", "r2"}, CreatedAt: created}
+		if err := store.SaveTOTP(e); err != nil {
+			t.Fatal(err)
+		}
+		e.Confirmed, e.LastStep = true, 100
+		if err := store.SaveTOTP(e); err != nil {
+			t.Fatal(err)
+		}
+
+		store = reopen()
+		got, ok, err := store.TOTP("alice@example.com")
+		if err != nil || !ok || got.Secret != "SECRET" || !got.Confirmed || got.LastStep != 100 ||
+			!reflect.DeepEqual(got.RecoveryCodes, e.RecoveryCodes) || !got.CreatedAt.Equal(created) {
+			t.Errorf("TOTP(alice) = %+v, %v, %v", got, ok, err)
+		}
+		if _, ok, err := store.TOTP("bob@example.com"); ok || err != nil {
+			t.Errorf("TOTP(bob) = %v, %v", ok, err)
+		}
+
+		for _, tt := range []struct {
+			step int64
+			want bool
+		}{{100, false}, {99, false}, {101, true}, {101, false}} {
+			if used, err := store.UseTOTPStep("alice@example.com", tt.step); used != tt.want || err != nil {
+				t.Errorf("UseTOTPStep(%d) = %v, %v, want %v", tt.step, used, err, tt.want)
+			}
+		}
+		if used, err := store.UseTOTPStep("bob@example.com", 1); used || err != nil {
+			t.Errorf("UseTOTPStep(bob) = %v, %v", used, err)
+		}
+		if used, err := store.UseRecoveryCode("alice@example.com", "r1"); !used || err != nil {
+			t.Errorf("UseRecoveryCode(r1) = %v, %v", used, err)
+		}
+		if used, err := store.UseRecoveryCode("alice@example.com", "r1"); used || err != nil {
+			t.Errorf("UseRecoveryCode(r1) again = %v, %v", used, err)
+		}
+
+		store = reopen()
+		if got, _, _ := store.TOTP("alice@example.com"); got.LastStep != 101 || !reflect.DeepEqual(got.RecoveryCodes, []string{"r2"}) {
+			t.Errorf("after use: %+v", got)
+		}
+		if found, err := store.DeleteTOTP("alice@example.com"); !found || err != nil {
+			t.Errorf("DeleteTOTP(alice) = %v, %v", found, err)
+		}
+		if found, err := store.DeleteTOTP("alice@example.com"); found || err != nil {
+			t.Errorf("DeleteTOTP(alice) again = %v, %v", found, err)
+		}
+		store = reopen()
+		if _, ok, _ := store.TOTP("alice@example.com"); ok {
+			t.Error("deleted enrollment still stored")
+		}
+	})
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whitelist.db")
+	s, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := s.SchemaVersion()
+	if err != nil || version != len(sqliteMigrations) {
+		t.Errorf("SchemaVersion() = %d, %v, want %d", version, err, len(sqliteMigrations))
+	}
+	s.Close()
+
+	// Reopening an up-to-date database applies nothing
+	s, err = openSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+
+	// A database from a newer build is refused
+	if _, err := s.db.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, 0)`, len(sqliteMigrations)+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openSQLiteStore(path); err == nil {
+		t.Error("opening a database with a newer schema succeeded")
+	}
+}
+
+func TestSQLiteImportJSON(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "whitelist_store.json")
+	expiry := time.Now().Add(time.Hour).UTC().Truncate(time.Second).Format(time.RFC3339)
+	created := time.Now().Add(-2 * time.Hour).UTC().Truncate(time.Second).Format(time.RFC3339)
+	whitelisted := time.Now().Add(-time.Hour).UTC().Truncate(time.Second).Format(time.RFC3339)
+	data := `{
+		"entries": {"1.1.1.1": "` + expiry + `", "4.4.4.4": "` + expiry + `", "5.5.5.5": "` + expiry + `"},
+		"meta": {"4.4.4.4": {"createdAt": "` + created + `"}, "5.5.5.5": {"createdAt": "` + whitelisted + `"}},
+		"history": [{"ip": "5.5.5.5", "event": "whitelisted", "at": "` + whitelisted + `", "expiresAt": "` + expiry + `"}],
+		"ruleIds": {"1.1.1.1": "rule-1", "2.2.2.2": "rule-2"},
+		"outbox": [{"id": "op-1", "kind": "remove", "ip": "2.2.2.2", "ruleId": "rule-2", "createdAt": "2025-01-01T00:00:00Z", "attempts": 1, "nextAttempt": "2025-01-01T00:00:30Z"}],
+		"deadLetters": [{"id": "op-2", "kind": "remove", "ip": "3.3.3.3", "createdAt": "2025-01-01T00:00:00Z", "attempts": 10, "nextAttempt": "2025-01-01T01:00:00Z", "lastError": "boom"}]
+	}`
+	if err := os.WriteFile(jsonPath, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openSQLiteStore(filepath.Join(dir, "whitelist.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.ImportJSON(jsonPath); err != nil {
+		t.Fatalf("ImportJSON() error: %v", err)
+	}
+
+	if _, ok, _ := s.Expiry("1.1.1.1"); !ok || ruleIDOf(t, s, "1.1.1.1") != "rule-1" {
+		t.Error("entry not imported")
+	}
+	pending, dead, _ := s.QueuedOps()
+	if len(pending) != 1 || pending[0].ID != "op-1" || pending[0].RuleID != "rule-2" {
+		t.Errorf("imported outbox = %v", pending)
+	}
+	if len(dead) != 1 || dead[0].ID != "op-2" || dead[0].LastError != "boom" {
+		t.Errorf("imported dead letters = %v", dead)
+	}
+
+	// The import runs once: later changes to the file are ignored
+	s.Remove("1.1.1.1")
+	if err := s.ImportJSON(jsonPath); err != nil {
+		t.Fatalf("second ImportJSON() error: %v", err)
+	}
+	if _, ok, _ := s.Expiry("1.1.1.1"); ok {
+		t.Error("second import brought a removed entry back")
+	}
+
+	// History is imported as recorded, never invented at import time
+	for ip, want := range map[string][]string{
+		"1.1.1.1": {"removed"},                    // no history, creation unknown
+		"4.4.4.4": {"whitelisted@" + created},     // no history, from the metadata
+		"5.5.5.5": {"whitelisted@" + whitelisted}, // the file's own history
+	} {
+		events, err := s.History(ip, time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatalf("History(%s) error: %v", ip, err)
+		}
+		var got []string
+		for _, e := range events {
+			if e.Event == HistoryRemoved {
+				got = append(got, e.Event)
+			} else {
+				got = append(got, e.Event+"@"+e.At.UTC().Format(time.RFC3339))
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("History(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestRedisStoreSharedBetweenReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := openTestRedisStore(t, mr.Addr())
+	b := openTestRedisStore(t, mr.Addr())
+
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := a.AddWithRule("1.1.1.1", expiry, "rule-1", EntryMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok, _ := b.Expiry("1.1.1.1"); !ok || !got.Equal(expiry) || ruleIDOf(t, b, "1.1.1.1") != "rule-1" {
+		t.Errorf("replica b sees %v, %v, rule %q", got, ok, ruleIDOf(t, b, "1.1.1.1"))
+	}
+
+	// A removal queued by one replica is retried by whichever runs next
+	a.EnqueueRemoval("1.1.1.1", nil)
+	due, _ := b.DueOps(time.Now().Add(outboxBaseBackoff))
+	if len(due) != 1 || due[0].RuleID != "rule-1" {
+		t.Fatalf("replica b due ops = %v", due)
+	}
+	if due, _ := b.DueOps(time.Now()); len(due) != 0 {
+		t.Errorf("removal due before its backoff: %v", due)
+	}
+	b.CompleteOp(due[0].ID)
+	if ownsIP(t, a, "1.1.1.1") || ruleIDOf(t, a, "1.1.1.1") != "" {
+		t.Error("completed removal still owned on replica a")
+	}
+}
+
+func TestRedisImportJSON(t *testing.T) {
+	jsonPath := filepath.Join(t.TempDir(), "whitelist_store.json")
+	expiry := time.Now().Add(time.Hour).UTC().Truncate(time.Second).Format(time.RFC3339)
+	created := time.Now().Add(-2 * time.Hour).UTC().Truncate(time.Second).Format(time.RFC3339)
+	data := `{
+		"entries": {"1.1.1.1": "` + expiry + `", "4.4.4.4": "` + expiry + `"},
+		"meta": {"4.4.4.4": {"createdAt": "` + created + `"}},
+		"ruleIds": {"1.1.1.1": "rule-1"},
+		"deadLetters": [{"id": "op-2", "kind": "remove", "ip": "3.3.3.3", "createdAt": "2025-01-01T00:00:00Z", "attempts": 10, "nextAttempt": "2025-01-01T01:00:00Z", "lastError": "boom"}]
+	}`
+	if err := os.WriteFile(jsonPath, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mr := miniredis.RunT(t)
+	s := openTestRedisStore(t, mr.Addr())
+	if err := s.ImportJSON(jsonPath); err != nil {
+		t.Fatalf("ImportJSON() error: %v", err)
+	}
+	if _, ok, _ := s.Expiry("1.1.1.1"); !ok || ruleIDOf(t, s, "1.1.1.1") != "rule-1" {
+		t.Error("entry not imported")
+	}
+	if _, dead, _ := s.QueuedOps(); len(dead) != 1 || dead[0].LastError != "boom" {
+		t.Errorf("imported dead letters = %v", dead)
+	}
+	// Like the SQLite import, history comes from the metadata when the
+	// file has none
+	if events, _ := s.History("4.4.4.4", time.Time{}, time.Time{}); len(events) != 1 ||
+		events[0].Event != HistoryWhitelisted || events[0].At.UTC().Format(time.RFC3339) != created {
+		t.Errorf("History(4.4.4.4) = %+v, want whitelisted at %s", events, created)
+	}
+	if events, _ := s.History("1.1.1.1", time.Time{}, time.Time{}); len(events) != 0 {
+		t.Errorf("History(1.1.1.1) = %+v, want none", events)
+	}
+
+	// Only the first replica to start imports the file
+	s.Remove("1.1.1.1")
+	if err := openTestRedisStore(t, mr.Addr()).ImportJSON(jsonPath); err != nil {
+		t.Fatalf("second ImportJSON() error: %v", err)
+	}
+	if _, ok, _ := s.Expiry("1.1.1.1"); ok {
+		t.Error("second import brought a removed entry back")
+	}
+}
+
+func TestStoreOutageRefusesRequests(t *testing.T) {
+	withTestStore(t, newFakeProvider("198.51.100.1"))
+	withTestAdminToken(t)
+	mr := miniredis.RunT(t)
+	store = openTestRedisStore(t, mr.Addr())
+	store.Add("198.51.100.1", time.Now().Add(time.Hour), EntryMeta{})
+	r := newRouter()
+
+	// Not "not managed by this service" or an empty list
+	mr.Close()
+	for _, path := range []string{"DELETE /whitelist?ip=198.51.100.1", "GET /admin/entries", "GET /admin/outbox", "GET /admin/api-keys"} {
+		method, target, _ := strings.Cut(path, " ")
+		if rr := callAPI(r, method, target, "secret", ""); rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s with the store down: status = %d, want 503", path, rr.Code)
+		}
+	}
+	var oe *opError
+	if err := whitelistIP(context.Background(), "198.51.100.2", time.Hour, EntryMeta{}); !errors.As(err, &oe) || oe.status != http.StatusServiceUnavailable {
+		t.Errorf("whitelistIP() with the store down = %v, want 503", err)
+	}
+	if _, err := reconcile(context.Background()); err == nil {
+		t.Error("reconcile() with the store down succeeded")
+	}
+}
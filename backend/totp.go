@@ -0,0 +1,613 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Signed-in users can enroll an authenticator app (RFC 6238 TOTP) with
+// POST /totp/enroll and POST /totp/confirm. POST /whitelist then wants a
+// fresh code from them, so a stolen session cookie alone cannot open the
+// firewall. Each code works once; recovery codes stand in for a lost
+// authenticator. TOTP_POLICY decides who needs a code, and
+// TOTP_TARGET_POLICIES overrides it for the target the provider changes.
+// API keys and ADMIN_TOKEN are not sessions and need no code.
+
+const (
+	totpPeriod = 30 // seconds per code
+	totpDigits = 6
+	// totpSkew is how many periods a code may be early or late, for clock drift
+	totpSkew          = 1
+	totpRecoveryCodes = 10
+	// totpMaxFailures invalid codes within totpFailureWindow lock a user
+	// out of code checks until the window has passed
+	totpMaxFailures   = 5
+	totpFailureWindow = 5 * time.Minute
+)
+
+// TOTP policies
+const (
+	totpOff      = "off"      // no codes
+	totpEnrolled = "enrolled" // users who enrolled send a code
+	totpRequired = "required" // every signed-in user enrolls and sends a code
+)
+
+// TOTPEnrollment is a user's authenticator.
+type TOTPEnrollment struct {
+	// User is the lowercased email of the user
+	User string `json:"user"`
+	// Secret is the base32 shared secret
+	Secret string `json:"secret"`
+	// Confirmed is set once the user sent a code from the authenticator;
+	// only confirmed enrollments are asked for codes
+	Confirmed bool `json:"confirmed"`
+	// LastStep is the time step of the last code used; it and earlier
+	// codes are not accepted again
+	LastStep int64 `json:"lastStep,omitempty"`
+	// RecoveryCodes are the hex SHA-256 of the unused recovery codes
+	RecoveryCodes []string  `json:"recoveryCodes,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+// totpStep returns the time step of t.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpCode returns the code of secret for step.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000), nil
+}
+
+// matchTOTP returns the step near now whose code is code.
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	step := totpStep(now)
+	for s := step - totpSkew; s <= step+totpSkew; s++ {
+		want, err := totpCode(secret, s)
+		if err == nil && hmac.Equal([]byte(want), []byte(code)) {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth:// URI that authenticator apps read from a
+// QR code.
+func totpURI(secret, user string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+user) + "?" + q.Encode()
+}
+
+// newRecoveryCodes returns recovery codes such as "k3j9x-p2m4q".
+func newRecoveryCodes() []string {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	codes := make([]string, totpRecoveryCodes)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		for j := range b {
+			b[j] = alphabet[int(b[j])%len(alphabet)]
+		}
+		codes[i] = string(b[:5]) + "-" + string(b[5:])
+	}
+	return codes
+}
+
+// hashRecoveryCode hashes a recovery code, ignoring case, spaces and dashes.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// enforcementTarget names what POST /whitelist changes: the provider and
+// the ID of its policy, group, list or access rule scope, e.g.
+// "access_policy:<CLOUDFLARE_POLICY_ID>".
+func enforcementTarget() string {
+	var id string
+	switch providerName {
+	case "access_policy":
+		id = policyID
+	case "access_group":
+		id = groupID
+	case "lists":
+		id = listID
+	case "access_rules":
+		id = zoneID
+		if accessRuleScope == "account" {
+			id = accountID
+		}
+	}
+	return providerName + ":" + id
+}
+
+// totpPolicyFor returns the TOTP policy of target: the TOTP_TARGET_POLICIES
+// entry for the target, else the one for its provider, else TOTP_POLICY.
+func totpPolicyFor(target string) string {
+	providerOnly, _, _ := strings.Cut(target, ":")
+	policy := totpPolicy
+	for _, p := range totpTargetPolicies {
+		t, mode, _ := strings.Cut(p, "=")
+		switch strings.TrimSpace(t) {
+		case target:
+			return strings.TrimSpace(mode)
+		case providerOnly:
+			policy = strings.TrimSpace(mode)
+		}
+	}
+	return policy
+}
+
+// checkTOTPConfig validates TOTP_POLICY and TOTP_TARGET_POLICIES.
+func checkTOTPConfig() error {
+	valid := func(mode string) bool {
+		return mode == totpOff || mode == totpEnrolled || mode == totpRequired
+	}
+	if !valid(totpPolicy) {
+		return fmt.Errorf("invalid TOTP_POLICY %q (want off, enrolled or required)", totpPolicy)
+	}
+	for _, p := range totpTargetPolicies {
+		t, mode, ok := strings.Cut(p, "=")
+		if !ok || strings.TrimSpace(t) == "" || !valid(strings.TrimSpace(mode)) {
+			return fmt.Errorf("invalid TOTP_TARGET_POLICIES entry %q (want target=off|enrolled|required)", p)
+		}
+	}
+	return nil
+}
+
+// totpUser returns the user of TOTP requests: the caller's lowercased
+// email. Only signed-in users have one.
+func totpUser(r *http.Request) (string, error) {
+	id, ok := identityFrom(r.Context())
+	if !ok || id.Email == "" || id.key != nil {
+		return "", &opError{http.StatusBadRequest, "TOTP is only for signed-in users"}
+	}
+	return strings.ToLower(id.Email), nil
+}
+
+// What POST /whitelist needs from a caller, besides the request
+const (
+	totpNeedCode   = "code"   // a code from their authenticator
+	totpNeedEnroll = "enroll" // an enrolled authenticator, which they lack
+)
+
+// totpRequirement returns what POST /whitelist needs from the caller of r
+// under the TOTP policy: totpNeedCode, totpNeedEnroll or nothing, along
+// with their enrollment. When the enrollment cannot be looked up it
+// returns a 503 error instead of letting the caller through.
+func totpRequirement(r *http.Request) (string, TOTPEnrollment, error) {
+	user, err := totpUser(r)
+	if err != nil {
+		return "", TOTPEnrollment{}, nil
+	}
+	policy := totpPolicyFor(enforcementTarget())
+	if policy == totpOff {
+		return "", TOTPEnrollment{}, nil
+	}
+	e, ok, err := store.TOTP(user)
+	if err != nil {
+		return "", TOTPEnrollment{}, storeUnavailable(err)
+	}
+	if ok && e.Confirmed {
+		return totpNeedCode, e, nil
+	}
+	if policy == totpRequired {
+		return totpNeedEnroll, TOTPEnrollment{}, nil
+	}
+	return "", TOTPEnrollment{}, nil
+}
+
+// checkTOTP enforces the TOTP policy on a POST /whitelist from the caller
+// of r, who sent code. It answers 403 rather than 401, since signing in
+// again does not help.
+func checkTOTP(r *http.Request, code string) error {
+	need, e, err := totpRequirement(r)
+	switch {
+	case err != nil:
+		return err
+	case need == totpNeedEnroll:
+		return &opError{http.StatusForbidden, "TOTP enrollment required: enroll an authenticator at POST /totp/enroll"}
+	case need == "":
+		return nil
+	case code == "":
+		return &opError{http.StatusForbidden, "TOTP code required"}
+	}
+	return useTOTPCode(e, code)
+}
+
+// useTOTPCode accepts a current code of e or one of its recovery codes,
+// each once.
+func useTOTPCode(e TOTPEnrollment, code string) error {
+	if totpFailures.blocked(e.User) {
+		return &opError{http.StatusTooManyRequests, "Too many invalid TOTP codes, try again later"}
+	}
+	code = strings.TrimSpace(code)
+	if step, ok := matchTOTP(e.Secret, code, time.Now()); ok {
+		fresh, err := store.UseTOTPStep(e.User, step)
+		if err != nil {
+			log.Printf("Error recording TOTP use of %s: %v", e.User, err)
+			return &opError{http.StatusInternalServerError, "Failed to check the TOTP code"}
+		}
+		if fresh {
+			totpFailures.reset(e.User)
+			return nil
+		}
+	} else if len(code) > totpDigits {
+		used, err := store.UseRecoveryCode(e.User, hashRecoveryCode(code))
+		if err != nil {
+			log.Printf("Error using a recovery code of %s: %v", e.User, err)
+			return &opError{http.StatusInternalServerError, "Failed to check the TOTP code"}
+		}
+		if used {
+			log.Printf("TOTP: %s used a recovery code", e.User)
+			totpFailures.reset(e.User)
+			return nil
+		}
+	}
+	totpFailures.fail(e.User)
+	return &opError{http.StatusForbidden, "Invalid TOTP code"}
+}
+
+// failureLimiter counts invalid codes per user, in memory: replicas
+// count separately.
+type failureLimiter struct {
+	mu       sync.Mutex
+	failures map[string][]time.Time
+}
+
+var totpFailures = &failureLimiter{failures: make(map[string][]time.Time)}
+
+// recent returns the failures of user within totpFailureWindow. The
+// caller holds l.mu.
+func (l *failureLimiter) recent(user string) []time.Time {
+	cutoff := time.Now().Add(-totpFailureWindow)
+	kept := l.failures[user][:0]
+	for _, t := range l.failures[user] {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	if len(kept) == 0 {
+		delete(l.failures, user)
+		return nil
+	}
+	l.failures[user] = kept
+	return kept
+}
+
+func (l *failureLimiter) blocked(user string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.recent(user)) >= totpMaxFailures
+}
+
+func (l *failureLimiter) fail(user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failures[user] = append(l.recent(user), time.Now())
+}
+
+func (l *failureLimiter) reset(user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, user)
+}
+
+// TOTPStatus is the response of GET /totp.
+type TOTPStatus struct {
+	Enrolled  bool `json:"enrolled"`
+	Confirmed bool `json:"confirmed"`
+	// Policy is the TOTP policy of the enforcement target
+	Policy string `json:"policy"`
+	// Required is whether POST /whitelist needs a code from the caller
+	Required          bool `json:"required"`
+	RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+}
+
+// TOTPEnrollResponse returns the new secret and recovery codes, the only
+// time they are shown.
+type TOTPEnrollResponse struct {
+	Secret string `json:"secret"`
+	// URI is the otpauth:// URI to show as a QR code
+	URI           string   `json:"uri"`
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// TOTPCodeRequest is the body of POST /totp/confirm and DELETE /totp.
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// handleTOTPStatus reports the caller's enrollment.
+func handleTOTPStatus(w http.ResponseWriter, r *http.Request) {
+	user, err := totpUser(r)
+	if err != nil {
+		writeOpError(w, err)
+		return
+	}
+	need, _, err := totpRequirement(r)
+	if err != nil {
+		writeOpError(w, err)
+		return
+	}
+	e, ok, err := store.TOTP(user)
+	if err != nil {
+		writeOpError(w, storeUnavailable(err))
+		return
+	}
+	resp := TOTPStatus{Policy: totpPolicyFor(enforcementTarget()), Required: need != ""}
+	if ok {
+		resp.Enrolled = true
+		resp.Confirmed = e.Confirmed
+		resp.RecoveryCodesLeft = len(e.RecoveryCodes)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleTOTPEnroll starts an enrollment, replacing an unconfirmed one.
+// Codes are only asked for once it is confirmed.
+func handleTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	user, err := totpUser(r)
+	if err != nil {
+		writeOpError(w, err)
+		return
+	}
+	if e, ok, err := store.TOTP(user); err != nil {
+		writeOpError(w, storeUnavailable(err))
+		return
+	} else if ok && e.Confirmed {
+		http.Error(w, "TOTP is already enabled; disable it first", http.StatusConflict)
+		return
+	}
+	e := TOTPEnrollment{User: user, Secret: newTOTPSecret(), CreatedAt: time.Now()}
+	codes := newRecoveryCodes()
+	for _, code := range codes {
+		e.RecoveryCodes = append(e.RecoveryCodes, hashRecoveryCode(code))
+	}
+	err = store.SaveTOTP(e)
+	recordTOTPAudit(newAuditSource(r, user), "totp.enroll", user, err)
+	if err != nil {
+		log.Printf("Error saving TOTP enrollment of %s: %v", user, err)
+		http.Error(w, "Failed to save the enrollment", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(TOTPEnrollResponse{Secret: e.Secret, URI: totpURI(e.Secret, user), RecoveryCodes: codes})
+}
+
+// handleTOTPConfirm enables an enrollment once the user sends a code from
+// their authenticator.
+func handleTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	user, err := totpUser(r)
+	if err != nil {
+		writeOpError(w, err)
+		return
+	}
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	e, ok, err := store.TOTP(user)
+	if err != nil {
+		writeOpError(w, storeUnavailable(err))
+		return
+	}
+	if !ok {
+		http.Error(w, "No TOTP enrollment to confirm", http.StatusNotFound)
+		return
+	}
+	if e.Confirmed {
+		http.Error(w, "TOTP is already enabled", http.StatusConflict)
+		return
+	}
+	if totpFailures.blocked(user) {
+		http.Error(w, "Too many invalid TOTP codes, try again later", http.StatusTooManyRequests)
+		return
+	}
+	step, ok := matchTOTP(e.Secret, strings.TrimSpace(req.Code), time.Now())
+	if !ok {
+		totpFailures.fail(user)
+		http.Error(w, "Invalid TOTP code", http.StatusBadRequest)
+		return
+	}
+	e.Confirmed = true
+	e.LastStep = step
+	err = store.SaveTOTP(e)
+	recordTOTPAudit(newAuditSource(r, user), "totp.confirm", user, err)
+	if err != nil {
+		log.Printf("Error saving TOTP enrollment of %s: %v", user, err)
+		http.Error(w, "Failed to save the enrollment", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("TOTP: enabled for %s", user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTOTPDisable removes the caller's enrollment. A confirmed one
+// takes a code or recovery code, so a stolen session cannot remove it.
+func handleTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	user, err := totpUser(r)
+	if err != nil {
+		writeOpError(w, err)
+		return
+	}
+	e, ok, err := store.TOTP(user)
+	if err != nil {
+		writeOpError(w, storeUnavailable(err))
+		return
+	}
+	if !ok {
+		http.Error(w, "TOTP is not enabled", http.StatusNotFound)
+		return
+	}
+	if e.Confirmed {
+		var req TOTPCodeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Code == "" {
+			http.Error(w, "TOTP code required", http.StatusForbidden)
+			return
+		}
+		if err := useTOTPCode(e, req.Code); err != nil {
+			writeOpError(w, err)
+			return
+		}
+	}
+	_, err = store.DeleteTOTP(user)
+	recordTOTPAudit(newAuditSource(r, user), "totp.disable", user, err)
+	if err != nil {
+		log.Printf("Error deleting TOTP enrollment of %s: %v", user, err)
+		http.Error(w, "Failed to delete the enrollment", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("TOTP: disabled for %s", user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleResetTOTP deletes a user's enrollment, for users who lost both
+// their authenticator and their recovery codes.
+func handleResetTOTP(w http.ResponseWriter, r *http.Request) {
+	user := strings.ToLower(chi.URLParam(r, "user"))
+	found, err := store.DeleteTOTP(user)
+	if found || err != nil {
+		recordTOTPAudit(newAuditSource(r, requestOwner(r, "admin")), "totp.reset", user, err)
+	}
+	if err != nil {
+		log.Printf("Error deleting TOTP enrollment of %s: %v", user, err)
+		http.Error(w, "Failed to delete the enrollment", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "No TOTP enrollment for that user", http.StatusNotFound)
+		return
+	}
+	log.Printf("Admin: reset TOTP of %s", user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// recordTOTPAudit appends a change to the TOTP enrollment of user to the
+// audit log.
+func recordTOTPAudit(src auditSource, action, user string, err error) {
+	rec := newAuditRecord(src, action, "", nil, err)
+	rec.User = user
+	appendAudit(rec)
+}
+
+func (s *WhitelistStore) TOTP(user string) (TOTPEnrollment, bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+	e, ok := s.TOTPEnrollments[user]
+	if !ok {
+		return TOTPEnrollment{}, false, nil
+	}
+	copied := *e
+	copied.RecoveryCodes = append([]string(nil), e.RecoveryCodes...)
+	return copied, true, nil
+}
+
+func (s *WhitelistStore) SaveTOTP(e TOTPEnrollment) error {
+	s.Lock()
+	if s.TOTPEnrollments == nil {
+		s.TOTPEnrollments = make(map[string]*TOTPEnrollment)
+	}
+	s.TOTPEnrollments[e.User] = &e
+	s.Unlock()
+	return s.Save()
+}
+
+func (s *WhitelistStore) DeleteTOTP(user string) (bool, error) {
+	s.Lock()
+	_, found := s.TOTPEnrollments[user]
+	delete(s.TOTPEnrollments, user)
+	s.Unlock()
+	if !found {
+		return false, nil
+	}
+	return true, s.Save()
+}
+
+func (s *WhitelistStore) UseTOTPStep(user string, step int64) (bool, error) {
+	s.Lock()
+	e, ok := s.TOTPEnrollments[user]
+	if !ok || step <= e.LastStep {
+		s.Unlock()
+		return false, nil
+	}
+	e.LastStep = step
+	s.Unlock()
+	return true, s.Save()
+}
+
+func (s *WhitelistStore) UseRecoveryCode(user, hash string) (bool, error) {
+	s.Lock()
+	e, ok := s.TOTPEnrollments[user]
+	if !ok {
+		s.Unlock()
+		return false, nil
+	}
+	codes, used := removeRecoveryCode(e.RecoveryCodes, hash)
+	e.RecoveryCodes = codes
+	s.Unlock()
+	if !used {
+		return false, nil
+	}
+	return true, s.Save()
+}
+
+// removeRecoveryCode returns codes without hash, and whether it was there.
+func removeRecoveryCode(codes []string, hash string) ([]string, bool) {
+	for i, c := range codes {
+		if hmac.Equal([]byte(c), []byte(hash)) {
+			return append(codes[:i:i], codes[i+1:]...), true
+		}
+	}
+	return codes, false
+}
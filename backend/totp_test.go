@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B (SHA-1), truncated to six digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got, err := totpCode(secret, totpStep(time.Unix(tt.unix, 0))); got != tt.want || err != nil {
+			t.Errorf("code at %d = %q, %v, want %q", tt.unix, got, err, tt.want)
+		}
+	}
+
+	now := time.Unix(1111111111, 0)
+	for _, code := range []string{"081804", "050471"} {
+		if _, ok := matchTOTP(secret, code, now); !ok {
+			t.Errorf("matchTOTP(%s) failed within the skew", code)
+		}
+	}
+	if _, ok := matchTOTP(secret, "287082", now); ok {
+		t.Error("matchTOTP accepted an old code")
+	}
+}
+
+func TestTOTPPolicyFor(t *testing.T) {
+	orig, origTargets := totpPolicy, totpTargetPolicies
+	t.Cleanup(func() { totpPolicy, totpTargetPolicies = orig, origTargets })
+	totpPolicy = totpEnrolled
+	totpTargetPolicies = []string{"access_policy:prod=required", "lists=off", "lists:ops = required"}
+
+	tests := []struct {
+		target, want string
+	}{
+		{"access_policy:prod", totpRequired},
+		{"access_policy:staging", totpEnrolled},
+		{"lists:other", totpOff},
+		{"lists:ops", totpRequired},
+		{"access_group:g", totpEnrolled},
+	}
+	for _, tt := range tests {
+		if got := totpPolicyFor(tt.target); got != tt.want {
+			t.Errorf("totpPolicyFor(%q) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+	if err := checkTOTPConfig(); err != nil {
+		t.Error(err)
+	}
+	totpTargetPolicies = []string{"lists=sometimes"}
+	if err := checkTOTPConfig(); err == nil {
+		t.Error("checkTOTPConfig accepted an unknown policy")
+	}
+}
+
+// withTestTOTPPolicy sets TOTP_POLICY and clears TOTP_TARGET_POLICIES and
+// the failure counts.
+func withTestTOTPPolicy(t *testing.T, policy string) {
+	t.Helper()
+	orig, origTargets := totpPolicy, totpTargetPolicies
+	totpPolicy, totpTargetPolicies = policy, nil
+	totpFailures = &failureLimiter{failures: make(map[string][]time.Time)}
+	t.Cleanup(func() { totpPolicy, totpTargetPolicies = orig, origTargets })
+}
+
+// callAs sends a request from 203.0.113.50 with cookie.
+func callAs(r http.Handler, cookie *http.Cookie, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("CF-Connecting-IP", "203.0.113.50")
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	return rr
+}
+
+// enrollTestTOTP enrolls and confirms alice, returning her secret and
+// recovery codes.
+func enrollTestTOTP(t *testing.T, r http.Handler) (string, []string) {
+	t.Helper()
+	rr := callAs(r, testSession(), "POST", "/totp/enroll", "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("enroll: status = %d: %s", rr.Code, rr.Body)
+	}
+	var enrolled TOTPEnrollResponse
+	json.NewDecoder(rr.Body).Decode(&enrolled)
+	if !strings.HasPrefix(enrolled.URI, "otpauth://totp/") || !strings.Contains(enrolled.URI, "secret="+enrolled.Secret) ||
+		len(enrolled.RecoveryCodes) != totpRecoveryCodes {
+		t.Fatalf("enrollment = %+v", enrolled)
+	}
+	code, _ := totpCode(enrolled.Secret, totpStep(time.Now()))
+	if rr := callAs(r, testSession(), "POST", "/totp/confirm", `{"code":"`+code+`"}`); rr.Code != http.StatusNoContent {
+		t.Fatalf("confirm: status = %d: %s", rr.Code, rr.Body)
+	}
+	return enrolled.Secret, enrolled.RecoveryCodes
+}
+
+func TestTOTPWhitelist(t *testing.T) {
+	withTestStore(t, newFakeProvider())
+	withTestOIDC(t, newMockOIDC(t))
+	withTestTOTPPolicy(t, totpEnrolled)
+	path := withTestAuditLog(t)
+	r := newRouter()
+
+	// Unconfirmed enrollments ask for nothing
+	if rr := callAs(r, testSession(), "POST", "/totp/enroll", ""); rr.Code != http.StatusCreated {
+		t.Fatalf("enroll: status = %d", rr.Code)
+	}
+	if rr := callAs(r, testSession(), "POST", "/whitelist", `{}`); rr.Code != http.StatusOK {
+		t.Fatalf("whitelist before confirming: status = %d: %s", rr.Code, rr.Body)
+	}
+	if rr := callAs(r, testSession(), "POST", "/totp/confirm", `{"code":"000000"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("confirm with a wrong code: status = %d", rr.Code)
+	}
+
+	secret, recovery := enrollTestTOTP(t, r)
+	if rr := callAs(r, testSession(), "POST", "/totp/enroll", ""); rr.Code != http.StatusConflict {
+		t.Errorf("enroll again: status = %d", rr.Code)
+	}
+	rr := callAs(r, testSession(), "GET", "/status", "")
+	var status StatusResponse
+	json.NewDecoder(rr.Body).Decode(&status)
+	if status.TOTP != totpNeedCode {
+		t.Errorf("status TOTP = %q, want %q", status.TOTP, totpNeedCode)
+	}
+
+	// The code used to confirm is spent; the next one is not
+	e, _, _ := store.TOTP("alice@example.com")
+	used, _ := totpCode(secret, e.LastStep)
+	next, _ := totpCode(secret, e.LastStep+1)
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"no code", `{}`, http.StatusForbidden},
+		{"spent code", `{"totpCode":"` + used + `"}`, http.StatusForbidden},
+		{"fresh code", `{"totpCode":"` + next + `"}`, http.StatusOK},
+		{"replayed code", `{"totpCode":"` + next + `"}`, http.StatusForbidden},
+		{"recovery code", `{"totpCode":"` + strings.ToUpper(recovery[0]) + `"}`, http.StatusOK},
+		{"spent recovery code", `{"totpCode":"` + recovery[0] + `"}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if rr := callAs(r, testSession(), "POST", "/whitelist", tt.body); rr.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d (%s)", tt.name, rr.Code, tt.want, strings.TrimSpace(rr.Body.String()))
+		}
+	}
+
+	// API keys are not sessions
+	key := createTestAPIKey(t, APIKey{Name: "ci", Scopes: []string{permWhitelistSelf}})
+	if rr := callAPI(r, "POST", "/whitelist", key, `{}`); rr.Code != http.StatusOK {
+		t.Errorf("API key: status = %d: %s", rr.Code, rr.Body)
+	}
+	if rr := callAPI(r, "GET", "/totp", key, ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("GET /totp with an API key: status = %d", rr.Code)
+	}
+
+	if rr := callAs(r, testSession(), "DELETE", "/totp", `{}`); rr.Code != http.StatusForbidden {
+		t.Errorf("disable without a code: status = %d", rr.Code)
+	}
+	if rr := callAs(r, testSession(), "DELETE", "/totp", `{"code":"`+recovery[1]+`"}`); rr.Code != http.StatusNoContent {
+		t.Errorf("disable: status = %d: %s", rr.Code, rr.Body)
+	}
+	if rr := callAs(r, testSession(), "POST", "/whitelist", `{}`); rr.Code != http.StatusOK {
+		t.Errorf("whitelist after disabling: status = %d", rr.Code)
+	}
+
+	var actions []string
+	for _, rec := range readAuditLog(t, path) {
+		if strings.HasPrefix(rec.Action, "totp.") {
+			actions = append(actions, rec.Action+" "+rec.User)
+		}
+	}
+	want := []string{
+		"totp.enroll alice@example.com",
+		"totp.enroll alice@example.com",
+		"totp.confirm alice@example.com",
+		"totp.disable alice@example.com",
+	}
+	if strings.Join(actions, "\n") != strings.Join(want, "\n") {
+		t.Errorf("audit records = %q, want %q", actions, want)
+	}
+}
+
+func TestTOTPRequiredPolicy(t *testing.T) {
+	withTestStore(t, newFakeProvider())
+	withTestOIDC(t, newMockOIDC(t))
+	withTestTOTPPolicy(t, totpEnrolled)
+	totpTargetPolicies = []string{providerName + "=" + totpRequired}
+	r := newRouter()
+
+	rr := callAs(r, testSession(), "POST", "/whitelist", `{}`)
+	if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "enrollment required") {
+		t.Errorf("unenrolled: status = %d: %s", rr.Code, rr.Body)
+	}
+	var status StatusResponse
+	json.NewDecoder(callAs(r, testSession(), "GET", "/status", "").Body).Decode(&status)
+	if status.TOTP != totpNeedEnroll {
+		t.Errorf("status TOTP = %q, want %q", status.TOTP, totpNeedEnroll)
+	}
+
+	secret, _ := enrollTestTOTP(t, r)
+	e, _, _ := store.TOTP("alice@example.com")
+	code, _ := totpCode(secret, e.LastStep+1)
+	if rr := callAs(r, testSession(), "POST", "/whitelist", `{"totpCode":"`+code+`"}`); rr.Code != http.StatusOK {
+		t.Errorf("enrolled: status = %d: %s", rr.Code, rr.Body)
+	}
+
+	totpTargetPolicies = []string{enforcementTarget() + "=" + totpOff}
+	if rr := callAs(r, testSession(), "POST", "/whitelist", `{}`); rr.Code != http.StatusOK {
+		t.Errorf("policy off for the target: status = %d: %s", rr.Code, rr.Body)
+	}
+}
+
+func TestTOTPFailureLimit(t *testing.T) {
+	withTestStore(t, newFakeProvider())
+	withTestOIDC(t, newMockOIDC(t))
+	withTestTOTPPolicy(t, totpEnrolled)
+	withTestAdminToken(t)
+	r := newRouter()
+	secret, _ := enrollTestTOTP(t, r)
+
+	for i := 0; i < totpMaxFailures; i++ {
+		if rr := callAs(r, testSession(), "POST", "/whitelist", `{"totpCode":"000000"}`); rr.Code != http.StatusForbidden {
+			t.Fatalf("invalid code %d: status = %d", i, rr.Code)
+		}
+	}
+	code, _ := totpCode(secret, totpStep(time.Now())+1)
+	if rr := callAs(r, testSession(), "POST", "/whitelist", `{"totpCode":"`+code+`"}`); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("valid code after too many failures: status = %d", rr.Code)
+	}
+
+	// An admin can reset the enrollment of a locked-out user
+	if rr := callAPI(r, "DELETE", "/admin/totp/Alice@example.com", "secret", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("reset: status = %d: %s", rr.Code, rr.Body)
+	}
+	if rr := callAPI(r, "DELETE", "/admin/totp/alice@example.com", "secret", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("reset again: status = %d", rr.Code)
+	}
+}
+
+func TestTOTPFailsClosedWithoutStore(t *testing.T) {
+	withTestStore(t, newFakeProvider())
+	withTestOIDC(t, newMockOIDC(t))
+	withTestTOTPPolicy(t, totpEnrolled)
+	mr := miniredis.RunT(t)
+	store = openTestRedisStore(t, mr.Addr())
+	r := newRouter()
+	enrollTestTOTP(t, r)
+
+	mr.Close()
+	for _, path := range []string{"/whitelist", "/totp/enroll"} {
+		if rr := callAs(r, testSession(), "POST", path, `{}`); rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("POST %s with the store down: status = %d, want 503", path, rr.Code)
+		}
+	}
+	if rr := callAs(r, testSession(), "GET", "/totp", ""); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /totp with the store down: status = %d, want 503", rr.Code)
+	}
+}
@@ -1,4 +1,4 @@
-import { Container, Title, Paper, Button, Slider, Text, Center, Stack, Loader, Group, Badge, Alert } from '@mantine/core';
+import { Anchor, Container, Title, Paper, Button, Slider, Text, TextInput, Center, Stack, Loader, Group, Badge, Alert } from '@mantine/core';
 import { useForm } from '@mantine/form';
 import { useState, useEffect } from 'react';
 
@@ -7,8 +7,23 @@ interface StatusData {
   whitelisted: boolean;
   expiresAt?: string;
   timeRemaining?: string;
+  user?: {
+    email: string;
+    method: string;
+  };
+  // What POST /whitelist needs: a TOTP code, or enrolling first
+  totp?: 'code' | 'enroll';
 }
 
+// Without a session the API answers 401: sign in and come back here
+const signInOn401 = (res: Response) => {
+  if (res.status === 401) {
+    window.location.href = '/auth/login?return=' + encodeURIComponent(window.location.pathname);
+    throw new Error('Not signed in');
+  }
+  return res;
+};
+
 function App() {
   const [submitted, setSubmitted] = useState(false);
   const [status, setStatus] = useState<StatusData | null>(null);
@@ -18,12 +33,14 @@ function App() {
   const form = useForm({
     initialValues: {
       duration: 1, // Default 1 day
+      totpCode: '',
     },
   });
 
   const fetchStatus = () => {
     setLoadingStatus(true);
     fetch('/status')
+      .then(signInOn401)
       .then(res => res.json())
       .then(data => {
         setStatus(data);
@@ -49,14 +66,19 @@ function App() {
       headers: {
         'Content-Type': 'application/json',
       },
-      body: JSON.stringify({ duration: (values.duration * 1440).toString() }), // Convert days to minutes
+      body: JSON.stringify({
+        duration: (values.duration * 1440).toString(), // Convert days to minutes
+        totpCode: values.totpCode || undefined,
+      }),
     })
+      .then(signInOn401)
       .then(res => {
         if (!res.ok) throw new Error('Network response was not ok');
         return res.json();
       })
       .then(data => {
         console.log('Success:', data);
+        form.setFieldValue('totpCode', '');
         setTimeout(() => {
           setSubmitted(false);
           setActionLoading(false);
@@ -81,6 +103,7 @@ function App() {
     fetch('/whitelist', {
       method: 'DELETE',
     })
+      .then(signInOn401)
       .then(res => {
         if (!res.ok) throw new Error('Failed to remove IP');
         return res.json();
@@ -110,8 +133,33 @@ function App() {
               <Text size="md" fw={500} mt={10}>
                 {loadingStatus ? <Loader size="xs" type="dots" /> : `Your IP: ${status?.ip}`}
               </Text>
+              {status?.user && (
+                <Text c="dimmed" size="xs" mt={4}>
+                  Signed in as {status.user.email}
+                  {status.user.method === 'oidc' && (
+                    <> · <Anchor href="/auth/logout" size="xs">Log out</Anchor></>
+                  )}
+                </Text>
+              )}
             </div>
 
+            {!loadingStatus && status?.totp === 'enroll' && (
+              <Alert color="yellow" title="Authenticator required">
+                <Text size="sm">
+                  Enroll an authenticator app (POST /totp/enroll) before whitelisting your IP.
+                </Text>
+              </Alert>
+            )}
+
+            {!loadingStatus && status?.totp === 'code' && (
+              <TextInput
+                label="Authenticator code"
+                placeholder="123456"
+                autoComplete="one-time-code"
+                {...form.getInputProps('totpCode')}
+              />
+            )}
+
             {!loadingStatus && status?.whitelisted && (
               <Alert color="green" title="IP Whitelisted">
                 <Text size="sm" mb="xs">